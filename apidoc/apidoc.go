@@ -0,0 +1,253 @@
+// Package apidoc generates a machine-readable API description for Drift.
+//
+// The description is an OpenAPI 3 document. Its operations come from the
+// cookoo route registry, so every route is listed with its help text. The
+// parameters, headers, and responses of each route are declared separately
+// in a Spec, keyed by route name.
+package apidoc
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/cookoo"
+)
+
+// OpenAPIVersion is the version of the OpenAPI specification generated.
+const OpenAPIVersion = "3.0.3"
+
+// Parameter locations.
+const (
+	InPath   = "path"
+	InQuery  = "query"
+	InHeader = "header"
+)
+
+// Param describes a single request parameter.
+type Param struct {
+	Name        string
+	In          string
+	Description string
+	Required    bool
+	// Type is a JSON Schema type name. Default is "string".
+	Type string
+}
+
+// Header describes a response header.
+type Header struct {
+	Name        string
+	Description string
+	Type        string
+}
+
+// Response describes a single response code.
+type Response struct {
+	Description string
+	ContentType string
+	Headers     []Header
+}
+
+// Endpoint describes the details of a route that are not in the registry.
+type Endpoint struct {
+	// Params are the route's parameters. Path parameters fill in the route's
+	// wildcards, in order.
+	Params []Param
+	// Body is the content type of the request body, if there is one.
+	Body string
+	// Responses maps HTTP status codes to their descriptions.
+	Responses map[int]Response
+}
+
+// Spec holds the information needed to describe an API.
+type Spec struct {
+	Title     string
+	Version   string
+	Endpoints map[string]Endpoint
+}
+
+// Generate builds an OpenAPI document from a set of routes.
+//
+// Route names are expected to be of the form "METHOD /path", where the path
+// may contain "*" wildcards. Routes that do not look like this are skipped.
+func (s *Spec) Generate(routes []cookoo.RouteDetails) map[string]interface{} {
+	paths := map[string]map[string]interface{}{}
+	for _, r := range routes {
+		parts := strings.SplitN(r.Name(), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		method, route := strings.ToLower(parts[0]), parts[1]
+		e := s.Endpoints[r.Name()]
+		path, extra := fillPath(route, e.Params)
+		e.Params = append(append([]Param{}, e.Params...), extra...)
+
+		if _, ok := paths[path]; !ok {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][method] = operation(r, e)
+	}
+
+	return map[string]interface{}{
+		"openapi": OpenAPIVersion,
+		"info": map[string]interface{}{
+			"title":   s.Title,
+			"version": s.Version,
+		},
+		"paths": paths,
+	}
+}
+
+// operation builds an OpenAPI operation for a single route.
+func operation(r cookoo.RouteDetails, e Endpoint) map[string]interface{} {
+	op := map[string]interface{}{
+		"operationId": operationID(r.Name()),
+		"summary":     r.Description(),
+	}
+
+	params := make([]interface{}, 0, len(e.Params))
+	for _, p := range e.Params {
+		params = append(params, map[string]interface{}{
+			"name":        p.Name,
+			"in":          p.In,
+			"description": p.Description,
+			// Path parameters are always required.
+			"required": p.Required || p.In == InPath,
+			"schema":   schema(p.Type),
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if len(e.Body) > 0 {
+		op["requestBody"] = map[string]interface{}{
+			"content": map[string]interface{}{
+				e.Body: map[string]interface{}{},
+			},
+		}
+	}
+
+	responses := map[string]interface{}{}
+	codes := make([]int, 0, len(e.Responses))
+	for c := range e.Responses {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+	for _, c := range codes {
+		res := e.Responses[c]
+		desc := res.Description
+		if len(desc) == 0 {
+			desc = http.StatusText(c)
+		}
+		out := map[string]interface{}{"description": desc}
+		if len(res.ContentType) > 0 {
+			out["content"] = map[string]interface{}{
+				res.ContentType: map[string]interface{}{},
+			}
+		}
+		if len(res.Headers) > 0 {
+			headers := map[string]interface{}{}
+			for _, h := range res.Headers {
+				headers[h.Name] = map[string]interface{}{
+					"description": h.Description,
+					"schema":      schema(h.Type),
+				}
+			}
+			out["headers"] = headers
+		}
+		responses[strconv.Itoa(c)] = out
+	}
+	if len(responses) == 0 {
+		responses["default"] = map[string]interface{}{"description": "Undocumented response."}
+	}
+	op["responses"] = responses
+
+	return op
+}
+
+// fillPath replaces each "*" in a route with the next path parameter.
+//
+// Wildcards without a declared path parameter are given generated names,
+// and parameters for them are returned so that the document stays valid.
+func fillPath(route string, params []Param) (string, []Param) {
+	names := []string{}
+	for _, p := range params {
+		if p.In == InPath {
+			names = append(names, p.Name)
+		}
+	}
+	extra := []Param{}
+	segments := strings.Split(route, "/")
+	i := 0
+	for j, seg := range segments {
+		if seg != "*" {
+			continue
+		}
+		var name string
+		if i < len(names) {
+			name = names[i]
+		} else {
+			name = "param" + strconv.Itoa(i+1)
+			extra = append(extra, Param{Name: name, In: InPath})
+		}
+		segments[j] = "{" + name + "}"
+		i++
+	}
+	return strings.Join(segments, "/"), extra
+}
+
+// operationID turns a route name like "GET /v1/t/*" into "getV1T".
+func operationID(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z':
+			if upper {
+				r -= 'a' - 'A'
+			}
+			b.WriteRune(r)
+			upper = false
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+			upper = false
+		default:
+			upper = b.Len() > 0
+		}
+	}
+	return b.String()
+}
+
+func schema(t string) map[string]interface{} {
+	if len(t) == 0 {
+		t = "string"
+	}
+	return map[string]interface{}{"type": t}
+}
+
+// Serve writes an OpenAPI document describing the routes as JSON.
+//
+// Params:
+// 	- spec (*Spec): The declared details of the API.
+// 	- routes ([]cookoo.RouteDetails): The routes from the registry.
+//
+// Returns:
+// 	- map[string]interface{}: The OpenAPI document.
+func Serve(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	spec := p.Get("spec", &Spec{}).(*Spec)
+	routes := p.Get("routes", []cookoo.RouteDetails{}).([]cookoo.RouteDetails)
+
+	doc := spec.Generate(routes)
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	w := c.Get("http.ResponseWriter", nil).(http.ResponseWriter)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	return doc, nil
+}
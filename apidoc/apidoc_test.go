@@ -0,0 +1,94 @@
+package apidoc
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Masterminds/cookoo"
+)
+
+func TestGenerate(t *testing.T) {
+	reg, _, _ := cookoo.Cookoo()
+	reg.Route("GET /v1/t/*", "Subscribe to a topic.")
+	reg.Route("DELETE /v1/t/*", "Delete a topic.")
+	reg.Route("GET /ping", "Ping.")
+	reg.Route("not-http", "Skipped.")
+
+	spec := &Spec{
+		Title:   "Test",
+		Version: "v1",
+		Endpoints: map[string]Endpoint{
+			"GET /v1/t/*": {
+				Params: []Param{
+					{Name: "topic", In: InPath},
+					{Name: "X-History-Length", In: InHeader, Type: "integer"},
+				},
+				Responses: map[int]Response{
+					200: {ContentType: "application/octet-stream", Headers: []Header{{Name: "X-History-Enabled"}}},
+				},
+			},
+		},
+	}
+
+	data, err := json.Marshal(spec.Generate(reg.Routes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		OpenAPI string
+		Paths   map[string]map[string]struct {
+			OperationID string
+			Summary     string
+			Parameters  []struct {
+				Name     string
+				In       string
+				Required bool
+				Schema   struct{ Type string }
+			}
+			Responses map[string]struct {
+				Description string
+				Headers     map[string]interface{}
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.OpenAPI != OpenAPIVersion {
+		t.Errorf("Expected version %s, got %s", OpenAPIVersion, doc.OpenAPI)
+	}
+	if len(doc.Paths) != 3 {
+		t.Errorf("Expected 3 paths, got %d: %v", len(doc.Paths), doc.Paths)
+	}
+
+	get, ok := doc.Paths["/v1/t/{topic}"]["get"]
+	if !ok {
+		t.Fatalf("Expected GET /v1/t/{topic}, got %v", doc.Paths)
+	}
+	if get.OperationID != "getV1T" {
+		t.Errorf("Expected operationId getV1T, got %s", get.OperationID)
+	}
+	if get.Summary != "Subscribe to a topic." {
+		t.Errorf("Expected summary from registry, got %q", get.Summary)
+	}
+	if len(get.Parameters) != 2 || !get.Parameters[0].Required || get.Parameters[1].Schema.Type != "integer" {
+		t.Errorf("Unexpected parameters: %+v", get.Parameters)
+	}
+	if res := get.Responses["200"]; res.Description != "OK" || res.Headers["X-History-Enabled"] == nil {
+		t.Errorf("Unexpected 200 response: %+v", res)
+	}
+
+	// Undocumented routes are still listed, with generated path parameters.
+	del, ok := doc.Paths["/v1/t/{param1}"]["delete"]
+	if !ok {
+		t.Fatalf("Expected DELETE /v1/t/{param1}, got %v", doc.Paths)
+	}
+	if len(del.Parameters) != 1 || del.Parameters[0].Name != "param1" || !del.Parameters[0].Required {
+		t.Errorf("Expected a generated path parameter, got %+v", del.Parameters)
+	}
+	if _, ok := del.Responses["default"]; !ok {
+		t.Errorf("Expected a default response, got %v", del.Responses)
+	}
+}
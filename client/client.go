@@ -3,11 +3,20 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/technosophos/drift/transport"
@@ -15,6 +24,58 @@ import (
 
 const v1Path = "/v1/t/"
 
+// unixScheme is the URL prefix for servers listening on a Unix socket.
+//
+// A URL like unix:///var/run/drift.sock names the socket. Requests over the
+// socket are made with cleartext HTTP/2.
+const unixScheme = "unix://"
+
+// closeReason is the trailer in which the server says why it ended a
+// subscription.
+const closeReason = "X-Close-Reason"
+
+// Reasons the server gives for ending a subscription. See ClosedError.
+const (
+	// ReasonDeleted means the topic was deleted.
+	ReasonDeleted = "deleted"
+	// ReasonExpired means the topic was deleted for being idle.
+	ReasonExpired = "expired"
+	// ReasonShutdown means the server is shutting down.
+	ReasonShutdown = "shutdown"
+	// ReasonOverflow means live messages were lost while history was
+	// replayed, because the subscriber fell too far behind. Resubscribe
+	// from the last message received to fill the gap.
+	ReasonOverflow = "overflow"
+)
+
+// ErrStreamEnded is returned by Subscription.Err when a subscription ended
+// without the server saying why, such as when the connection was lost or
+// the subscription was cancelled.
+var ErrStreamEnded = errors.New("Subscription stream ended unexpectedly.")
+
+// ClosedError reports that the server ended a subscription on purpose.
+type ClosedError struct {
+	Topic string
+	// Reason is why the subscription was ended, such as ReasonDeleted.
+	Reason string
+}
+
+func (e *ClosedError) Error() string {
+	return fmt.Sprintf("Server closed the subscription to %s: %s", e.Topic, e.Reason)
+}
+
+// Dialer opens a connection to a server. See transport.Transport.Dial.
+type Dialer func(network, addr string) (net.Conn, error)
+
+// endpoint resolves a server URL and optional Dialer into the base URL for
+// requests and the Dialer that should be used to reach the server.
+func endpoint(url string, dial Dialer) (string, Dialer) {
+	if strings.HasPrefix(url, unixScheme) {
+		return "http://localhost", transport.UnixDialer(strings.TrimPrefix(url, unixScheme))
+	}
+	return url, dial
+}
+
 // Client provides consumer functions for Drift.
 //
 // Client contains the simple methods for working with subscriptions
@@ -24,6 +85,15 @@ type Client struct {
 	Url string
 	// Does not verify cert against authorities.
 	InsecureTLSDial bool
+	// Dial, if set, is used to connect to the server.
+	Dial Dialer
+
+	// httpc and pub are built by the first request that needs them, so
+	// that connections are reused. Url, InsecureTLSDial and Dial should not
+	// be changed after that.
+	httpOnce sync.Once
+	httpc    *http.Client
+	pub      *Publisher
 }
 
 // New creates and initializes a new client.
@@ -35,39 +105,297 @@ func New(url string) *Client {
 
 // Create creates a new topic on the pubsub server.
 func (c *Client) Create(topic string) error {
-	url := c.Url + path.Join(v1Path, topic)
-	_, err := c.basicRoundTrip("PUT", url)
+	_, err := c.basicRoundTrip("PUT", path.Join(v1Path, topic))
 	return err
 }
 
 // Delete removes an existing topic from the pubsub server.
 func (c *Client) Delete(topic string) error {
-	url := c.Url + path.Join(v1Path, topic)
-	_, err := c.basicRoundTrip("DELETE", url)
+	_, err := c.basicRoundTrip("DELETE", path.Join(v1Path, topic))
 	return err
 }
 
 // Checks whether the server already has the topic.
 func (c *Client) Exists(topic string) bool {
-	url := c.Url + path.Join(v1Path, topic)
-	_, err := c.basicRoundTrip("HEAD", url)
+	_, err := c.basicRoundTrip("HEAD", path.Join(v1Path, topic))
 	return err == nil
 }
 
+// Publish sends a message to a topic.
+//
+// If the topic has a schema and the message does not match it, the error
+// is a *SchemaError.
 func (c *Client) Publish(topic string, msg []byte) error {
-	p := NewPublisher(c.Url)
-	_, err := p.Publish(topic, msg)
-	return err
+	c.httpClient()
+	res, err := c.pub.Publish(topic, msg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Reading to the end lets the connection be reused.
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+	switch {
+	case res.StatusCode == http.StatusUnprocessableEntity:
+		e := &SchemaError{}
+		if err := json.NewDecoder(res.Body).Decode(e); err != nil {
+			return fmt.Errorf("Publish failed: %s", res.Status)
+		}
+		return e
+	case res.StatusCode >= 300:
+		return responseError("Publish", res)
+	}
+	return nil
 }
 
 func (c *Client) Subscribe(topic string) (*Subscription, error) {
 	s := NewSubscriber(c.Url)
+	s.Dial = c.Dial
 	s.History.Len = 100
 	return s.Subscribe(topic)
 }
 
-func (c *Client) basicRoundTrip(verb, url string) (*http.Response, error) {
-	t := &transport.Transport{InsecureTLSDial: c.InsecureTLSDial}
+// HistoryQuery selects a range of a topic's history.
+//
+// Each bound is inclusive. A sequence number takes precedence over a time
+// for the same bound. Zero values are ignored.
+type HistoryQuery struct {
+	FromSeq uint64
+	ToSeq   uint64
+	From    time.Time
+	To      time.Time
+	// Limit is the most records to return in a page. The server caps it.
+	Limit int
+}
+
+// Record is a message in a topic's history.
+type Record struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Key     string    `json:"key,omitempty"`
+	Message []byte    `json:"message"`
+	// Expires is when the message's TTL runs out, if it has one.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Meta is the metadata the message was published with.
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// HistoryPage is one page of history.
+type HistoryPage struct {
+	Topic    string   `json:"topic"`
+	Messages []Record `json:"messages"`
+	// Next is the sequence number the next page starts at, or zero if this
+	// is the last page.
+	Next uint64 `json:"next,omitempty"`
+}
+
+// QueryHistory reads one page of a topic's history without subscribing.
+func (c *Client) QueryHistory(topic string, q HistoryQuery) (*HistoryPage, error) {
+	v := url.Values{}
+	bound := func(name string, seq uint64, t time.Time) {
+		if seq > 0 {
+			v.Set(name, strconv.FormatUint(seq, 10))
+		} else if !t.IsZero() {
+			v.Set(name, t.Format(time.RFC3339Nano))
+		}
+	}
+	bound("from", q.FromSeq, q.From)
+	bound("to", q.ToSeq, q.To)
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	u := c.base() + path.Join(v1Path, topic, "history") + "?" + v.Encode()
+	res, err := c.httpClient().Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError("History query", res)
+	}
+
+	page := &HistoryPage{}
+	if err := json.NewDecoder(res.Body).Decode(page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// AllHistory reads every page of a topic's history that matches q.
+func (c *Client) AllHistory(topic string, q HistoryQuery) ([]Record, error) {
+	records := []Record{}
+	for {
+		page, err := c.QueryHistory(topic, q)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, page.Messages...)
+		if page.Next == 0 {
+			return records, nil
+		}
+		q.FromSeq = page.Next
+	}
+}
+
+// SchemaError says why the server rejected a message that does not match
+// the topic's schema.
+type SchemaError struct {
+	Topic   string `json:"topic"`
+	Version int    `json:"version"`
+	// Message summarizes the violations.
+	Message    string            `json:"error"`
+	Violations []SchemaViolation `json:"violations"`
+}
+
+// SchemaViolation is one way in which a message does not match a schema.
+type SchemaViolation struct {
+	// Path is a JSON Pointer to the part of the message that is wrong.
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e *SchemaError) Error() string {
+	return e.Message
+}
+
+// SchemaInfo is a version of a topic's JSON Schema.
+type SchemaInfo struct {
+	Topic   string          `json:"topic"`
+	Version int             `json:"version"`
+	Schema  json.RawMessage `json:"schema"`
+}
+
+// SetSchema adds a new version of a topic's JSON Schema, and returns its
+// version. If the schema is the same as the latest version, that version
+// is returned.
+func (c *Client) SetSchema(topic string, schema []byte) (int, error) {
+	req, err := http.NewRequest("PUT", c.base()+path.Join(v1Path, topic, "schema"), bytes.NewReader(schema))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/schema+json")
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, responseError("Set schema", res)
+	}
+	info := &SchemaInfo{}
+	if err := json.NewDecoder(res.Body).Decode(info); err != nil {
+		return 0, err
+	}
+	return info.Version, nil
+}
+
+// Schema gets a version of a topic's JSON Schema. Version 0 is the latest.
+func (c *Client) Schema(topic string, version int) (*SchemaInfo, error) {
+	u := c.base() + path.Join(v1Path, topic, "schema")
+	if version > 0 {
+		u += "?version=" + strconv.Itoa(version)
+	}
+	res, err := c.httpClient().Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError("Get schema", res)
+	}
+	info := &SchemaInfo{}
+	if err := json.NewDecoder(res.Body).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ImportResult describes the outcome of ImportHistory.
+type ImportResult struct {
+	// Topics maps topic names to the number of messages imported.
+	Topics map[string]int `json:"topics"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// ExportHistory writes an archive of the history of the named topics to w.
+//
+// If no topics are named, the history of every topic is exported.
+func (c *Client) ExportHistory(w io.Writer, topics ...string) error {
+	v := url.Values{"topic": topics}
+	res, err := c.httpClient().Get(c.base() + "/v1/admin/export?" + v.Encode())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError("Export", res)
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// ImportHistory imports an archive made by ExportHistory.
+//
+// If the import fails part way, the result shows what was imported.
+func (c *Client) ImportHistory(r io.Reader) (*ImportResult, error) {
+	res, err := c.httpClient().Post(c.base()+"/v1/admin/import", "application/x-ndjson", r)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	result := &ImportResult{}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("Import failed: %s", res.Status)
+	}
+	if len(result.Error) > 0 {
+		return result, errors.New(result.Error)
+	}
+	return result, nil
+}
+
+// base returns the base URL for requests.
+func (c *Client) base() string {
+	base, _ := endpoint(c.Url, c.Dial)
+	return base
+}
+
+// httpClient returns an HTTP/1.1 client for requests that do not need to
+// stream. It is shared by every such request on the Client.
+func (c *Client) httpClient() *http.Client {
+	c.httpOnce.Do(func() {
+		c.httpc = &http.Client{Transport: newTransport(c.Url, c.Dial, c.InsecureTLSDial)}
+		c.pub = NewPublisher(c.Url)
+		c.pub.Dial = c.Dial
+	})
+	return c.httpc
+}
+
+// newTransport builds an HTTP/1.1 transport to the server at url.
+func newTransport(url string, dial Dialer, insecure bool) *http.Transport {
+	t := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+	}
+	if _, dial := endpoint(url, dial); dial != nil {
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(network, addr)
+		}
+	}
+	return t
+}
+
+// responseError builds an error from a failed response.
+func responseError(op string, res *http.Response) error {
+	msg, _ := ioutil.ReadAll(res.Body)
+	return fmt.Errorf("%s failed: %s: %s", op, res.Status, bytes.TrimSpace(msg))
+}
+
+func (c *Client) basicRoundTrip(verb, p string) (*http.Response, error) {
+	base, dial := endpoint(c.Url, c.Dial)
+	url := base + p
+	t := &transport.Transport{InsecureTLSDial: c.InsecureTLSDial, AllowHTTP: true, Dial: dial}
 
 	req, err := http.NewRequest(verb, url, nil)
 	if err != nil {
@@ -81,6 +409,13 @@ func (c *Client) basicRoundTrip(verb, url string) (*http.Response, error) {
 type Publisher struct {
 	Url    string
 	Header http.Header
+	// Dial, if set, is used to connect to the server.
+	Dial Dialer
+
+	// rt is built by the first Publish, so that connections are reused.
+	// Url and Dial should not be changed after that.
+	rtOnce sync.Once
+	rt     *http.Transport
 }
 
 // NewPublisher creates a new Publisher.
@@ -103,35 +438,106 @@ func (p *Publisher) Publish(topic string, message []byte) (*http.Response, error
 	/* HTTP2 does not currently send the body! So we have to go to HTTP1
 	t := &transport.Transport{InsecureTLSDial: true}
 	*/
-	t := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	p.rtOnce.Do(func() {
+		p.rt = newTransport(p.Url, p.Dial, true)
+	})
+	base, _ := endpoint(p.Url, p.Dial)
 
-	url := p.Url + path.Join(v1Path, topic)
+	url := base + path.Join(v1Path, topic)
 
 	var body bytes.Buffer
 	body.Write(message)
 
 	req, _ := http.NewRequest("POST", url, &body)
+	for name, v := range p.Header {
+		req.Header[name] = v
+	}
 
-	return t.RoundTrip(req)
+	return p.rt.RoundTrip(req)
 }
 
 // Subscription represents an existing subscription that a subscriber
 // has subscribed to.
+//
+// Messages arrive on C, which is closed when the subscription ends. Err
+// then says why.
+//
+// Control events from the server, such as heartbeats, are kept off C. They
+// arrive on Events, which need not be read. Alive and LastSeen use them to
+// tell a quiet topic from a dead connection.
 type Subscription struct {
 	C        chan []byte
+	Events   chan Event
+	topic    string
 	listener transport.Listener
+
+	mx        sync.Mutex
+	lastSeen  time.Time
+	heartbeat time.Duration
+
+	// done is closed by Cancel, so that nothing waits on C after that.
+	done   chan struct{}
+	cancel sync.Once
+}
+
+// newSubscription starts reading a subscription stream. If framed is false,
+// the server does not send events, and each chunk of the stream is a
+// message.
+func newSubscription(topic string, listener transport.Listener, stream chan []byte, framed bool) *Subscription {
+	s := &Subscription{
+		C:        make(chan []byte),
+		Events:   make(chan Event, eventBuffer),
+		topic:    topic,
+		listener: listener,
+		lastSeen: time.Now(),
+		done:     make(chan struct{}),
+	}
+	if framed {
+		go s.decode(stream)
+	} else {
+		go s.forward(stream)
+	}
+	return s
 }
 
+// Cancel ends the subscription. C is closed soon after, whether or not it
+// is being read. It is safe to call Cancel more than once.
 func (s *Subscription) Cancel() {
-	// Signal the transport that the clientStream should be removed.
-	s.listener.Cancel()
+	s.cancel.Do(func() {
+		close(s.done)
+		// Signal the transport that the clientStream should be removed.
+		s.listener.Cancel()
+	})
+}
+
+// Err returns why the subscription ended, once C has been closed.
+//
+// It returns nil while the subscription is open. If the server ended the
+// subscription, because the topic was deleted or the server is shutting
+// down, the error is a *ClosedError. Otherwise it is ErrStreamEnded.
+func (s *Subscription) Err() error {
+	trailer := s.listener.Trailer()
+	if trailer == nil {
+		return nil
+	}
+	if reason := trailer.Get(closeReason); len(reason) > 0 {
+		return &ClosedError{Topic: s.topic, Reason: reason}
+	}
+	return ErrStreamEnded
 }
 
 // Subscriber defines a client that subscribes to a topic on a PubSub.
 type Subscriber struct {
 	Url     string
 	History History
-	Header  http.Header
+	// Filter, if set, is a filter expression on message metadata, such as
+	// region == "eu". The server only sends messages that match it.
+	Filter string
+	// JSON, if set, filters and projects JSON messages on the server.
+	JSON   JSONView
+	Header http.Header
+	// Dial, if set, is used to connect to the server.
+	Dial Dialer
 }
 
 func NewSubscriber(url string) *Subscriber {
@@ -141,9 +547,21 @@ func NewSubscriber(url string) *Subscriber {
 	}
 }
 
+// JSONView asks the server to filter and project JSON messages.
+//
+// Filter is a filter expression with JSON Pointers as fields, such as
+// /type == "order" && /total > 100. Fields are JSON Pointers to keep, such
+// as /id. Messages that are not JSON are not sent.
+type JSONView struct {
+	Filter string
+	Fields []string
+}
+
 // History describes how much history a subscriber should ask for.
 //
-// Be default, Subscribers do not ask for any history.
+// Be default, Subscribers do not ask for any history. Since is sent with
+// nanosecond precision, so a subscriber can resume from the time of the
+// last message it saw.
 type History struct {
 	Since time.Time
 	Len   int
@@ -154,10 +572,10 @@ func (s *Subscriber) Subscribe(topic string) (*Subscription, error) {
 		return nil, errors.New("Cannot subscribe to an empty channel.")
 	}
 
-	url := s.Url + path.Join(v1Path, topic)
-	fmt.Printf("URL: %s\n", url)
+	base, dial := endpoint(s.Url, s.Dial)
+	url := base + path.Join(v1Path, topic)
 
-	t := &transport.Transport{InsecureTLSDial: true}
+	t := &transport.Transport{InsecureTLSDial: true, AllowHTTP: true, Dial: dial}
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -166,7 +584,7 @@ func (s *Subscriber) Subscribe(topic string) (*Subscription, error) {
 
 	s.setHeaders(req)
 
-	_, listener, err := t.Listen(req)
+	res, listener, err := t.Listen(req)
 	if err != nil {
 		return nil, err
 	}
@@ -176,15 +594,32 @@ func (s *Subscriber) Subscribe(topic string) (*Subscription, error) {
 		return nil, err
 	}
 
-	return &Subscription{C: stream, listener: listener}, nil
+	framed := res.Header.Get(streamEvents) == "true"
+	return newSubscription(topic, listener, stream, framed), nil
 }
 
+// setHeaders sets the request's headers from the Subscriber. The
+// Subscriber's own Header is copied, not changed, so that it can be used
+// for many requests.
 func (s *Subscriber) setHeaders(req *http.Request) {
-	req.Header = s.Header
+	req.Header = s.Header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set(streamEvents, "true")
+	if len(s.Filter) > 0 {
+		req.Header.Set("X-Filter", s.Filter)
+	}
+	if len(s.JSON.Filter) > 0 {
+		req.Header.Set("X-Json-Filter", s.JSON.Filter)
+	}
+	if len(s.JSON.Fields) > 0 {
+		req.Header.Set("X-Json-Fields", strings.Join(s.JSON.Fields, ","))
+	}
 	if s.History.Len > 0 {
-		req.Header.Add("X-History-Length", fmt.Sprintf("%d", s.History.Len))
+		req.Header.Set("X-History-Length", fmt.Sprintf("%d", s.History.Len))
 	}
 	if s.History.Since.After(time.Unix(0, 0)) {
-		req.Header.Add("X-History-Since", fmt.Sprintf("%d", s.History.Since.Unix()))
+		req.Header.Set("X-History-Since", s.History.Since.UTC().Format(time.RFC3339Nano))
 	}
 }
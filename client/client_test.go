@@ -1,15 +1,19 @@
 package client
 
 import (
+	"bytes"
+	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/Masterminds/cookoo"
 	"github.com/Masterminds/cookoo/web"
-	"github.com/bradfitz/http2"
 	"github.com/technosophos/drift/httputil"
 	"github.com/technosophos/drift/pubsub"
+	"golang.org/x/net/http2"
 )
 
 var hostport = "127.0.0.1:5500"
@@ -116,16 +120,9 @@ func buildRegistry(reg *cookoo.Registry, router *cookoo.Router, cxt cookoo.Conte
 		Name: "GET /v1/t/*",
 		Help: "Subscribe to a topic.",
 		Does: cookoo.Tasks{
-			cookoo.Cmd{
-				Name: "history",
-				Fn:   pubsub.ReplayHistory,
-				Using: []cookoo.Param{
-					{Name: "topic", From: "path:2"},
-				},
-			},
 			cookoo.Cmd{
 				Name: "subscribe",
-				Fn:   pubsub.Subscribe,
+				Fn:   pubsub.ReplayAndSubscribe,
 				Using: []cookoo.Param{
 					{Name: "topic", From: "path:2"},
 				},
@@ -161,3 +158,241 @@ func buildRegistry(reg *cookoo.Registry, router *cookoo.Router, cxt cookoo.Conte
 		},
 	})
 }
+
+func TestEndpoint(t *testing.T) {
+	base, dial := endpoint("https://example.com:5500", nil)
+	if base != "https://example.com:5500" || dial != nil {
+		t.Errorf("Expected URL to pass through unchanged, got %s", base)
+	}
+
+	base, dial = endpoint("unix:///var/run/drift.sock", nil)
+	if base != "http://localhost" {
+		t.Errorf("Expected cleartext base URL for a Unix socket, got %s", base)
+	}
+	if dial == nil {
+		t.Error("Expected a Unix socket dialer.")
+	}
+}
+
+func TestHTTPClientReuse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"topic":"test","messages":[]}`)
+	}))
+	defer srv.Close()
+
+	dials := 0
+	cli := New(srv.URL)
+	cli.Dial = func(network, addr string) (net.Conn, error) {
+		dials++
+		return net.Dial(network, addr)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cli.QueryHistory("test", HistoryQuery{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dials != 1 {
+		t.Errorf("Expected one connection to be reused, got %d dials", dials)
+	}
+
+	// Publishing uses a connection of its own, which is also reused.
+	for i := 0; i < 3; i++ {
+		if err := cli.Publish("test", []byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dials != 2 {
+		t.Errorf("Expected one more connection for publishing, got %d dials", dials)
+	}
+	if cli.httpClient() != cli.httpClient() {
+		t.Error("Expected the HTTP client to be built once.")
+	}
+}
+
+func TestSubscriberHeaders(t *testing.T) {
+	s := NewSubscriber("https://localhost")
+	s.Header.Set("X-Custom", "a")
+	s.Filter = `region == "eu"`
+	s.History.Len = 10
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "https://localhost/v1/t/test", nil)
+		s.setHeaders(req)
+		if v := req.Header["X-History-Length"]; len(v) != 1 || v[0] != "10" {
+			t.Errorf("Expected one history length, got %v", v)
+		}
+		if req.Header.Get("X-Custom") != "a" || req.Header.Get("X-Filter") != s.Filter {
+			t.Errorf("Unexpected headers %v", req.Header)
+		}
+	}
+	if len(s.Header) != 1 {
+		t.Errorf("Expected the Subscriber's Header to be unchanged, got %v", s.Header)
+	}
+
+	// A filter that is removed is not sent again.
+	s.Filter = ""
+	req, _ := http.NewRequest("GET", "https://localhost/v1/t/test", nil)
+	s.setHeaders(req)
+	if v := req.Header.Get("X-Filter"); len(v) > 0 {
+		t.Errorf("Expected no filter, got %q", v)
+	}
+
+	// A Subscriber made without NewSubscriber has no Header.
+	req, _ = http.NewRequest("GET", "https://localhost/v1/t/test", nil)
+	(&Subscriber{}).setHeaders(req)
+	if req.Header.Get(streamEvents) != "true" {
+		t.Error("Expected stream events to be requested.")
+	}
+}
+
+func TestAllHistory(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/t/test/history" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("from") {
+		case "1":
+			fmt.Fprint(w, `{"topic":"test","messages":[{"seq":1,"message":"YQ=="}],"next":2}`)
+		case "2":
+			fmt.Fprint(w, `{"topic":"test","messages":[{"seq":2,"message":"Yg=="}]}`)
+		default:
+			http.Error(w, "bad from", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	cli := New(srv.URL)
+	records, err := cli.AllHistory("test", HistoryQuery{FromSeq: 1, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || string(records[0].Message) != "a" || string(records[1].Message) != "b" {
+		t.Errorf("Unexpected records: %+v", records)
+	}
+
+	if _, err := cli.QueryHistory("test", HistoryQuery{}); err == nil {
+		t.Error("Expected an error for a failed query.")
+	}
+}
+
+func TestExportImportHistory(t *testing.T) {
+	archive := `{"format":"drift-history","version":1}` + "\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/admin/export":
+			if topics := r.URL.Query()["topic"]; len(topics) != 2 {
+				t.Errorf("Expected 2 topics, got %v", topics)
+			}
+			fmt.Fprint(w, archive)
+		case "/v1/admin/import":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"topics":{"a":2},"error":"too new"}`)
+		}
+	}))
+	defer srv.Close()
+
+	cli := New(srv.URL)
+	var buf bytes.Buffer
+	if err := cli.ExportHistory(&buf, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != archive {
+		t.Errorf("Unexpected archive %q", buf.String())
+	}
+
+	res, err := cli.ImportHistory(&buf)
+	if err == nil || err.Error() != "too new" {
+		t.Errorf("Expected the server's error, got %v", err)
+	}
+	if res == nil || res.Topics["a"] != 2 {
+		t.Errorf("Expected a partial result, got %+v", res)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method + " " + r.URL.Path {
+		case "PUT /v1/t/test/schema":
+			fmt.Fprint(w, `{"topic":"test","version":2}`)
+		case "GET /v1/t/test/schema":
+			if v := r.URL.Query().Get("version"); v != "1" {
+				t.Errorf("Expected version 1, got %q", v)
+			}
+			fmt.Fprint(w, `{"topic":"test","version":1,"schema":{"type":"string"}}`)
+		case "POST /v1/t/pinned":
+			if v := r.Header.Get("X-Schema-Version"); v != "1" {
+				t.Errorf("Expected the publisher's header, got %q", v)
+			}
+		case "POST /v1/t/test":
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprint(w, `{"error":"Message does not match.","topic":"test","version":1,"violations":[{"path":"/id","message":"is not allowed"}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	cli := New(srv.URL)
+	if v, err := cli.SetSchema("test", []byte(`{"type":"string"}`)); err != nil || v != 2 {
+		t.Errorf("Expected version 2, got %d, %v", v, err)
+	}
+	info, err := cli.Schema("test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 1 || string(info.Schema) != `{"type":"string"}` {
+		t.Errorf("Unexpected schema %+v", info)
+	}
+	if _, err := cli.Schema("other", 0); err == nil {
+		t.Error("Expected an error for a missing schema.")
+	}
+
+	p := NewPublisher(srv.URL)
+	p.Header.Set("X-Schema-Version", "1")
+	res, err := p.Publish("pinned", []byte(`{"id":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	err = cli.Publish("test", []byte(`{"id":1}`))
+	se, ok := err.(*SchemaError)
+	if !ok {
+		t.Fatalf("Expected a SchemaError, got %v", err)
+	}
+	if se.Version != 1 || len(se.Violations) != 1 || se.Violations[0].Path != "/id" || se.Error() != "Message does not match." {
+		t.Errorf("Unexpected error %+v", se)
+	}
+}
+
+// fakeListener is a transport.Listener that ends with the given trailer.
+type fakeListener struct {
+	data    chan []byte
+	trailer http.Header
+}
+
+func (l *fakeListener) Stream() (chan []byte, error) { return l.data, nil }
+func (l *fakeListener) Cancel()                      {}
+func (l *fakeListener) Trailer() http.Header         { return l.trailer }
+
+func TestSubscriptionErr(t *testing.T) {
+	l := &fakeListener{data: make(chan []byte)}
+	sub := &Subscription{C: l.data, topic: "test", listener: l}
+	if err := sub.Err(); err != nil {
+		t.Errorf("Expected no error while open, got %s", err)
+	}
+
+	l.trailer = http.Header{}
+	if err := sub.Err(); err != ErrStreamEnded {
+		t.Errorf("Expected ErrStreamEnded, got %v", err)
+	}
+
+	l.trailer.Set("X-Close-Reason", ReasonDeleted)
+	err, ok := sub.Err().(*ClosedError)
+	if !ok || err.Reason != ReasonDeleted || err.Topic != "test" {
+		t.Errorf("Expected the topic to be deleted, got %v", sub.Err())
+	}
+}
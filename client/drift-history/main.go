@@ -0,0 +1,62 @@
+/* Command drift-history backs up and restores the history of a Drift server.
+
+Usage:
+
+	drift-history [-url URL] [-k] export [TOPIC...] > backup.ndjson
+	drift-history [-url URL] [-k] import < backup.ndjson
+
+Export writes the history of the named topics, or of every topic, to
+standard output. Import reads an archive from standard input and adds it to
+the server's history, preserving order and timestamps.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/technosophos/drift/client"
+)
+
+var (
+	url      = flag.String("url", "https://localhost:5500", "The URL of the Drift server. Use unix:///path/to/socket for a Unix socket")
+	insecure = flag.Bool("k", false, "Do not verify the server's TLS certificate")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] export [TOPIC...] | import\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := client.New(*url)
+	c.InsecureTLSDial = *insecure
+
+	switch flag.Arg(0) {
+	case "export":
+		if err := c.ExportHistory(os.Stdout, flag.Args()[1:]...); err != nil {
+			fmt.Fprintf(os.Stderr, "Export failed: %s\n", err)
+			os.Exit(1)
+		}
+	case "import":
+		res, err := c.ImportHistory(os.Stdin)
+		if res != nil {
+			for topic, n := range res.Topics {
+				fmt.Fprintf(os.Stderr, "%s: imported %d messages\n", topic, n)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Import failed: %s\n", err)
+			os.Exit(1)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
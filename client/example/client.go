@@ -11,10 +11,10 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/bradfitz/http2"
-	"github.com/bradfitz/http2/hpack"
 	"github.com/technosophos/drift/client"
 	"github.com/technosophos/drift/transport"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
 )
 
 func main() {
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+)
+
+// streamEvents is the header with which a subscriber asks for a framed
+// stream, and the server says that it sent one.
+const streamEvents = "X-Stream-Events"
+
+// Kinds of frame on a framed stream. See pubsub.WriteFrame.
+const (
+	frameMessage   byte = 'M'
+	frameEvent     byte = 'E'
+	frameHeaderLen      = 5
+)
+
+// Types of Event.
+const (
+	// EventSubscribed is sent once the subscription is live. It carries the
+	// server's heartbeat interval.
+	EventSubscribed = "subscribed"
+	// EventHeartbeat is sent periodically while the topic is quiet.
+	EventHeartbeat = "heartbeat"
+	// EventHistoryComplete is sent after history has been replayed. Count
+	// is the number of history messages.
+	EventHistoryComplete = "history-complete"
+	// EventLag warns that the subscriber is not keeping up. Count is the
+	// number of messages waiting on the server.
+	EventLag = "lag"
+)
+
+// eventBuffer is how many events are kept for a reader of Events. Events
+// that arrive when it is full are dropped.
+const eventBuffer = 16
+
+// Event is a control event sent by the server on a subscription stream.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Count is the number of messages for EventHistoryComplete and EventLag.
+	Count int `json:"count,omitempty"`
+	// Heartbeat is the server's heartbeat interval, for EventSubscribed.
+	Heartbeat string `json:"heartbeat,omitempty"`
+}
+
+// forward copies messages from a stream that is not framed, where each
+// chunk is a message.
+func (s *Subscription) forward(stream chan []byte) {
+	defer s.end(stream)
+	for msg := range stream {
+		s.seen()
+		if !s.send(msg) {
+			return
+		}
+	}
+}
+
+// send sends a message to C. It returns false if the subscription was
+// cancelled first.
+func (s *Subscription) send(msg []byte) bool {
+	select {
+	case s.C <- msg:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// end closes C, and then discards the rest of the stream, so that the
+// transport is never blocked on it. The transport closes the stream once
+// it has ended or been cancelled.
+func (s *Subscription) end(stream chan []byte) {
+	close(s.C)
+	for range stream {
+	}
+}
+
+// decode reads frames from a framed stream, sending messages to C and
+// events to Events.
+//
+// A frame may be split across chunks, and a chunk may hold several frames.
+func (s *Subscription) decode(stream chan []byte) {
+	defer s.end(stream)
+	var buf []byte
+	for chunk := range stream {
+		s.seen()
+		buf = append(buf, chunk...)
+		for len(buf) >= frameHeaderLen {
+			n := int(binary.BigEndian.Uint32(buf[1:frameHeaderLen]))
+			if len(buf) < frameHeaderLen+n {
+				break
+			}
+			kind := buf[0]
+			payload := append([]byte(nil), buf[frameHeaderLen:frameHeaderLen+n]...)
+			buf = buf[frameHeaderLen+n:]
+			if !s.dispatch(kind, payload) {
+				return
+			}
+		}
+	}
+}
+
+// dispatch handles one frame. Frames of unknown kinds are ignored, so that
+// servers can add new ones. It returns false if the subscription was
+// cancelled.
+func (s *Subscription) dispatch(kind byte, payload []byte) bool {
+	switch kind {
+	case frameMessage:
+		return s.send(payload)
+	case frameEvent:
+		e := Event{}
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return true
+		}
+		if e.Type == EventSubscribed {
+			d, _ := time.ParseDuration(e.Heartbeat)
+			s.mx.Lock()
+			s.heartbeat = d
+			s.mx.Unlock()
+		}
+		select {
+		case s.Events <- e:
+		default:
+		}
+	}
+	return true
+}
+
+// seen records that the server was heard from.
+func (s *Subscription) seen() {
+	s.mx.Lock()
+	s.lastSeen = time.Now()
+	s.mx.Unlock()
+}
+
+// LastSeen returns when a message or event was last received from the
+// server. It is the time of subscribing if nothing has been received.
+func (s *Subscription) LastSeen() time.Time {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.lastSeen
+}
+
+// Alive returns true if the subscription looks healthy.
+//
+// Once the server has announced its heartbeat interval, a subscription is
+// alive if the server has been heard from within two intervals. Otherwise,
+// such as when the server sends no heartbeats, only the end of the stream
+// shows that it is dead.
+func (s *Subscription) Alive() bool {
+	if s.listener.Trailer() != nil {
+		return false
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.heartbeat <= 0 {
+		return true
+	}
+	return time.Since(s.lastSeen) < 2*s.heartbeat
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func testFrame(kind byte, payload string) []byte {
+	f := make([]byte, frameHeaderLen+len(payload))
+	f[0] = kind
+	binary.BigEndian.PutUint32(f[1:frameHeaderLen], uint32(len(payload)))
+	copy(f[frameHeaderLen:], payload)
+	return f
+}
+
+func TestSubscriptionDecode(t *testing.T) {
+	var data []byte
+	data = append(data, testFrame(frameEvent, `{"type":"subscribed","heartbeat":"1h"}`)...)
+	data = append(data, testFrame(frameMessage, "one")...)
+	data = append(data, testFrame(frameEvent, `{"type":"heartbeat"}`)...)
+	data = append(data, testFrame('?', "from the future")...)
+	data = append(data, testFrame(frameMessage, "two")...)
+
+	l := &fakeListener{data: make(chan []byte)}
+	sub := newSubscription("test", l, l.data, true)
+
+	// Split the stream so that frames straddle chunks.
+	go func() {
+		for i := 0; i < len(data); i += 3 {
+			end := i + 3
+			if end > len(data) {
+				end = len(data)
+			}
+			l.data <- data[i:end]
+		}
+		l.trailer = http.Header{}
+		close(l.data)
+	}()
+
+	msgs := [][]byte{}
+	for msg := range sub.C {
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) != 2 || string(msgs[0]) != "one" || string(msgs[1]) != "two" {
+		t.Errorf("Expected messages one and two, got %q", msgs)
+	}
+
+	types := []string{}
+	for len(sub.Events) > 0 {
+		types = append(types, (<-sub.Events).Type)
+	}
+	if len(types) != 2 || types[0] != EventSubscribed || types[1] != EventHeartbeat {
+		t.Errorf("Expected subscribed and heartbeat events, got %v", types)
+	}
+	if sub.heartbeat != time.Hour {
+		t.Errorf("Expected a heartbeat of 1h, got %s", sub.heartbeat)
+	}
+	if sub.Alive() {
+		t.Error("Expected an ended subscription not to be alive.")
+	}
+}
+
+func TestSubscriptionRaw(t *testing.T) {
+	l := &fakeListener{data: make(chan []byte, 2)}
+	l.data <- []byte("a")
+	l.data <- testFrame(frameMessage, "b")
+	close(l.data)
+	sub := newSubscription("test", l, l.data, false)
+
+	if msg := <-sub.C; string(msg) != "a" {
+		t.Errorf("Expected 'a', got %q", msg)
+	}
+	// Without framing, frames are not decoded.
+	if msg := <-sub.C; !bytes.Equal(msg, testFrame(frameMessage, "b")) {
+		t.Errorf("Expected the raw chunk, got %q", msg)
+	}
+}
+
+func TestSubscriptionAlive(t *testing.T) {
+	l := &fakeListener{data: make(chan []byte)}
+	sub := newSubscription("test", l, l.data, true)
+
+	if !sub.Alive() {
+		t.Error("Expected a subscription with no heartbeat to be alive.")
+	}
+	sub.mx.Lock()
+	sub.heartbeat = time.Millisecond
+	sub.lastSeen = time.Now().Add(-time.Second)
+	sub.mx.Unlock()
+	if sub.Alive() {
+		t.Error("Expected a subscription with missed heartbeats not to be alive.")
+	}
+	l.data <- testFrame(frameEvent, `{"type":"heartbeat"}`)
+	<-sub.Events
+	if !sub.LastSeen().After(time.Now().Add(-time.Second)) {
+		t.Error("Expected the heartbeat to be seen.")
+	}
+	close(l.data)
+}
+
+// cancelListener closes its stream when cancelled, as the transport does.
+type cancelListener struct {
+	fakeListener
+}
+
+func (l *cancelListener) Cancel() { close(l.data) }
+
+func TestSubscriptionCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+	var subs []*Subscription
+	for _, framed := range []bool{false, true} {
+		msg := []byte("a")
+		if framed {
+			msg = testFrame(frameMessage, "a")
+		}
+		l := &cancelListener{fakeListener{data: make(chan []byte, 3)}}
+		for i := 0; i < 3; i++ {
+			l.data <- msg
+		}
+		// Nobody reads C, so the subscription is stuck sending to it.
+		sub := newSubscription("test", l, l.data, framed)
+		sub.Cancel()
+		sub.Cancel()
+		subs = append(subs, sub)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("Expected %d goroutines after Cancel, got %d", before, n)
+	}
+	for _, sub := range subs {
+		if _, ok := <-sub.C; ok {
+			t.Error("Expected C to be closed without delivering anything after Cancel.")
+		}
+	}
+}
@@ -8,31 +8,117 @@ import (
 	"time"
 
 	"github.com/Masterminds/cookoo"
+	"github.com/technosophos/drift/logging"
 )
 
+// MaxBodyBytes is the default limit on the size of a request body read by
+// BufferPost.
+var MaxBodyBytes int64 = 10 << 20
+
 // BufferPost buffers the body of the POST request into the context.
 //
+// The body is read up to a limit, so that a huge request cannot exhaust
+// memory. A request whose body is over the limit gets a 413, and the route
+// stops.
+//
 // Params:
+// 	- maxBytes (int64): The most bytes to read. Default is MaxBodyBytes.
+// 		Zero or less is unlimited.
 //
 // Returns:
 //	- []byte with the content of the request.
 func BufferPost(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
 	req := c.Get("http.Request", nil).(*http.Request)
+	max := p.Get("maxBytes", MaxBodyBytes).(int64)
+	log := Logger(c)
+
+	body := io.Reader(req.Body)
+	if max > 0 {
+		// Refuse a declared length up front, rather than reading it.
+		if req.ContentLength > max {
+			return nil, TooLarge(c, max)
+		}
+		// Read one byte too many, to tell a body at the limit from one
+		// over it.
+		body = io.LimitReader(req.Body, max+1)
+	}
 	var b bytes.Buffer
-	_, err := io.Copy(&b, req.Body)
-	c.Logf("info", "Received POST: %s", b.Bytes())
+	_, err := io.Copy(&b, body)
+	if max > 0 && int64(b.Len()) > max {
+		return nil, TooLarge(c, max)
+	}
+	log.Debugf("Received POST: %s", log.Payload(b.Bytes()))
 	return b.Bytes(), err
 }
 
-// Timestamp returns a UNIX timestamp.
+// TooLarge sends an HTTP 413 for a body over max bytes, if there is a
+// response to write to.
+//
+// It returns an Interrupt that stops the route.
+func TooLarge(c cookoo.Context, max int64) cookoo.Interrupt {
+	Logger(c).Infof("Refused a request body over %d bytes.", max)
+	if res, ok := c.Get("http.ResponseWriter", nil).(http.ResponseWriter); ok {
+		// The rest of the body is not read, so an HTTP/1.1 connection
+		// cannot be reused. HTTP/2 only resets the stream, and would take
+		// Connection: close as a reason to shut down every other stream on
+		// the connection.
+		if req, ok := c.Get("http.Request", nil).(*http.Request); ok && req.ProtoMajor == 1 {
+			res.Header().Set("Connection", "close")
+		}
+		http.Error(res, fmt.Sprintf("Request body is larger than %d bytes.", max), http.StatusRequestEntityTooLarge)
+	}
+	return &cookoo.Stop{}
+}
+
+// Logger returns a logger tagged with the ID of the request in the context.
+//
+// If the context has no request, logging.Default is returned.
+func Logger(c cookoo.Context) *logging.Logger {
+	if r, ok := c.Get("http.Request", nil).(*http.Request); ok {
+		return logging.ForRequest(r)
+	}
+	return logging.Default
+}
+
+// Time formats for Timestamp.
+const (
+	// TimeUnix is whole seconds since the UNIX epoch.
+	TimeUnix = "unix"
+	// TimeMillis is milliseconds since the UNIX epoch.
+	TimeMillis = "ms"
+	// TimeRFC3339 is an RFC 3339 time with nanoseconds, in UTC.
+	TimeRFC3339 = "rfc3339"
+)
+
+// FormatTime formats a time in one of the Time formats.
+func FormatTime(t time.Time, format string) (string, error) {
+	switch format {
+	case TimeUnix, "":
+		return fmt.Sprintf("%d", t.Unix()), nil
+	case TimeMillis:
+		return fmt.Sprintf("%d", t.UnixNano()/int64(time.Millisecond)), nil
+	case TimeRFC3339:
+		return t.UTC().Format(time.RFC3339Nano), nil
+	}
+	return "", fmt.Errorf("Unknown time format %q", format)
+}
+
+// Timestamp returns the current time.
 //
 // Params:
+// 	- format (string): One of TimeUnix, TimeMillis, or TimeRFC3339. Default
+// 		is the "format" query parameter of the request, or TimeUnix.
 //
 // Returns:
-// 	- int64 timestamp as seconds since epoch.
+// 	- string timestamp, by default as seconds since epoch.
 //
 func Timestamp(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
-	return fmt.Sprintf("%d", time.Now().Unix()), nil
+	format := ""
+	if r, ok := c.Get("http.Request", nil).(*http.Request); ok && r != nil {
+		format = r.URL.Query().Get("format")
+	}
+	format = p.Get("format", format).(string)
+	return FormatTime(time.Now(), format)
 }
 
 // Debug displays debugging info.
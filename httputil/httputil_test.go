@@ -2,8 +2,17 @@ package httputil
 
 import (
 	"github.com/Masterminds/cookoo"
+	"github.com/technosophos/drift/logging"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestTimestamp(t *testing.T) {
@@ -32,3 +41,158 @@ func TestTimestamp(t *testing.T) {
 		t.Error("Dude, you're stuck in the '70s.")
 	}
 }
+
+func TestFormatTime(t *testing.T) {
+	ts := time.Unix(1436464998, 123456789)
+	tests := map[string]string{
+		TimeUnix:    "1436464998",
+		TimeMillis:  "1436464998123",
+		TimeRFC3339: "2015-07-09T18:03:18.123456789Z",
+	}
+	for format, expect := range tests {
+		out, err := FormatTime(ts, format)
+		if err != nil {
+			t.Errorf("Failed to format %s: %s", format, err)
+		}
+		if out != expect {
+			t.Errorf("Expected %s for %s, got %s", expect, format, out)
+		}
+	}
+	if _, err := FormatTime(ts, "sundial"); err == nil {
+		t.Error("Expected an error for an unknown format.")
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	var seen string
+	h := Instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(logging.RequestIDHeader)
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("Expected instrumented writer to be a Flusher.")
+		}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	before := requestsTotal.Value("GET", "418")
+	req, _ := http.NewRequest("GET", "https://localhost/ping", nil)
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+
+	if len(seen) == 0 {
+		t.Error("Expected the handler to see a request ID.")
+	}
+	if id := res.Header().Get(logging.RequestIDHeader); id != seen {
+		t.Errorf("Expected response ID %q, got %q", seen, id)
+	}
+	if after := requestsTotal.Value("GET", "418"); after != before+1 {
+		t.Errorf("Expected request count to go from %v to %v, got %v", before, before+1, after)
+	}
+}
+
+func TestBufferPost(t *testing.T) {
+	reg, router, cxt := cookoo.Cookoo()
+	reg.Route("test", "Test route").
+		Does(BufferPost, "body").Using("maxBytes").WithDefault(int64(5))
+
+	tests := []struct {
+		body   string
+		length int64
+		code   int
+	}{
+		{"12345", 5, http.StatusOK},
+		{"123456", 6, http.StatusRequestEntityTooLarge},
+		// A body with no declared length is cut off while it is read.
+		{"123456", -1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "https://localhost/v1/t/test", strings.NewReader(tt.body))
+		req.ContentLength = tt.length
+		res := httptest.NewRecorder()
+		cxt.Put("http.Request", req)
+		cxt.Put("http.ResponseWriter", res)
+		cxt.Put("body", nil)
+		if err := router.HandleRequest("test", cxt, true); err != nil {
+			t.Fatal(err)
+		}
+		if res.Code != tt.code {
+			t.Errorf("Expected %d for %q, got %d", tt.code, tt.body, res.Code)
+		}
+		if body, _ := cxt.Get("body", nil).([]byte); tt.code == http.StatusOK && string(body) != tt.body {
+			t.Errorf("Expected body %q, got %q", tt.body, body)
+		}
+	}
+}
+
+func TestBufferPostHTTP2(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			io.WriteString(w, "hello")
+			w.(http.Flusher).Flush()
+			<-release
+			io.WriteString(w, "bye")
+			return
+		}
+		reg, router, cxt := cookoo.Cookoo()
+		reg.Route("test", "Test route").
+			Does(BufferPost, "body").Using("maxBytes").WithDefault(int64(5))
+		cxt.Put("http.Request", r)
+		cxt.Put("http.ResponseWriter", w)
+		if err := router.HandleRequest("test", cxt, true); err != nil {
+			t.Error(err)
+		}
+	}))
+	var conns int32
+	srv.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	client := srv.Client()
+
+	stream, err := client.Get(srv.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	if stream.ProtoMajor != 2 {
+		t.Fatalf("Expected HTTP/2, got %s", stream.Proto)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(stream.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := client.Post(srv.URL+"/big", "text/plain", strings.NewReader("123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", res.StatusCode)
+	}
+	if res.Header.Get("Connection") == "close" {
+		t.Error("Expected no Connection: close on HTTP/2.")
+	}
+
+	// The other stream is unaffected, and the connection is still used.
+	close(release)
+	rest, err := ioutil.ReadAll(stream.Body)
+	if err != nil || string(rest) != "bye" {
+		t.Errorf("Expected the stream to finish, got %q (%v)", rest, err)
+	}
+	res, err = client.Post(srv.URL+"/big", "text/plain", strings.NewReader("12345"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got %d", res.StatusCode)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("Expected one connection, got %d", n)
+	}
+}
@@ -0,0 +1,97 @@
+package httputil
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/technosophos/drift/logging"
+	"github.com/technosophos/drift/metrics"
+)
+
+var (
+	requestsTotal   = metrics.Default.Counter("drift_http_requests_total", "HTTP requests handled, by method and status code.", "method", "code")
+	requestDuration = metrics.Default.Histogram("drift_http_request_duration_seconds", "Time taken to handle HTTP requests, by method. Subscriptions are counted when they end.", nil, "method")
+)
+
+// Instrument wraps an http.Handler, recording request counts and durations.
+//
+// Every request is given an ID, which is reused from the X-Request-Id header
+// if the client sent one. The ID is sent back to the client in the same
+// header, and is attached to every log entry for the request. When the
+// request is done, it is logged at Info level.
+//
+// The ResponseWriter passed to the wrapped handler still supports
+// http.Flusher and http.CloseNotifier, which subscriptions rely on.
+func Instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(logging.RequestIDHeader)
+		if len(id) == 0 {
+			id = newRequestID()
+			r.Header.Set(logging.RequestIDHeader, id)
+		}
+		w.Header().Set(logging.RequestIDHeader, id)
+
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+		elapsed := time.Since(start)
+		requestsTotal.Inc(r.Method, strconv.Itoa(sw.code))
+		requestDuration.Observe(elapsed.Seconds(), r.Method)
+
+		logging.ForRequest(r).With(logging.Fields{
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"proto":    r.Proto,
+			"status":   sw.code,
+			"duration": elapsed.String(),
+		}).Infof("%s %s %d", r.Method, r.URL.Path, sw.code)
+	})
+}
+
+// newRequestID generates a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// statusWriter records the status code written to a ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
@@ -0,0 +1,194 @@
+// Package logging provides structured, leveled logging for Drift.
+//
+// Each log entry is written as a single line of JSON containing the time,
+// the level, the message, and any fields attached to the Logger.
+//
+// Message payloads are never logged unless the Logger is at Debug level.
+// Use Payload to log a message body safely.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestIDHeader is the HTTP header that carries the ID of a request.
+const RequestIDHeader = "X-Request-Id"
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	// Debug is for detailed diagnostics, including message payloads.
+	Debug Level = iota
+	// Info is for normal operational messages.
+	Info
+	// Warn is for recoverable problems.
+	Warn
+	// Error is for failures.
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel converts a level name, such as "info", into a Level.
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("Unknown log level %q", s)
+}
+
+// Fields are key/value pairs attached to every entry a Logger writes.
+type Fields map[string]interface{}
+
+// Default is the Logger used throughout Drift.
+var Default = New(os.Stderr, Info)
+
+// core is shared by a Logger and all of the Loggers derived from it.
+type core struct {
+	// level is read on every log call, so it is atomic rather than
+	// guarded by mx.
+	level int32
+	// mx guards out.
+	mx  sync.Mutex
+	out io.Writer
+}
+
+// Logger writes JSON log entries at or above its level.
+type Logger struct {
+	*core
+	fields Fields
+}
+
+// New creates a Logger that writes entries at level l or above to w.
+func New(w io.Writer, l Level) *Logger {
+	return &Logger{
+		core:   &core{out: w, level: int32(l)},
+		fields: Fields{},
+	}
+}
+
+// SetLevel changes the level of this Logger and every Logger derived from it.
+func (l *Logger) SetLevel(lvl Level) {
+	atomic.StoreInt32(&l.level, int32(lvl))
+}
+
+// SetOutput changes where this Logger and every Logger derived from it write.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.mx.Lock()
+	l.out = w
+	l.mx.Unlock()
+}
+
+// Enabled returns true if entries at the given level will be written.
+func (l *Logger) Enabled(lvl Level) bool {
+	return int32(lvl) >= atomic.LoadInt32(&l.level)
+}
+
+// With returns a Logger that adds the given fields to every entry.
+//
+// The new Logger shares its level and output with l.
+func (l *Logger) With(f Fields) *Logger {
+	fields := make(Fields, len(l.fields)+len(f))
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	for k, v := range f {
+		fields[k] = v
+	}
+	return &Logger{core: l.core, fields: fields}
+}
+
+// Payload returns a loggable representation of a message body.
+//
+// At Debug level, this is the body itself. Otherwise it is only the size
+// of the body, so payloads do not leak into logs by accident.
+func (l *Logger) Payload(b []byte) string {
+	if l.Enabled(Debug) {
+		return string(b)
+	}
+	return fmt.Sprintf("[%d bytes]", len(b))
+}
+
+// Debugf logs at Debug level.
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	if l.Enabled(Debug) {
+		l.write(Debug, fmt.Sprintf(format, v...))
+	}
+}
+
+// Infof logs at Info level.
+func (l *Logger) Infof(format string, v ...interface{}) {
+	if l.Enabled(Info) {
+		l.write(Info, fmt.Sprintf(format, v...))
+	}
+}
+
+// Warnf logs at Warn level.
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	if l.Enabled(Warn) {
+		l.write(Warn, fmt.Sprintf(format, v...))
+	}
+}
+
+// Errorf logs at Error level.
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	if l.Enabled(Error) {
+		l.write(Error, fmt.Sprintf(format, v...))
+	}
+}
+
+// write writes an entry. The caller checks that lvl is enabled, so that
+// disabled entries are never formatted.
+func (l *Logger) write(lvl Level, msg string) {
+	entry := make(map[string]interface{}, len(l.fields)+3)
+	for k, v := range l.fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = lvl.String()
+	entry["msg"] = msg
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{
+			"time":  entry["time"].(string),
+			"level": lvl.String(),
+			"msg":   msg,
+			"error": fmt.Sprintf("Could not encode log fields: %s", err),
+		})
+	}
+	data = append(data, '\n')
+
+	l.mx.Lock()
+	l.out.Write(data)
+	l.mx.Unlock()
+}
+
+// ForRequest returns a Logger tagged with the request's ID, if it has one.
+func ForRequest(r *http.Request) *Logger {
+	if id := r.Header.Get(RequestIDHeader); len(id) > 0 {
+		return Default.With(Fields{"request_id": id})
+	}
+	return Default
+}
@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var b bytes.Buffer
+	log := New(&b, Info)
+
+	log.Debugf("hidden")
+	if b.Len() > 0 {
+		t.Errorf("Expected debug entry to be suppressed, got %s", b.String())
+	}
+
+	log.With(Fields{"topic": "test", "err": errors.New("boom")}).Warnf("Hello %s", "world")
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(b.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a JSON entry, got %q: %s", b.String(), err)
+	}
+	expect := map[string]string{"level": "warn", "msg": "Hello world", "topic": "test", "err": "boom"}
+	for k, v := range expect {
+		if entry[k] != v {
+			t.Errorf("Expected %s to be %q, got %v", k, v, entry[k])
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Error("Expected entry to have a time.")
+	}
+}
+
+func TestPayload(t *testing.T) {
+	var b bytes.Buffer
+	log := New(&b, Info)
+	child := log.With(Fields{"a": 1})
+
+	if p := child.Payload([]byte("secret")); p != "[6 bytes]" {
+		t.Errorf("Expected payload to be redacted, got %q", p)
+	}
+
+	// Changing the level on the parent affects derived loggers.
+	log.SetLevel(Debug)
+	if p := child.Payload([]byte("secret")); p != "secret" {
+		t.Errorf("Expected payload at debug level, got %q", p)
+	}
+}
+
+// countingStringer counts how often it is formatted.
+type countingStringer int
+
+func (c *countingStringer) String() string {
+	*c++
+	return "counted"
+}
+
+func TestDisabledNotFormatted(t *testing.T) {
+	var b bytes.Buffer
+	log := New(&b, Warn)
+	var c countingStringer
+	log.Debugf("%s", &c)
+	log.Infof("%s", &c)
+	if c != 0 || b.Len() > 0 {
+		t.Errorf("Expected disabled entries to be skipped before formatting, formatted %d times", c)
+	}
+	log.Errorf("%s", &c)
+	if c != 1 {
+		t.Errorf("Expected an enabled entry to be formatted once, got %d", c)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if l, err := ParseLevel("WARN"); err != nil || l != Warn {
+		t.Errorf("Expected Warn, got %s (%v)", l, err)
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("Expected an error for an unknown level.")
+	}
+}
+
+func TestForRequest(t *testing.T) {
+	var b bytes.Buffer
+	Default.SetOutput(&b)
+	defer Default.SetOutput(&bytes.Buffer{})
+
+	req, _ := http.NewRequest("GET", "https://localhost/v1/t/test", nil)
+	req.Header.Set(RequestIDHeader, "abc123")
+	ForRequest(req).Infof("hi")
+
+	if !strings.Contains(b.String(), `"request_id":"abc123"`) {
+		t.Errorf("Expected request ID in %s", b.String())
+	}
+}
@@ -0,0 +1,455 @@
+// Package metrics provides counters, gauges, and histograms for Drift.
+//
+// Metrics are kept in a Registry and written out in the Prometheus text
+// exposition format. Every metric may declare label names; values are then
+// recorded per combination of label values.
+//
+// Most code should use the Default registry, which is what the Serve command
+// writes.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Masterminds/cookoo"
+)
+
+// ContentType is the content type of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4"
+
+// DefaultBuckets are the histogram buckets used when none are given.
+//
+// They are tuned to latencies measured in seconds.
+var DefaultBuckets = []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry used by the rest of Drift.
+var Default = NewRegistry()
+
+// Registry holds a set of metrics.
+type Registry struct {
+	metrics map[string]metric
+	mx      sync.Mutex
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]metric{}}
+}
+
+type metric interface {
+	write(io.Writer)
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	r.metrics[name] = m
+}
+
+// Counter registers a new counter.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec: newVec(name, help, "counter", labels)}
+	r.register(name, c)
+	return c
+}
+
+// Gauge registers a new gauge.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vec: newVec(name, help, "gauge", labels)}
+	r.register(name, g)
+	return g
+}
+
+// Histogram registers a new histogram.
+//
+// If buckets is nil, DefaultBuckets is used.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	sort.Float64s(b)
+	h := &Histogram{
+		vec:     newVec(name, help, "histogram", labels),
+		buckets: b,
+		series:  map[string]*histSeries{},
+	}
+	r.register(name, h)
+	return h
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mx.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for n := range r.metrics {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	ms := make([]metric, len(names))
+	for i, n := range names {
+		ms[i] = r.metrics[n]
+	}
+	r.mx.Unlock()
+
+	var b bytes.Buffer
+	for _, m := range ms {
+		m.write(&b)
+	}
+	return b.WriteTo(w)
+}
+
+// vec holds one float value per combination of label values.
+type vec struct {
+	name, help, kind string
+	labels           []string
+	// mx guards the map. The values themselves are updated atomically.
+	values map[string]*value
+	mx     sync.Mutex
+}
+
+func newVec(name, help, kind string, labels []string) *vec {
+	return &vec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: map[string]*value{},
+	}
+}
+
+// value is a float64 that is updated without a lock.
+type value struct {
+	bits uint64
+	// deleted is set when the value is removed from its vec, so that a
+	// CounterSeries knows to look it up again.
+	deleted int32
+}
+
+func (v *value) add(d float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		n := math.Float64bits(math.Float64frombits(old) + d)
+		if atomic.CompareAndSwapUint64(&v.bits, old, n) {
+			return
+		}
+	}
+}
+
+func (v *value) set(d float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(d))
+}
+
+func (v *value) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// series returns the value for a set of label values, creating it if
+// necessary.
+func (v *vec) series(lv []string) *value {
+	k := v.key(lv)
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	s, ok := v.values[k]
+	if !ok {
+		s = &value{}
+		v.values[k] = s
+	}
+	return s
+}
+
+func (v *vec) add(d float64, lv []string) {
+	v.series(lv).add(d)
+}
+
+func (v *vec) set(d float64, lv []string) {
+	v.series(lv).set(d)
+}
+
+func (v *vec) get(lv []string) float64 {
+	k := v.key(lv)
+	v.mx.Lock()
+	s, ok := v.values[k]
+	v.mx.Unlock()
+	if !ok {
+		return 0
+	}
+	return s.load()
+}
+
+// Delete removes the series for the given label values.
+//
+// This is used to forget about topics that no longer exist.
+func (v *vec) Delete(lv ...string) {
+	k := v.key(lv)
+	v.mx.Lock()
+	if s, ok := v.values[k]; ok {
+		atomic.StoreInt32(&s.deleted, 1)
+		delete(v.values, k)
+	}
+	v.mx.Unlock()
+}
+
+// key builds the label string for a set of label values.
+func (v *vec) key(lv []string) string {
+	if len(lv) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(lv)))
+	}
+	return labelString(v.labels, lv)
+}
+
+func (v *vec) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+}
+
+func (v *vec) write(w io.Writer) {
+	v.header(w)
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	for _, k := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, k, formatFloat(v.values[k].load()))
+	}
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	*vec
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+// Add adds d to the counter. Negative values are ignored.
+func (c *Counter) Add(d float64, labelValues ...string) {
+	if d < 0 {
+		return
+	}
+	c.add(d, labelValues)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.get(labelValues)
+}
+
+// With returns the series of the counter for the given label values.
+//
+// Code that updates the same series often should look it up once with
+// With, rather than pass the label values on every update. If the series
+// is deleted, the next update through the CounterSeries starts it again.
+func (c *Counter) With(labelValues ...string) *CounterSeries {
+	s := &CounterSeries{c: c, labels: labelValues}
+	s.v.Store(c.series(labelValues))
+	return s
+}
+
+// CounterSeries is one series of a Counter. It is safe for concurrent use.
+type CounterSeries struct {
+	c      *Counter
+	labels []string
+	// v holds the current *value.
+	v atomic.Value
+}
+
+// Inc adds one to the series.
+func (s *CounterSeries) Inc() {
+	s.value().add(1)
+}
+
+// Add adds d to the series. Negative values are ignored.
+func (s *CounterSeries) Add(d float64) {
+	if d > 0 {
+		s.value().add(d)
+	}
+}
+
+func (s *CounterSeries) value() *value {
+	v := s.v.Load().(*value)
+	if atomic.LoadInt32(&v.deleted) == 1 {
+		v = s.c.series(s.labels)
+		s.v.Store(v)
+	}
+	return v
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	*vec
+}
+
+// Set sets the gauge to d.
+func (g *Gauge) Set(d float64, labelValues ...string) {
+	g.set(d, labelValues)
+}
+
+// Add adds d (which may be negative) to the gauge.
+func (g *Gauge) Add(d float64, labelValues ...string) {
+	g.add(d, labelValues)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.get(labelValues)
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	*vec
+	buckets []float64
+	series  map[string]*histSeries
+}
+
+type histSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe records a single observation.
+func (h *Histogram) Observe(d float64, labelValues ...string) {
+	h.ObserveAll([]float64{d}, labelValues...)
+}
+
+// ObserveAll records several observations, taking the histogram's lock
+// once.
+func (h *Histogram) ObserveAll(ds []float64, labelValues ...string) {
+	if len(ds) == 0 {
+		return
+	}
+	k := h.key(labelValues)
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	s, ok := h.series[k]
+	if !ok {
+		s = &histSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	for _, d := range ds {
+		for i, b := range h.buckets {
+			if d <= b {
+				s.counts[i]++
+			}
+		}
+		s.count++
+		s.sum += d
+	}
+}
+
+// Count returns the number of observations recorded.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	k := h.key(labelValues)
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if s, ok := h.series[k]; ok {
+		return s.count
+	}
+	return 0
+}
+
+// Delete removes the series for the given label values.
+func (h *Histogram) Delete(labelValues ...string) {
+	k := h.key(labelValues)
+	h.mx.Lock()
+	delete(h.series, k)
+	h.mx.Unlock()
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.header(w)
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLe(k, formatFloat(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLe(k, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, k, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, k, s.count)
+	}
+}
+
+// Serve writes the Default registry to the HTTP response.
+//
+// Params:
+//
+// Returns:
+func Serve(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	w := c.Get("http.ResponseWriter", nil).(http.ResponseWriter)
+	w.Header().Set("Content-Type", ContentType)
+	_, err := Default.WriteTo(w)
+	return nil, err
+}
+
+// labelString renders labels as {a="x",b="y"}, or "" if there are none.
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", n, escapeLabel(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLe adds the histogram "le" label to a label string.
+func withLe(labels, le string) string {
+	if labels == "" {
+		return "{le=\"" + le + "\"}"
+	}
+	return labels[:len(labels)-1] + ",le=\"" + le + "\"}"
+}
+
+func sortedKeys(m map[string]*value) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
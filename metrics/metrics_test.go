@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_total", "A test counter.", "topic")
+	g := r.Gauge("test_gauge", "A test gauge.")
+	h := r.Histogram("test_seconds", "A test histogram.", []float64{1, 0.5}, "topic")
+
+	c.Inc("a")
+	c.Add(2, "a")
+	c.Add(-1, "a")
+	c.Inc(`b"c`)
+	g.Set(5)
+	g.Add(-2)
+	h.Observe(0.2, "a")
+	h.Observe(0.7, "a")
+	h.Observe(3, "a")
+
+	if v := c.Value("a"); v != 3 {
+		t.Errorf("Expected counter to be 3, got %v", v)
+	}
+	if v := g.Value(); v != 3 {
+		t.Errorf("Expected gauge to be 3, got %v", v)
+	}
+	if n := h.Count("a"); n != 3 {
+		t.Errorf("Expected 3 observations, got %d", n)
+	}
+
+	var b bytes.Buffer
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+
+	expect := []string{
+		"# TYPE test_total counter\n",
+		"test_total{topic=\"a\"} 3\n",
+		"test_total{topic=\"b\\\"c\"} 1\n",
+		"# TYPE test_gauge gauge\n",
+		"test_gauge 3\n",
+		"# TYPE test_seconds histogram\n",
+		"test_seconds_bucket{topic=\"a\",le=\"0.5\"} 1\n",
+		"test_seconds_bucket{topic=\"a\",le=\"1\"} 2\n",
+		"test_seconds_bucket{topic=\"a\",le=\"+Inf\"} 3\n",
+		"test_seconds_sum{topic=\"a\"} 3.9\n",
+		"test_seconds_count{topic=\"a\"} 3\n",
+	}
+	for _, e := range expect {
+		if !strings.Contains(out, e) {
+			t.Errorf("Expected output to contain %q. Got:\n%s", e, out)
+		}
+	}
+
+	c.Delete("a")
+	if v := c.Value("a"); v != 0 {
+		t.Errorf("Expected deleted counter to be 0, got %v", v)
+	}
+}
+
+func TestCounterSeries(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_total", "A test counter.", "topic")
+	h := r.Histogram("test_depth", "A test histogram.", []float64{0, 1})
+
+	s := c.With("a")
+	s.Inc()
+	s.Add(2)
+	s.Add(-1)
+	c.Inc("a")
+	if v := c.Value("a"); v != 4 {
+		t.Errorf("Expected the series and the counter to share a value of 4, got %v", v)
+	}
+
+	// A deleted series starts again on its next update.
+	c.Delete("a")
+	s.Inc()
+	if v := c.Value("a"); v != 1 {
+		t.Errorf("Expected the series to start again at 1, got %v", v)
+	}
+
+	h.ObserveAll([]float64{0, 1, 2})
+	if n := h.Count(); n != 3 {
+		t.Errorf("Expected 3 observations, got %d", n)
+	}
+}
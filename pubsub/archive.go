@@ -0,0 +1,205 @@
+package pubsub
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/Masterminds/cookoo"
+	"github.com/technosophos/drift/httputil"
+)
+
+const (
+	// ArchiveFormat names the history archive format.
+	ArchiveFormat = "drift-history"
+	// ArchiveVersion is the version of the archive format written.
+	ArchiveVersion = 1
+	// ArchiveContentType is the media type of a history archive.
+	ArchiveContentType = "application/x-ndjson"
+)
+
+// ArchiveHeader is the first line of a history archive.
+type ArchiveHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// ArchiveEntry is a single message in a history archive.
+type ArchiveEntry struct {
+	Topic string `json:"topic"`
+	Record
+}
+
+// WriteArchive writes the history of the named topics to w.
+//
+// If no topics are named, the history of every topic is written. Topics
+// without history, and topics that do not exist, such as those deleted
+// while the archive is written, are skipped.
+//
+// The archive is newline-delimited JSON. The first line is an
+// ArchiveHeader, and each line after that is an ArchiveEntry. Entries are
+// grouped by topic, oldest first, so that the archive can be imported in
+// order.
+func WriteArchive(w io.Writer, m *Medium, topics ...string) error {
+	if len(topics) == 0 {
+		for _, t := range m.topics.all() {
+			topics = append(topics, t.Name())
+		}
+		sort.Strings(topics)
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(ArchiveHeader{Format: ArchiveFormat, Version: ArchiveVersion}); err != nil {
+		return err
+	}
+	for _, name := range topics {
+		t, ok := m.Topic(name)
+		if !ok {
+			continue
+		}
+		ht, ok := t.(HistoriedTopic)
+		if !ok {
+			continue
+		}
+		records, _ := ht.Range(HistoryQuery{})
+		for _, r := range records {
+			if err := enc.Encode(ArchiveEntry{Topic: name, Record: r}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadArchive imports a history archive written by WriteArchive into m.
+//
+// Topics that do not exist are created with history. It returns the number
+// of messages read for each topic. Reading stops at the first error.
+func ReadArchive(r io.Reader, m *Medium) (map[string]int, error) {
+	counts := map[string]int{}
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	head := ArchiveHeader{}
+	if err := dec.Decode(&head); err != nil {
+		return counts, fmt.Errorf("Could not read archive header: %w", err)
+	}
+	if head.Format != ArchiveFormat {
+		return counts, fmt.Errorf("Not a history archive: format is %q", head.Format)
+	}
+	if head.Version > ArchiveVersion {
+		return counts, fmt.Errorf("Unsupported archive version %d", head.Version)
+	}
+
+	for {
+		e := ArchiveEntry{}
+		if err := dec.Decode(&e); err == io.EOF {
+			return counts, nil
+		} else if err != nil {
+			return counts, fmt.Errorf("Could not read archive entry: %w", err)
+		}
+		if len(e.Topic) == 0 {
+			return counts, errors.New("Archive entry has no topic.")
+		}
+
+		t := fetchOrCreateTopic(m, e.Topic, true, DefaultMaxHistory)
+		ht, ok := t.(HistoriedTopic)
+		if !ok {
+			return counts, fmt.Errorf("Topic %s does not keep history.", e.Topic)
+		}
+		if err := ht.Import(e.Record); err != nil {
+			return counts, err
+		}
+		counts[e.Topic]++
+	}
+}
+
+// ExportHistory writes a history archive of one or more topics.
+//
+// The topics are taken from the "topic" query parameter, which may be
+// repeated. If there is none, every topic is exported.
+//
+// Params:
+//
+// Returns:
+//
+func ExportHistory(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	req := c.Get("http.Request", nil).(*http.Request)
+	res := c.Get("http.ResponseWriter", nil).(http.ResponseWriter)
+
+	medium, err := getMedium(c)
+	if err != nil {
+		return nil, &cookoo.FatalError{Message: "No medium."}
+	}
+
+	topics := req.URL.Query()["topic"]
+	for _, name := range topics {
+		if _, ok := medium.Topic(name); !ok {
+			http.Error(res, fmt.Sprintf("No topic named %s.", name), http.StatusNotFound)
+			return nil, nil
+		}
+	}
+
+	res.Header().Set("Content-Type", ArchiveContentType)
+	if err := WriteArchive(res, medium, topics...); err != nil {
+		// The status has already been sent, so all we can do is log.
+		httputil.Logger(c).Errorf("Failed to export history: %s", err)
+	}
+	return nil, nil
+}
+
+// ImportResult describes what ImportHistory imported.
+type ImportResult struct {
+	// Topics maps topic names to the number of messages imported.
+	Topics map[string]int `json:"topics"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// ImportHistory reads a history archive from the request body.
+//
+// The response is an ImportResult. If the archive cannot be imported
+// completely, the status is 400, and the result shows what was imported
+// before the error. A body over the limit gets a 413, though what was read
+// before the limit has been imported.
+//
+// Params:
+// 	- maxBytes (int64): The largest archive. Default is
+// 		httputil.MaxBodyBytes. Zero or less is unlimited.
+//
+// Returns:
+// 	- *ImportResult
+func ImportHistory(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	req := c.Get("http.Request", nil).(*http.Request)
+	res := c.Get("http.ResponseWriter", nil).(http.ResponseWriter)
+	max := p.Get("maxBytes", httputil.MaxBodyBytes).(int64)
+
+	medium, err := getMedium(c)
+	if err != nil {
+		return nil, &cookoo.FatalError{Message: "No medium."}
+	}
+
+	body := req.Body
+	if max > 0 {
+		if req.ContentLength > max {
+			return nil, httputil.TooLarge(c, max)
+		}
+		body = http.MaxBytesReader(res, req.Body, max)
+	}
+	counts, err := ReadArchive(body, medium)
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		httputil.Logger(c).Warnf("Stopped importing history at the body limit, after %v.", counts)
+		return nil, httputil.TooLarge(c, max)
+	}
+	result := &ImportResult{Topics: counts}
+	code := http.StatusOK
+	if err != nil {
+		result.Error = err.Error()
+		code = http.StatusBadRequest
+		httputil.Logger(c).Warnf("Failed to import history: %s", err)
+	}
+	return result, writeJSON(res, code, result)
+}
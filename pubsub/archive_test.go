@@ -0,0 +1,149 @@
+package pubsub
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/cookoo"
+)
+
+func TestArchive(t *testing.T) {
+	src := NewMedium()
+	one := NewHistoriedTopic("one", 10)
+	src.Add(one)
+	one.Publish([]byte("a"))
+	one.PublishWith([]byte("b"), PublishOptions{Key: "k", TTL: time.Hour})
+	src.Add(NewTopic("nohistory"))
+
+	var buf bytes.Buffer
+	if err := WriteArchive(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 3 {
+		t.Errorf("Expected a header and 2 entries, got %d lines:\n%s", lines, buf.String())
+	}
+
+	dest := NewMedium()
+	counts, err := ReadArchive(bytes.NewReader(buf.Bytes()), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["one"] != 2 {
+		t.Errorf("Expected 2 messages imported, got %v", counts)
+	}
+
+	t2, ok := dest.Topic("one")
+	if !ok {
+		t.Fatal("Expected topic one to be created.")
+	}
+	got, _ := t2.(HistoriedTopic).Range(HistoryQuery{})
+	want, _ := one.Range(HistoryQuery{})
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d records, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].Seq != want[i].Seq || !got[i].Time.Equal(want[i].Time) || got[i].Key != want[i].Key || string(got[i].Message) != string(want[i].Message) {
+			t.Errorf("Record %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+	if got[1].Expires == nil || !got[1].Expires.Equal(*want[1].Expires) {
+		t.Errorf("Expected the TTL to be kept, got %v", got[1].Expires)
+	}
+
+	// New messages continue the imported sequence.
+	t2.Publish([]byte("c"))
+	if got, _ = t2.(HistoriedTopic).Range(HistoryQuery{}); got[2].Seq != 3 {
+		t.Errorf("Expected sequence 3, got %d", got[2].Seq)
+	}
+
+	// Importing older messages after newer ones fails.
+	if _, err := ReadArchive(bytes.NewReader(buf.Bytes()), dest); err == nil {
+		t.Error("Expected an error importing old history after new history.")
+	}
+
+	if _, err := ReadArchive(strings.NewReader(`{"format":"tar"}`), NewMedium()); err == nil {
+		t.Error("Expected an error for an unknown format.")
+	}
+}
+
+// deletingWriter deletes a topic on its first write after the header.
+type deletingWriter struct {
+	bytes.Buffer
+	m     *Medium
+	topic string
+}
+
+func (w *deletingWriter) Write(b []byte) (int, error) {
+	if w.Len() > 0 && len(w.topic) > 0 {
+		w.m.Delete(w.topic)
+		w.topic = ""
+	}
+	return w.Buffer.Write(b)
+}
+
+func TestArchiveDeletedTopic(t *testing.T) {
+	m := NewMedium()
+	for _, name := range []string{"one", "two"} {
+		ht := NewHistoriedTopic(name, 10)
+		m.Add(ht)
+		ht.Publish([]byte(name))
+	}
+
+	w := &deletingWriter{m: m, topic: "two"}
+	if err := WriteArchive(w, m); err != nil {
+		t.Fatalf("Expected a deleted topic to be skipped, got %s", err)
+	}
+	counts, err := ReadArchive(bytes.NewReader(w.Bytes()), NewMedium())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["one"] != 1 || counts["two"] != 0 {
+		t.Errorf("Expected only topic one, got %v", counts)
+	}
+}
+
+func TestImportHistoryLimit(t *testing.T) {
+	src := NewMedium()
+	one := NewHistoriedTopic("one", 10)
+	src.Add(one)
+	for i := 0; i < 10; i++ {
+		one.Publish([]byte("message"))
+	}
+	var archive bytes.Buffer
+	if err := WriteArchive(&archive, src); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, router, cxt := cookoo.Cookoo()
+	reg.Route("test", "Test route").
+		Does(ImportHistory, "import").Using("maxBytes").WithDefault(int64(archive.Len() - 1))
+
+	tests := []struct {
+		length int64
+		code   int
+	}{
+		{int64(archive.Len()), http.StatusRequestEntityTooLarge},
+		// A body with no declared length is cut off while it is read.
+		{-1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		m := NewMedium()
+		cxt.AddDatasource(MediumDS, m)
+		req, _ := http.NewRequest("POST", "https://localhost/v1/admin/import", ioutil.NopCloser(bytes.NewReader(archive.Bytes())))
+		req.ContentLength = tt.length
+		res := httptest.NewRecorder()
+		cxt.Put("http.Request", req)
+		cxt.Put("http.ResponseWriter", res)
+		if err := router.HandleRequest("test", cxt, true); err != nil {
+			t.Fatal(err)
+		}
+		if res.Code != tt.code {
+			t.Errorf("Expected %d for length %d, got %d", tt.code, tt.length, res.Code)
+		}
+	}
+}
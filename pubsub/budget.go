@@ -0,0 +1,180 @@
+package pubsub
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HistoryBudget is the memory budget shared by the history of every topic.
+//
+// By default it is unlimited. Use SetMax to cap the total size of all
+// message histories.
+var HistoryBudget = NewBudget(0)
+
+// Budget limits the total number of bytes held in the history of many
+// topics.
+//
+// When the budget is exceeded, the oldest messages are evicted, regardless
+// of which topic they belong to, until the total fits again. Topics are
+// kept in a heap by the time of their oldest message, so that each
+// eviction is O(log n) in the number of topics.
+type Budget struct {
+	max  int64
+	used int64
+
+	// mx guards topics and queue, and serializes eviction. It is never
+	// acquired while a topic's own lock is held.
+	mx     sync.Mutex
+	topics map[*historyTopic]*budgetItem
+	queue  budgetQueue
+}
+
+// budgetItem is a topic's place in the eviction queue.
+//
+// The time may be older than the topic's oldest message, since topics drop
+// messages on their own. It is corrected when the topic reaches the front
+// of the queue.
+type budgetItem struct {
+	h     *historyTopic
+	ts    time.Time
+	empty bool
+	index int
+}
+
+// budgetQueue is a min-heap of topics by the time of their oldest message.
+// Empty topics sort last.
+type budgetQueue []*budgetItem
+
+func (q budgetQueue) Len() int { return len(q) }
+
+func (q budgetQueue) Less(i, j int) bool {
+	if q[i].empty != q[j].empty {
+		return q[j].empty
+	}
+	return q[i].ts.Before(q[j].ts)
+}
+
+func (q budgetQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *budgetQueue) Push(x interface{}) {
+	it := x.(*budgetItem)
+	it.index = len(*q)
+	*q = append(*q, it)
+}
+
+func (q *budgetQueue) Pop() interface{} {
+	old := *q
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return it
+}
+
+// NewBudget creates a Budget of max bytes. Zero means unlimited.
+func NewBudget(max int64) *Budget {
+	b := &Budget{
+		max:    max,
+		topics: map[*historyTopic]*budgetItem{},
+	}
+	budgetGauge.Set(float64(max))
+	return b
+}
+
+// SetMax changes the size of the budget, evicting messages if necessary.
+func (b *Budget) SetMax(max int64) {
+	atomic.StoreInt64(&b.max, max)
+	budgetGauge.Set(float64(max))
+	b.enforce(nil)
+}
+
+// Max returns the size of the budget in bytes. Zero means unlimited.
+func (b *Budget) Max() int64 {
+	return atomic.LoadInt64(&b.max)
+}
+
+// Used returns the number of bytes held in history.
+func (b *Budget) Used() int64 {
+	return atomic.LoadInt64(&b.used)
+}
+
+func (b *Budget) register(h *historyTopic) {
+	b.mx.Lock()
+	it := &budgetItem{h: h, empty: true}
+	b.topics[h] = it
+	heap.Push(&b.queue, it)
+	b.mx.Unlock()
+}
+
+func (b *Budget) unregister(h *historyTopic) {
+	b.mx.Lock()
+	if it, ok := b.topics[h]; ok {
+		heap.Remove(&b.queue, it.index)
+		delete(b.topics, h)
+	}
+	b.mx.Unlock()
+}
+
+// grow records that n bytes were added to (or, if negative, removed from)
+// a history.
+func (b *Budget) grow(n int64) {
+	used := atomic.AddInt64(&b.used, n)
+	memoryGauge.Set(float64(used))
+}
+
+// over returns true if more than the budget is in use.
+func (b *Budget) over() bool {
+	max := b.Max()
+	return max > 0 && b.Used() > max
+}
+
+// refresh moves a topic to its place in the queue by its oldest message.
+// It returns false if the topic was already in place.
+//
+// The caller must hold the lock.
+func (b *Budget) refresh(it *budgetItem) bool {
+	ts, ok := it.h.oldest()
+	if it.empty == !ok && it.ts.Equal(ts) {
+		return false
+	}
+	it.ts, it.empty = ts, !ok
+	heap.Fix(&b.queue, it.index)
+	return true
+}
+
+// enforce evicts the oldest messages across all topics until the budget is
+// no longer exceeded.
+//
+// If h is not nil, and its oldest message may be older than the queue
+// knows, it is put in its place first. That only happens when a message
+// is added to an empty history.
+func (b *Budget) enforce(h *historyTopic) {
+	stale := h != nil && atomic.CompareAndSwapInt32(&h.stale, 1, 0)
+	if !stale && !b.over() {
+		return
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if it, ok := b.topics[h]; stale && ok {
+		b.refresh(it)
+	}
+	for b.over() && len(b.queue) > 0 {
+		it := b.queue[0]
+		// A topic may have dropped its oldest messages since it was
+		// queued. If so, it goes back to its place and the new front is
+		// tried.
+		if b.refresh(it) {
+			continue
+		}
+		if it.empty {
+			return
+		}
+		it.h.evictOldest()
+		b.refresh(it)
+	}
+}
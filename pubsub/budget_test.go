@@ -0,0 +1,109 @@
+package pubsub
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	old := HistoryBudget
+	HistoryBudget = NewBudget(6)
+	defer func() { HistoryBudget = old }()
+
+	one := NewHistoriedTopic("one", 10)
+	two := NewHistoriedTopic("two", 10)
+
+	one.Publish([]byte("a1"))
+	time.Sleep(time.Millisecond)
+	two.Publish([]byte("b1"))
+	time.Sleep(time.Millisecond)
+	one.Publish([]byte("a2"))
+	if u := HistoryBudget.Used(); u != 6 {
+		t.Errorf("Expected 6 bytes used, got %d", u)
+	}
+
+	// This pushes the oldest message, on another topic, out of history.
+	time.Sleep(time.Millisecond)
+	two.Publish([]byte("b2"))
+	if str := string(bytes.Join(one.Last(10), []byte(""))); str != "a2" {
+		t.Errorf("Expected a2, got %s", str)
+	}
+	if str := string(bytes.Join(two.Last(10), []byte(""))); str != "b1b2" {
+		t.Errorf("Expected b1b2, got %s", str)
+	}
+
+	// Shrinking the budget evicts right away.
+	HistoryBudget.SetMax(2)
+	if str := string(bytes.Join(two.Last(10), []byte(""))); str != "b2" {
+		t.Errorf("Expected b2, got %s", str)
+	}
+	if l := one.Last(10); len(l) != 0 {
+		t.Errorf("Expected no history on one, got %d messages", len(l))
+	}
+
+	// Closing a topic releases its memory.
+	two.Close()
+	one.Close()
+	if u := HistoryBudget.Used(); u != 0 {
+		t.Errorf("Expected 0 bytes used, got %d", u)
+	}
+}
+
+func TestBudgetOrder(t *testing.T) {
+	old := HistoryBudget
+	HistoryBudget = NewBudget(0)
+	defer func() { HistoryBudget = old }()
+
+	topics := make([]HistoriedTopic, 50)
+	for i := range topics {
+		topics[i] = NewHistoriedTopic(fmt.Sprintf("t%d", i), 10)
+		defer topics[i].Close()
+	}
+	// Messages go out newest topic first, so the queue has to reorder
+	// them.
+	for i := len(topics) - 1; i >= 0; i-- {
+		topics[i].Publish([]byte("x"))
+		time.Sleep(time.Millisecond)
+	}
+	// An empty topic that is given an old message moves to the front.
+	now := time.Now()
+	empty := NewHistoriedTopic("empty", 10).(*historyTopic)
+	defer empty.Close()
+	empty.Import(Record{Time: now.Add(-time.Hour), Message: []byte("old")})
+
+	// Dropping it and the ten oldest x messages fits the budget.
+	HistoryBudget.SetMax(int64(len(topics)) - 10)
+	if l := empty.Last(10); len(l) != 0 {
+		t.Errorf("Expected the imported message to go first, got %q", l)
+	}
+	for i, top := range topics {
+		want := 1
+		if i >= len(topics)-10 {
+			want = 0
+		}
+		if l := top.Last(10); len(l) != want {
+			t.Errorf("Expected %d messages on %s, got %d", want, top.Name(), len(l))
+		}
+	}
+}
+
+func TestBudgetClosedTopic(t *testing.T) {
+	old := HistoryBudget
+	HistoryBudget = NewBudget(100)
+	defer func() { HistoryBudget = old }()
+
+	one := NewHistoriedTopic("one", 10)
+	one.Publish([]byte("a1"))
+	one.Close()
+	if err := one.Publish([]byte("a2")); err == nil {
+		t.Error("Expected an error publishing to a closed topic.")
+	}
+	if err := one.(*historyTopic).Import(Record{Time: time.Now(), Message: []byte("a3")}); err == nil {
+		t.Error("Expected an error importing into a closed topic.")
+	}
+	if u := HistoryBudget.Used(); u != 0 {
+		t.Errorf("Expected a closed topic to hold no budget, got %d bytes", u)
+	}
+}
@@ -4,33 +4,114 @@
 package pubsub
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Masterminds/cookoo"
+	"github.com/technosophos/drift/httputil"
+	"github.com/technosophos/drift/logging"
 )
 
 const MediumDS = "drift.Medium"
 
 const (
 	// XHistorySince is an HTTP header for the client to send a request for history since TIMESTAMP.
+	// See ParseTime for the accepted formats.
 	XHistorySince = "x-history-since"
 	// XHistoryLength is an HTTP header for the client to send a request for the last N records.
 	XHistoryLength = "x-history-length"
 	// XHistoryEnabled is a flag for the server to notify the client whether history is enabled.
 	XHistoryEnabled = "x-history-enabled"
+	// XHistoryMaxAge is an HTTP header for the client to set how long a topic keeps history.
+	XHistoryMaxAge = "x-history-max-age"
+	// XHistoryMaxBytes is an HTTP header for the client to limit the size of a topic's history.
+	XHistoryMaxBytes = "x-history-max-bytes"
+	// XHistoryCompact is an HTTP header for the client to turn on key-based compaction of a topic's history.
+	XHistoryCompact = "x-history-compact"
+	// XMessageTTL is an HTTP header for the publisher to set how long a message stays in history.
+	XMessageTTL = "x-message-ttl"
+	// XMessageKey is an HTTP header for the publisher to set the key of a message in a compacted history.
+	XMessageKey = "x-message-key"
+	// XMessageRetain is an HTTP header for the publisher to make a message the topic's retained message.
+	XMessageRetain = "x-message-retain"
+	// XTopicEphemeral is an HTTP header for the client to have a topic deleted when its last subscriber leaves.
+	XTopicEphemeral = "x-topic-ephemeral"
+	// XTopicMaxMessageBytes is an HTTP header for the client to limit the size of messages
+	// published to a topic.
+	XTopicMaxMessageBytes = "x-topic-max-message-bytes"
+	// XCloseReason is an HTTP trailer for the server to tell a subscriber why it ended the subscription.
+	XCloseReason = "x-close-reason"
+	// XMetaPrefix is the prefix of HTTP headers in which the publisher sets metadata on a message.
+	// X-Meta-Region: eu sets the region field to eu.
+	XMetaPrefix = "x-meta-"
+	// XFilter is an HTTP header for the subscriber to receive only messages whose metadata matches
+	// a filter expression. See Filter.
+	XFilter = "x-filter"
+	// XJSONFilter is an HTTP header for the subscriber to receive only JSON messages that match a
+	// filter expression on JSON Pointers. See JSONView.
+	XJSONFilter = "x-json-filter"
+	// XJSONFields is an HTTP header for the subscriber to receive only some fields of JSON messages,
+	// as a comma separated list of JSON Pointers. See JSONView.
+	XJSONFields = "x-json-fields"
+	// XSchemaVersion is an HTTP header for the publisher to check a message against an older
+	// version of the topic's schema, rather than the latest.
+	XSchemaVersion = "x-schema-version"
+	// XStreamEvents is an HTTP header for the subscriber to ask for a framed stream with control events.
+	// The server sends it back if the stream is framed.
+	XStreamEvents = "x-stream-events"
 )
 
+// Reasons sent in the XCloseReason trailer.
+const (
+	// CloseDeleted means the topic was deleted.
+	CloseDeleted = "deleted"
+	// CloseExpired means the topic was deleted for being idle.
+	CloseExpired = "expired"
+	// CloseShutdown means the server is shutting down.
+	CloseShutdown = "shutdown"
+	// CloseOverflow means more live messages arrived while history was
+	// replayed than could be buffered, so some were not sent. The
+	// subscriber should resubscribe from the last message it received.
+	CloseOverflow = "overflow"
+)
+
+// retainedSent is the context key that records that ReplayHistory already
+// sent the retained message to a subscriber.
+const retainedSent = "drift.retainedSent"
+
 // Publish sends a new message to a topic.
 //
+// The topic is created if it does not exist. If the Medium does not allow
+// implicit creation, a 404 is sent instead.
+//
+// A message larger than the topic's limit is rejected with a 413. See
+// MessageLimit. If the topic has a schema, a message that does not match
+// it is rejected with a 422 and a JSON SchemaError. See SetSchema.
+//
 // Params:
 // 	- topic (string): The topic to send to.
 // 	- message ([]byte): The message to send.
 // 	- withHistory (bool): Turn on history. Default is true. This only takes
 // 		effect when the channel is created.
+// 	- ttl (time.Duration): How long the message is kept in history. Default
+// 		is the X-Message-TTL header, if the client sent one.
+// 	- key (string): The key of the message, for compacted history. Default
+// 		is the X-Message-Key header, if the client sent one.
+// 	- retain (bool): Make this the topic's retained message. An empty
+// 		message clears the retained message. Default is true if the
+// 		X-Message-Retain header is "true".
+// 	- meta (Metadata): Metadata that subscribers can filter on. Default is
+// 		read from headers starting with X-Meta-.
+// 	- schemaVersion (int): The version of the topic's schema to check the
+// 		message against. Default is the X-Schema-Version header, or the
+// 		latest version.
 //
 // Datasources:
 // 	- This uses the 'drift.Medium' datasource.
@@ -43,20 +124,99 @@ func Publish(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt)
 	if len(topic) == 0 {
 		return nil, errors.New("No topic supplied.")
 	}
+	ttl, err := headerDuration(c, XMessageTTL)
+	if err != nil {
+		return nil, badRequest(c, err)
+	}
+	ttl = p.Get("ttl", ttl).(time.Duration)
+	key := p.Get("key", header(c, XMessageKey)).(string)
+	retain, err := headerBool(c, XMessageRetain)
+	if err != nil {
+		return nil, badRequest(c, err)
+	}
+	retain = p.Get("retain", retain).(bool)
+	var meta Metadata
+	if req, ok := c.Get("http.Request", nil).(*http.Request); ok && req != nil {
+		meta = metadataFromHeader(req.Header)
+	}
+	meta = p.Get("meta", meta).(Metadata)
+	version := 0
+	if v := header(c, XSchemaVersion); len(v) > 0 {
+		if version, err = strconv.Atoi(v); err != nil || version < 1 {
+			return nil, badRequest(c, fmt.Errorf("Invalid %s header: must be a positive version number", http.CanonicalHeaderKey(XSchemaVersion)))
+		}
+	}
+	version = p.Get("schemaVersion", version).(int)
 
 	medium, _ := getMedium(c)
 
 	// Is there any reason to disallow empty messages?
 	msg := p.Get("message", []byte{}).([]byte)
-	c.Logf("info", "Msg: %s", msg)
+	log := httputil.Logger(c).With(logging.Fields{"topic": topic})
+	log.Debugf("Publishing message: %s", log.Payload(msg))
 
-	t := fetchOrCreateTopic(medium, topic, hist, DefaultMaxHistory)
-	return nil, t.Publish(msg)
+	start := time.Now()
+	t, ok := implicitTopic(c, medium, topic, hist)
+	if !ok {
+		return nil, &cookoo.Stop{}
+	}
+	if max := messageLimit(t); max > 0 && int64(len(msg)) > max {
+		return nil, tooLarge(c, max)
+	}
+	// Empty messages that clear the retained message or delete a key are
+	// not checked against the schema.
+	if len(msg) > 0 || !retain && len(key) == 0 {
+		if err := validateMessage(t, msg, version); err != nil {
+			log.Infof("Rejected message: %s", err)
+			return nil, rejectMessage(c, err.(*SchemaError))
+		}
+	}
+	err = t.PublishWith(msg, PublishOptions{TTL: ttl, Key: key, Retain: retain, Meta: meta})
+	publishLatency.Observe(time.Since(start).Seconds())
+	return nil, err
 
 }
 
+// MessageLimit finds the largest message that can be published to a topic,
+// so that httputil.BufferPost can refuse a larger one while reading it,
+// rather than after.
+//
+// Params:
+// 	- topic (string): The topic. If it does not exist, MaxMessageBytes
+// 		applies.
+//
+// Returns:
+// 	- int64 the limit in bytes, or 0 if there is none.
+func MessageLimit(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	name := p.Get("topic", "").(string)
+	medium, err := getMedium(c)
+	if err != nil {
+		return nil, &cookoo.FatalError{Message: "No medium."}
+	}
+	if t, ok := medium.Topic(name); ok {
+		return messageLimit(t), nil
+	}
+	return MaxMessageBytes, nil
+}
+
 // Subscribe allows an request to subscribe to topic updates.
 //
+// The topic is created if it does not exist. If the Medium does not allow
+// implicit creation, a 404 is sent instead. If the topic is ephemeral, it
+// is deleted when the last subscriber leaves.
+//
+// When the server ends the subscription, because the topic was deleted or
+// the server is shutting down, the stream ends with an X-Close-Reason
+// trailer. A stream that ends without one was not closed on purpose.
+//
+// If the subscriber sends X-Stream-Events, the stream is framed: messages
+// and control events are sent as frames, a subscribed event is sent once
+// the subscription is live, and heartbeats are sent every
+// HeartbeatInterval. See WriteFrame.
+//
+// Messages published while an earlier ReplayHistory command was running
+// may be missed. ReplayAndSubscribe does both without a gap.
+//
 // Params:
 // 	- topic (string): The topic to subscribe to.
 // 	-
@@ -64,6 +224,31 @@ func Publish(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt)
 // Returns:
 //
 func Subscribe(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	return subscribe(c, p, false)
+}
+
+// ReplayAndSubscribe sends history to a subscriber, and then subscribes it
+// to the topic, as one step.
+//
+// It takes the same headers as ReplayHistory and Subscribe. Unlike running
+// those two commands in turn, every message published to a topic with
+// history is sent exactly once: either in the replayed history, or live.
+// On a framed stream, a history-complete event marks where the replayed
+// history ends and live messages begin. The retained message of a topic
+// without history is sent live, after the marker.
+//
+// Params:
+// 	- topic (string): The topic to subscribe to.
+//
+// Returns:
+//
+func ReplayAndSubscribe(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	return subscribe(c, p, true)
+}
+
+// subscribe does the work of Subscribe, first replaying history if replay
+// is true.
+func subscribe(c cookoo.Context, p *cookoo.Params, replay bool) (interface{}, cookoo.Interrupt) {
 	medium, err := getMedium(c)
 	if err != nil {
 		return nil, &cookoo.FatalError{"No medium."}
@@ -74,28 +259,159 @@ func Subscribe(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrup
 	}
 
 	rw := c.Get("http.ResponseWriter", nil).(ResponseWriterFlusher)
+	if medium.Closing() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return nil, nil
+	}
 	clientGone := rw.(http.CloseNotifier).CloseNotify()
 
+	var filter *Filter
+	if expr := header(c, XFilter); len(expr) > 0 {
+		if filter, err = ParseFilter(expr); err != nil {
+			return nil, badRequest(c, err)
+		}
+	}
+
+	view, err := ParseJSONView(header(c, XJSONFilter), header(c, XJSONFields))
+	if err != nil {
+		return nil, badRequest(c, err)
+	}
+
 	sub := NewSubscription(rw)
-	t := fetchOrCreateTopic(medium, topic, true, DefaultMaxHistory)
-	t.Subscribe(sub)
+	sub.filter = filter
+	sub.view = view
+	sub.framed = streamEvents(c)
+	sub.heartbeat = HeartbeatInterval
+	if sent, ok := c.Get(retainedSent, false).(bool); ok && sent {
+		sub.skipRetained = true
+	}
+	t, ok := implicitTopic(c, medium, topic, true)
+	if !ok {
+		return nil, &cookoo.Stop{}
+	}
+	listen := true
+	if replay {
+		listen = subscribeWithHistory(c, t, sub)
+	} else {
+		t.Subscribe(sub)
+		sendSubscribed(sub)
+	}
 
 	defer func() {
 		t.Unsubscribe(sub)
 		sub.Close()
+		medium.release(t)
 	}()
 
-	sub.Listen(clientGone)
+	if listen {
+		sub.Listen(clientGone)
+	}
+	if reason := sub.CloseReason(); len(reason) > 0 {
+		rw.Header().Set(http.TrailerPrefix+http.CanonicalHeaderKey(XCloseReason), reason)
+	}
 
 	return nil, nil
 }
 
+// subscribeWithHistory attaches sub to t, and sends it the retained message
+// and the history it asked for. Nothing published to t meanwhile is missed
+// or sent twice: live messages are buffered while history is written, and
+// sent after it, so that a slow subscriber does not hold up publishers.
+//
+// It returns false if the buffer overflowed. The subscription's close
+// reason is then CloseOverflow, and it should not go on to listen.
+func subscribeWithHistory(c cookoo.Context, t Topic, sub *Subscription) bool {
+	req := c.Get("http.Request", nil).(*http.Request)
+	log := httputil.Logger(c).With(logging.Fields{"topic": t.Name()})
+
+	ht, ok := t.(HistoriedTopic)
+	sub.Writer.Header().Set(XHistoryEnabled, historyEnabled(ok))
+	n := 0
+	var live [][]byte
+	complete := true
+	if ok {
+		retained, hist := ht.SubscribeWithHistory(sub, historyQuery(req, log, ht.Compacted()))
+		release := sub.hold(t.Name())
+		sendSubscribed(sub)
+		if retained != nil {
+			if msg, ok := sub.view.Apply(retained); ok {
+				writeMessage(sub.Writer, msg, sub.framed)
+			}
+		}
+		n, _ = sendHistory(log, sub.Writer, hist, sub.framed, sub.view)
+		live, complete = release()
+	} else {
+		t.Subscribe(sub)
+		sendSubscribed(sub)
+	}
+	if sub.framed {
+		writeEvent(sub.Writer, Event{Type: EventHistoryComplete, Count: n})
+	}
+	for _, msg := range live {
+		if msg, ok := sub.view.Apply(msg); ok {
+			writeMessage(sub.Writer, msg, sub.framed)
+		}
+	}
+	if !complete {
+		log.Warnf("More than %d messages arrived during replay. Ending the subscription.", ReplayBufferLen)
+		sub.SetCloseReason(CloseOverflow)
+	}
+	return complete
+}
+
+// sendSubscribed tells a framed subscriber that its subscription is live.
+// It is sent as soon as sub is attached, before any history.
+func sendSubscribed(sub *Subscription) {
+	if !sub.framed {
+		return
+	}
+	hb := ""
+	if sub.heartbeat > 0 {
+		hb = sub.heartbeat.String()
+	}
+	writeEvent(sub.Writer, Event{Type: EventSubscribed, Heartbeat: hb})
+}
+
+// historyEnabled formats the XHistoryEnabled header.
+func historyEnabled(on bool) string {
+	if on {
+		return "True"
+	}
+	return "False"
+}
+
+// TopicDescriptor is the optional JSON body of a request to create a
+// topic.
+type TopicDescriptor struct {
+	// Schema is a JSON Schema that messages must match. If it differs from
+	// the topic's latest schema, it is added as a new version.
+	Schema json.RawMessage `json:"schema,omitempty"`
+}
+
 // CreateTopic creates a new topic.
 //
 // Params:
 // 	- topic (string)
 // 	- history (bool): whether or not to track history
 // 	- historyLength (int): How much history to track. Default is DefaultMaxHistory.
+// 	- historyMaxAge (time.Duration): How long to keep history. Default is
+// 		the X-History-Max-Age header, if the client sent one. If this is
+// 		set, it also applies to an existing topic.
+// 	- historyMaxBytes (int64): The most bytes of messages to keep in history.
+// 		Default is the X-History-Max-Bytes header, if the client sent one. If
+// 		this is set, it also applies to an existing topic.
+// 	- compact (bool): Keep only the latest message for each key in history.
+// 		Default is true if the X-History-Compact header is "true". If this
+// 		is set, it also applies to an existing topic.
+// 	- ephemeral (bool): Delete the topic when its last subscriber leaves.
+// 		Default is true if the X-Topic-Ephemeral header is "true". If this
+// 		is set, it also applies to an existing topic.
+// 	- maxMessageBytes (int64): The largest message that can be published to
+// 		the topic. It cannot raise MaxMessageBytes. Default is the
+// 		X-Topic-Max-Message-Bytes header, if the client sent one. If this is
+// 		set, it also applies to an existing topic.
+// 	- descriptor ([]byte): A JSON TopicDescriptor, usually the request body.
+// 		If it has a schema, it also applies to an existing topic.
 //
 // Returns:
 // 	Topic the new topic.
@@ -107,6 +423,43 @@ func CreateTopic(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interr
 
 	hist := p.Get("history", true).(bool)
 	histLen := p.Get("historyLength", DefaultMaxHistory).(int)
+	maxAge, err := headerDuration(c, XHistoryMaxAge)
+	if err != nil {
+		return nil, badRequest(c, err)
+	}
+	maxAge = p.Get("historyMaxAge", maxAge).(time.Duration)
+	maxBytes, err := headerSize(c, XHistoryMaxBytes)
+	if err != nil {
+		return nil, badRequest(c, err)
+	}
+	maxBytes = p.Get("historyMaxBytes", maxBytes).(int64)
+	compact, err := headerBool(c, XHistoryCompact)
+	if err != nil {
+		return nil, badRequest(c, err)
+	}
+	compact = p.Get("compact", compact).(bool)
+	ephemeral, err := headerBool(c, XTopicEphemeral)
+	if err != nil {
+		return nil, badRequest(c, err)
+	}
+	ephemeral = p.Get("ephemeral", ephemeral).(bool)
+	maxMessage, err := headerSize(c, XTopicMaxMessageBytes)
+	if err != nil {
+		return nil, badRequest(c, err)
+	}
+	maxMessage = p.Get("maxMessageBytes", maxMessage).(int64)
+	var schema *Schema
+	if body := p.Get("descriptor", []byte{}).([]byte); len(bytes.TrimSpace(body)) > 0 {
+		desc := TopicDescriptor{}
+		if err := json.Unmarshal(body, &desc); err != nil {
+			return nil, badRequest(c, fmt.Errorf("Invalid topic descriptor: %s", err))
+		}
+		if len(desc.Schema) > 0 {
+			if schema, err = ParseSchema(desc.Schema); err != nil {
+				return nil, badRequest(c, err)
+			}
+		}
+	}
 
 	m, err := getMedium(c)
 	if err != nil {
@@ -114,6 +467,26 @@ func CreateTopic(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interr
 	}
 
 	t := fetchOrCreateTopic(m, name, hist, histLen)
+	if ephemeral {
+		t.SetEphemeral(true)
+	}
+	if maxMessage > 0 {
+		t.SetMaxMessageBytes(maxMessage)
+	}
+	if schema != nil {
+		t.AddSchema(schema)
+	}
+	if ht, ok := t.(HistoriedTopic); ok {
+		if maxAge > 0 {
+			ht.SetMaxAge(maxAge)
+		}
+		if maxBytes > 0 {
+			ht.SetMaxBytes(maxBytes)
+		}
+		if compact {
+			ht.SetCompact(true)
+		}
+	}
 
 	return t, nil
 
@@ -139,7 +512,7 @@ func DeleteTopic(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interr
 
 	err = m.Delete(name)
 	if err != nil {
-		c.Logf("warn", "Failed to delete topic: %s", err)
+		httputil.Logger(c).Warnf("Failed to delete topic: %s", err)
 	}
 
 	return nil, nil
@@ -176,6 +549,19 @@ func TopicExists(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interr
 // ReplayHistory sends back the history to a subscriber.
 //
 // This should be called before the client goes into active listening.
+// Messages published between this and Subscribe are missed, so prefer
+// ReplayAndSubscribe, which does both.
+//
+// If the topic has a retained message, it is sent before any history, and
+// Subscribe will not send it again.
+//
+// If the client sends neither X-History-Since nor X-History-Length, no
+// history is sent, unless the topic is compacted. Then the whole compacted
+// history is sent.
+//
+// On a framed stream (see Subscribe), a history-complete event is sent
+// after the history, even if there was none, so the subscriber can tell
+// replayed messages from live ones.
 //
 // Params:
 // - topic (string): The topic to fetch.
@@ -183,30 +569,69 @@ func TopicExists(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interr
 // Returns:
 // 	- int: The number of history messages sent to the client.
 func ReplayHistory(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	res := c.Get("http.ResponseWriter", nil).(ResponseWriterFlusher)
+	framed := streamEvents(c)
+	n, err := replayHistory(c, p, framed)
+	if framed {
+		writeEvent(res, Event{Type: EventHistoryComplete, Count: n})
+	}
+	return n, err
+}
+
+// replayHistory does the work of ReplayHistory, and returns the number of
+// history messages sent.
+func replayHistory(c cookoo.Context, p *cookoo.Params, framed bool) (int, cookoo.Interrupt) {
 	req := c.Get("http.Request", nil).(*http.Request)
 	res := c.Get("http.ResponseWriter", nil).(ResponseWriterFlusher)
 	medium, _ := getMedium(c)
 	name := p.Get("topic", "").(string)
+	log := httputil.Logger(c).With(logging.Fields{"topic": name})
 
 	// This does not manage topics. If there is no topic set, we silently fail.
 	if len(name) == 0 {
-		c.Log("info", "No topic name given to ReplayHistory.")
+		log.Infof("No topic name given to ReplayHistory.")
 		return 0, nil
 	}
 	top, ok := medium.Topic(name)
 	if !ok {
-		c.Logf("info", "No topic named %s exists yet. No history replayed.", name)
+		log.Infof("No topic named %s exists yet. No history replayed.", name)
 		return 0, nil
 	}
 
+	// Headers must be set before anything is written.
 	topic, ok := top.(HistoriedTopic)
+	res.Header().Set(XHistoryEnabled, historyEnabled(ok))
+
+	// Views are checked again, and rejected, by Subscribe.
+	view, _ := ParseJSONView(header(c, XJSONFilter), header(c, XJSONFields))
+
+	// A filtered subscriber gets the retained message from Subscribe, which
+	// knows its metadata.
+	if msg, ok := top.Retained(); ok && len(header(c, XFilter)) == 0 {
+		if msg, ok = view.Apply(msg); ok {
+			writeMessage(res, msg, framed)
+		}
+		c.Put(retainedSent, true)
+	}
 	if !ok {
-		c.Logf("info", "No history for topic %s.", name)
-		res.Header().Add(XHistoryEnabled, "False")
+		log.Infof("No history for topic %s.", name)
 		return 0, nil
 	}
-	res.Header().Add(XHistoryEnabled, "True")
 
+	query := historyQuery(req, log, topic.Compacted())
+	if query == nil {
+		return 0, nil
+	}
+	return sendHistory(log, res, query(topic), framed, view)
+}
+
+// historyQuery reads which history a subscriber asked for from the
+// X-History-Since and X-History-Length headers. It returns nil if no
+// history should be sent.
+//
+// If the subscriber asked for neither, the whole of a compacted history is
+// sent, since it is a snapshot of current state.
+func historyQuery(req *http.Request, log *logging.Logger, compacted bool) func(History) [][]byte {
 	since := req.Header.Get(XHistorySince)
 	max := req.Header.Get(XHistoryLength)
 
@@ -215,7 +640,7 @@ func ReplayHistory(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Inte
 	if len(max) > 0 {
 		m, err := parseHistLen(max)
 		if err != nil {
-			c.Logf("info", "failed to parse X-History-Length %s", max)
+			log.Infof("failed to parse X-History-Length %s", max)
 		} else {
 			maxLen = m
 		}
@@ -223,49 +648,290 @@ func ReplayHistory(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Inte
 	if len(since) > 0 {
 		ts, err := parseSince(since)
 		if err != nil {
-			c.Logf("warn", "Failed to parse X-History-Since field %s: %s", since, err)
-			return 0, nil
+			log.Warnf("Failed to parse X-History-Since field %s: %s", since, err)
+			return nil
 		}
-		toSend := topic.Since(ts)
-
-		// If maxLen is also set, we trim the list by sending the newest.
-		ls := len(toSend)
-		if maxLen > 0 && ls > maxLen {
-			offset := ls - maxLen - 1
-			toSend = toSend[offset:]
+		return func(h History) [][]byte {
+			toSend := h.Since(ts)
+			// If maxLen is also set, we trim the list by sending the newest.
+			if ls := len(toSend); maxLen > 0 && ls > maxLen {
+				toSend = toSend[ls-maxLen:]
+			}
+			return toSend
 		}
-		return sendHistory(c, res, toSend)
 	} else if maxLen > 0 {
-		toSend := topic.Last(maxLen)
-		return sendHistory(c, res, toSend)
+		return func(h History) [][]byte { return h.Last(maxLen) }
+	} else if compacted {
+		return func(h History) [][]byte { return h.Since(time.Time{}) }
+	}
+	return nil
+}
+
+var (
+	// DefaultHistoryQueryLimit is how many records QueryHistory returns if
+	// the client does not set a limit.
+	DefaultHistoryQueryLimit = 100
+	// MaxHistoryQueryLimit is the most records QueryHistory returns at once.
+	MaxHistoryQueryLimit = 1000
+)
+
+// HistoryPage is a page of history returned by QueryHistory.
+type HistoryPage struct {
+	Topic    string   `json:"topic"`
+	Messages []Record `json:"messages"`
+	// Next is the sequence number to query from for the next page. It is
+	// zero if this is the last page.
+	Next uint64 `json:"next,omitempty"`
+}
+
+// QueryHistory writes a range of a topic's history as JSON.
+//
+// Unlike ReplayHistory, this does not subscribe, so it works with any HTTP
+// client. The range is read from the query string: "from" and "to" are
+// inclusive bounds, each either a sequence number or an RFC 3339 time, and
+// "limit" caps the number of messages returned. Results are paginated: if
+// more messages match, the response has a "next" sequence number to pass as
+// "from".
+//
+// Params:
+// 	- topic (string): The topic to query.
+//
+// Returns:
+// 	- *HistoryPage
+func QueryHistory(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	req := c.Get("http.Request", nil).(*http.Request)
+	res := c.Get("http.ResponseWriter", nil).(http.ResponseWriter)
+	name := p.Get("topic", "").(string)
+
+	medium, err := getMedium(c)
+	if err != nil {
+		return nil, &cookoo.FatalError{Message: "No medium."}
+	}
+
+	q, err := parseHistoryQuery(req.URL.Query())
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return nil, nil
 	}
 
-	return 0, nil
+	t, ok := medium.Topic(name)
+	if !ok {
+		http.Error(res, fmt.Sprintf("No topic named %s.", name), http.StatusNotFound)
+		return nil, nil
+	}
+	ht, ok := t.(HistoriedTopic)
+	if !ok {
+		http.Error(res, fmt.Sprintf("Topic %s has no history.", name), http.StatusNotFound)
+		return nil, nil
+	}
+
+	page := &HistoryPage{Topic: name}
+	var more bool
+	page.Messages, more = ht.Range(q)
+	if more {
+		page.Next = page.Messages[len(page.Messages)-1].Seq + 1
+	}
+	return page, writeJSON(res, http.StatusOK, page)
 }
 
-// sendHistory sends the accumulated history to the writer.
-func sendHistory(c cookoo.Context, writer ResponseWriterFlusher, data [][]byte) (int, error) {
-	c.Logf("info", "Sending history.")
-	var i int
-	var d []byte
-	for i, d = range data {
-		_, err := writer.Write(d)
+// parseHistoryQuery reads a HistoryQuery from the query string of a request.
+func parseHistoryQuery(v url.Values) (HistoryQuery, error) {
+	q := HistoryQuery{Limit: DefaultHistoryQueryLimit}
+	if l := v.Get("limit"); len(l) > 0 {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return q, fmt.Errorf("Invalid limit %q", l)
+		}
+		q.Limit = n
+	}
+	if q.Limit > MaxHistoryQueryLimit {
+		q.Limit = MaxHistoryQueryLimit
+	}
+
+	bound := func(name string, seq *uint64, ts *time.Time) error {
+		s := v.Get(name)
+		if len(s) == 0 {
+			return nil
+		}
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			*seq = n
+			return nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
 		if err != nil {
-			c.Logf("warn", "Failed to write history message: %s", err)
-			return i + 1, nil
+			return fmt.Errorf("Invalid %s %q: must be a sequence number or an RFC 3339 time", name, s)
 		}
-		writer.Flush()
+		*ts = t
+		return nil
 	}
-	return i + 1, nil
+	if err := bound("from", &q.FromSeq, &q.From); err != nil {
+		return q, err
+	}
+	if err := bound("to", &q.ToSeq, &q.To); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// sendHistory sends the accumulated history to the writer through a view,
+// and returns the number of messages sent.
+func sendHistory(log *logging.Logger, writer ResponseWriterFlusher, data [][]byte, framed bool, view *JSONView) (int, cookoo.Interrupt) {
+	log.Infof("Sending history.")
+	sent := 0
+	for _, d := range data {
+		d, ok := view.Apply(d)
+		if !ok {
+			continue
+		}
+		if err := writeMessage(writer, d, framed); err != nil {
+			log.Warnf("Failed to write history message: %s", err)
+			break
+		}
+		sent++
+	}
+	return sent, nil
 }
 
 // parseSince parses the X-History-Since value.
 func parseSince(s string) (time.Time, error) {
-	tint, err := strconv.ParseInt(s, 0, 64)
+	return ParseTime(s)
+}
+
+// millisThreshold separates UNIX seconds from UNIX milliseconds. As seconds
+// it is in the year 5138, and as milliseconds it is in 1973.
+const millisThreshold = 1e11
+
+// ParseTime parses a timestamp in any of the formats Drift accepts:
+//
+// 	- An RFC 3339 time, with up to nanosecond precision, such as
+// 		2016-01-02T15:04:05.123456789Z.
+// 	- UNIX seconds, optionally with a fraction, such as 1451747045 or
+// 		1451747045.123.
+// 	- UNIX milliseconds, such as 1451747045123. Any whole number too large
+// 		to be a time in seconds is taken to be milliseconds.
+func ParseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	n, err := strconv.ParseInt(whole, 10, 64)
 	if err != nil {
 		return time.Unix(0, 0), fmt.Errorf("Could not parse as time: %s", s)
 	}
-	return time.Unix(tint, 0), nil
+	if len(frac) == 0 {
+		if n >= millisThreshold || n <= -millisThreshold {
+			return time.Unix(n/1000, (n%1000)*int64(time.Millisecond)), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	// Parse the fraction as nanoseconds, so no precision is lost.
+	if len(frac) > 9 {
+		frac = frac[:9]
+	}
+	nanos, err := strconv.ParseUint(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+	if err != nil || n >= millisThreshold || n < 0 {
+		return time.Unix(0, 0), fmt.Errorf("Could not parse as time: %s", s)
+	}
+	return time.Unix(n, int64(nanos)), nil
+}
+
+// parseDuration parses a duration header, such as X-Message-TTL.
+//
+// The value is either a whole number of seconds or a Go duration string,
+// such as "90s" or "1h30m". It must be positive.
+func parseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		secs, serr := strconv.ParseInt(s, 10, 64)
+		if serr != nil {
+			return 0, fmt.Errorf("Could not parse as duration: %s", s)
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("Duration must be positive: %s", s)
+	}
+	return d, nil
+}
+
+// header returns a header of the current request, or "" if there is no
+// request.
+func header(c cookoo.Context, name string) string {
+	req, ok := c.Get("http.Request", nil).(*http.Request)
+	if !ok || req == nil {
+		return ""
+	}
+	return req.Header.Get(name)
+}
+
+// headerBool parses a boolean from a header of the current request.
+//
+// If there is no request, or the header is not set, it returns false.
+func headerBool(c cookoo.Context, name string) (bool, error) {
+	v := header(c, name)
+	if len(v) == 0 {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s header: %s", http.CanonicalHeaderKey(name), v)
+	}
+	return b, nil
+}
+
+// headerDuration parses a duration from a header of the current request.
+//
+// If there is no request, or the header is not set, it returns 0.
+func headerDuration(c cookoo.Context, name string) (time.Duration, error) {
+	v := header(c, name)
+	if len(v) == 0 {
+		return 0, nil
+	}
+	d, err := parseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s header: %s", http.CanonicalHeaderKey(name), err)
+	}
+	return d, nil
+}
+
+// headerSize parses a positive number of bytes from a header of the
+// current request.
+//
+// If there is no request, or the header is not set, it returns 0.
+func headerSize(c cookoo.Context, name string) (int64, error) {
+	v := header(c, name)
+	if len(v) == 0 {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid %s header: must be a positive number of bytes", http.CanonicalHeaderKey(name))
+	}
+	return n, nil
+}
+
+// tooLarge sends an HTTP 413 for a message over max bytes, if there is a
+// response to write to.
+//
+// It returns an Interrupt that stops the route.
+func tooLarge(c cookoo.Context, max int64) cookoo.Interrupt {
+	if res, ok := c.Get("http.ResponseWriter", nil).(http.ResponseWriter); ok {
+		http.Error(res, fmt.Sprintf("Message is larger than %d bytes.", max), http.StatusRequestEntityTooLarge)
+	}
+	return &cookoo.Stop{}
+}
+
+// badRequest sends an HTTP 400 for err, if there is a response to write to.
+//
+// It returns an Interrupt that stops the route.
+func badRequest(c cookoo.Context, err error) cookoo.Interrupt {
+	if res, ok := c.Get("http.ResponseWriter", nil).(http.ResponseWriter); ok {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+	}
+	return &cookoo.Stop{}
 }
 
 // parseHistLen parses the X-History-Length value.
@@ -273,15 +939,35 @@ func parseHistLen(s string) (int, error) {
 	return strconv.Atoi(s)
 }
 
-// fetchOrCreateTopic gets a topic if it exists, and creates one if it doesn't.
-func fetchOrCreateTopic(m *Medium, name string, hist bool, l int) Topic {
+// implicitTopic gets a topic for a publisher or subscriber, creating it if
+// the Medium allows implicit creation.
+//
+// If the topic does not exist and cannot be created, it sends a 404 and
+// returns false.
+func implicitTopic(c cookoo.Context, m *Medium, name string, hist bool) (Topic, bool) {
+	if m.AutoCreate() {
+		return fetchOrCreateTopic(m, name, hist, DefaultMaxHistory), true
+	}
 	t, ok := m.Topic(name)
 	if !ok {
-		t = NewTopic(name)
+		if res, ok := c.Get("http.ResponseWriter", nil).(http.ResponseWriter); ok {
+			http.Error(res, fmt.Sprintf("No topic named %s.", name), http.StatusNotFound)
+		}
+	}
+	return t, ok
+}
+
+// fetchOrCreateTopic gets a topic if it exists, and creates one if it doesn't.
+//
+// If several requests race to create the same topic, only one topic is
+// created, and all of them use it.
+func fetchOrCreateTopic(m *Medium, name string, hist bool, l int) Topic {
+	t, _ := m.FetchOrCreate(name, func(name string) Topic {
+		t := NewTopic(name)
 		if hist && l > 0 {
 			t = TrackHistory(t, l)
 		}
-		m.Add(t)
-	}
+		return t
+	})
 	return t
 }
@@ -1,9 +1,13 @@
 package pubsub
 
 import (
+	"encoding/json"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Masterminds/cookoo"
 )
@@ -42,3 +46,522 @@ func TestReplayHistory(t *testing.T) {
 	}
 
 }
+
+func TestQueryHistory(t *testing.T) {
+	reg, router, cxt := cookoo.Cookoo()
+
+	medium := NewMedium()
+	cxt.AddDatasource(MediumDS, medium)
+
+	topic := NewHistoriedTopic("test", 5)
+	medium.Add(topic)
+	for _, s := range []string{"a", "b", "c"} {
+		topic.Publish([]byte(s))
+	}
+
+	reg.Route("test", "Test route").
+		Does(QueryHistory, "res").Using("topic").WithDefault("test")
+
+	req, _ := http.NewRequest("GET", "https://localhost/v1/t/test/history?from=1&limit=2", nil)
+	res := &mockResponseWriter{}
+	cxt.Put("http.Request", req)
+	cxt.Put("http.ResponseWriter", res)
+	if err := router.HandleRequest("test", cxt, true); err != nil {
+		t.Fatal(err)
+	}
+
+	page := &HistoryPage{}
+	if err := json.Unmarshal(res.Buf(), page); err != nil {
+		t.Fatalf("Could not decode %s: %s", res.String(), err)
+	}
+	if len(page.Messages) != 2 || string(page.Messages[1].Message) != "b" || page.Next != 3 {
+		t.Errorf("Unexpected page: %+v", page)
+	}
+
+	req, _ = http.NewRequest("GET", "https://localhost/v1/t/test/history?from=yesterday", nil)
+	res = &mockResponseWriter{}
+	cxt.Put("http.Request", req)
+	cxt.Put("http.ResponseWriter", res)
+	router.HandleRequest("test", cxt, true)
+	if res.code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad bound, got %d", res.code)
+	}
+}
+
+func TestAutoCreate(t *testing.T) {
+	reg, router, cxt := cookoo.Cookoo()
+
+	medium := NewMedium()
+	medium.SetAutoCreate(false)
+	cxt.AddDatasource(MediumDS, medium)
+
+	reg.Route("test", "Test route").
+		Does(Publish, "pub").Using("topic").WithDefault("test").Using("message").WithDefault([]byte("hi"))
+
+	req, _ := http.NewRequest("POST", "https://localhost/v1/t/test", nil)
+	res := &mockResponseWriter{}
+	cxt.Put("http.Request", req)
+	cxt.Put("http.ResponseWriter", res)
+	if err := router.HandleRequest("test", cxt, true); err != nil {
+		t.Error(err)
+	}
+	if res.code != http.StatusNotFound {
+		t.Errorf("Expected a 404, got %d", res.code)
+	}
+	if _, ok := medium.Topic("test"); ok {
+		t.Error("Expected no topic to be created.")
+	}
+
+	medium.SetAutoCreate(true)
+	res = &mockResponseWriter{}
+	cxt.Put("http.ResponseWriter", res)
+	if err := router.HandleRequest("test", cxt, true); err != nil {
+		t.Error(err)
+	}
+	if _, ok := medium.Topic("test"); !ok {
+		t.Error("Expected the topic to be created.")
+	}
+}
+
+// slowWriter is a response writer that blocks its first write until
+// release is closed.
+type slowWriter struct {
+	*mockResponseWriter
+	release chan struct{}
+	once    sync.Once
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() { <-w.release })
+	return w.mockResponseWriter.Write(b)
+}
+
+func TestReplayAndSubscribeSlow(t *testing.T) {
+	reg, router, cxt := cookoo.Cookoo()
+
+	medium := NewMedium()
+	cxt.AddDatasource(MediumDS, medium)
+	topic := NewHistoriedTopic("test", 1000)
+	medium.Add(topic)
+	for i := 0; i < 50; i++ {
+		topic.Publish([]byte(strconv.Itoa(i)))
+	}
+
+	reg.Route("test", "Test route").
+		Does(ReplayAndSubscribe, "sub").Using("topic").WithDefault("test")
+
+	req, _ := http.NewRequest("GET", "https://localhost/v1/t/test", nil)
+	req.Header.Add(XHistoryLength, "1000")
+	res := &slowWriter{mockResponseWriter: &mockResponseWriter{}, release: make(chan struct{})}
+	cxt.Put("http.Request", req)
+	cxt.Put("http.ResponseWriter", res)
+
+	done := make(chan error)
+	go func() {
+		done <- router.HandleRequest("test", cxt, true)
+	}()
+	for len(topic.Subscribers()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The subscriber is stuck replaying history, which must not hold up
+	// publishers, even past the capacity of its queue.
+	published := make(chan struct{})
+	go func() {
+		for i := 50; i < 100; i++ {
+			topic.Publish([]byte(strconv.Itoa(i) + ","))
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Publishing blocked on a slow replay.")
+	}
+	close(res.release)
+	for len(topic.Last(1000)) < 100 {
+		time.Sleep(time.Millisecond)
+	}
+	medium.Delete("test")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	expect := ""
+	for i := 0; i < 100; i++ {
+		if i < 50 {
+			expect += strconv.Itoa(i)
+		} else {
+			expect += strconv.Itoa(i) + ","
+		}
+	}
+	if got := res.String(); got != expect {
+		t.Errorf("Expected every message once, in order, got %q", got)
+	}
+}
+
+func TestReplayAndSubscribeOverflow(t *testing.T) {
+	defer func(n int) { ReplayBufferLen = n }(ReplayBufferLen)
+	ReplayBufferLen = 10
+	reg, router, cxt := cookoo.Cookoo()
+
+	medium := NewMedium()
+	cxt.AddDatasource(MediumDS, medium)
+	topic := NewHistoriedTopic("test", 1000)
+	medium.Add(topic)
+	topic.Publish([]byte("h,"))
+
+	reg.Route("test", "Test route").
+		Does(ReplayAndSubscribe, "sub").Using("topic").WithDefault("test")
+
+	req, _ := http.NewRequest("GET", "https://localhost/v1/t/test", nil)
+	req.Header.Add(XHistoryLength, "1000")
+	res := &slowWriter{mockResponseWriter: &mockResponseWriter{}, release: make(chan struct{})}
+	cxt.Put("http.Request", req)
+	cxt.Put("http.ResponseWriter", res)
+
+	done := make(chan error)
+	go func() {
+		done <- router.HandleRequest("test", cxt, true)
+	}()
+	for len(topic.Subscribers()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 30; i++ {
+		topic.Publish([]byte(strconv.Itoa(i) + ","))
+	}
+	close(res.release)
+
+	// The stream ends on its own, after the messages that fit, and says
+	// why.
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the subscription to end after an overflow.")
+	}
+	expect := "h,"
+	for i := 0; i < 10; i++ {
+		expect += strconv.Itoa(i) + ","
+	}
+	if got := res.String(); got != expect {
+		t.Errorf("Expected %q, got %q", expect, got)
+	}
+	if r := res.Header().Get(http.TrailerPrefix + http.CanonicalHeaderKey(XCloseReason)); r != CloseOverflow {
+		t.Errorf("Expected close reason %q, got %q", CloseOverflow, r)
+	}
+	if n := len(topic.Subscribers()); n != 0 {
+		t.Errorf("Expected the subscriber to be removed, got %d", n)
+	}
+}
+
+func TestMessageLimit(t *testing.T) {
+	defer func(max int64) { MaxMessageBytes = max }(MaxMessageBytes)
+	MaxMessageBytes = 10
+
+	reg, router, cxt := cookoo.Cookoo()
+	medium := NewMedium()
+	cxt.AddDatasource(MediumDS, medium)
+
+	reg.Route("create", "Test route").
+		Does(CreateTopic, "topic").Using("topic").WithDefault("test")
+	reg.Route("publish", "Test route").
+		Does(MessageLimit, "limit").Using("topic").WithDefault("test").
+		Does(Publish, "pub").Using("topic").WithDefault("test").Using("message").From("cxt:message")
+
+	publish := func(msg string) int {
+		req, _ := http.NewRequest("POST", "https://localhost/v1/t/test", nil)
+		res := &mockResponseWriter{}
+		cxt.Put("http.Request", req)
+		cxt.Put("http.ResponseWriter", res)
+		cxt.Put("message", []byte(msg))
+		if err := router.HandleRequest("publish", cxt, true); err != nil {
+			t.Fatal(err)
+		}
+		return res.code
+	}
+
+	// Before the topic exists, the global limit applies.
+	if code := publish("0123456789x"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a 413, got %d", code)
+	}
+	if limit := cxt.Get("limit", nil); limit != int64(10) {
+		t.Errorf("Expected a limit of 10, got %v", limit)
+	}
+	if code := publish("0123456789"); code == http.StatusRequestEntityTooLarge {
+		t.Error("Expected a message at the limit to be published.")
+	}
+
+	for _, tt := range []struct {
+		header string
+		expect int64
+	}{{"4", 4}, {"20", 10}} {
+		req, _ := http.NewRequest("PUT", "https://localhost/v1/t/test", nil)
+		req.Header.Set(XTopicMaxMessageBytes, tt.header)
+		cxt.Put("http.Request", req)
+		cxt.Put("http.ResponseWriter", &mockResponseWriter{})
+		router.HandleRequest("create", cxt, true)
+
+		publish("")
+		if limit := cxt.Get("limit", nil); limit != tt.expect {
+			t.Errorf("Expected a limit of %d for a topic limit of %s, got %v", tt.expect, tt.header, limit)
+		}
+	}
+	if code := publish("01234"); code == http.StatusRequestEntityTooLarge {
+		t.Error("Expected a topic limit above the global limit not to lower it.")
+	}
+}
+
+func TestSubscribeCloseReason(t *testing.T) {
+	reg, router, cxt := cookoo.Cookoo()
+
+	medium := NewMedium()
+	cxt.AddDatasource(MediumDS, medium)
+	topic := NewTopic("test")
+	medium.Add(topic)
+
+	reg.Route("test", "Test route").
+		Does(Subscribe, "sub").Using("topic").WithDefault("test")
+
+	res := &mockResponseWriter{}
+	cxt.Put("http.ResponseWriter", res)
+	done := make(chan error)
+	go func() {
+		done <- router.HandleRequest("test", cxt, true)
+	}()
+	for len(topic.Subscribers()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	medium.Delete("test")
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if reason := res.Header().Get(http.TrailerPrefix + "X-Close-Reason"); reason != CloseDeleted {
+		t.Errorf("Expected a %s trailer, got %q", CloseDeleted, reason)
+	}
+}
+
+func TestReplayAndSubscribe(t *testing.T) {
+	reg, router, cxt := cookoo.Cookoo()
+
+	medium := NewMedium()
+	cxt.AddDatasource(MediumDS, medium)
+	topic := NewHistoriedTopic("test", 1000)
+	medium.Add(topic)
+	for i := 0; i < 100; i++ {
+		topic.Publish([]byte(strconv.Itoa(i)))
+	}
+
+	reg.Route("test", "Test route").
+		Does(ReplayAndSubscribe, "sub").Using("topic").WithDefault("test")
+
+	req, _ := http.NewRequest("GET", "https://localhost/v1/t/test", nil)
+	req.Header.Add(XHistoryLength, "1000")
+	req.Header.Add(XStreamEvents, "true")
+	res := &mockResponseWriter{}
+	cxt.Put("http.Request", req)
+	cxt.Put("http.ResponseWriter", res)
+
+	// Publish while subscribing, so that some messages land at the boundary.
+	published := make(chan struct{})
+	go func() {
+		for i := 100; i < 500; i++ {
+			topic.Publish([]byte(strconv.Itoa(i)))
+		}
+		close(published)
+	}()
+	done := make(chan error)
+	go func() {
+		done <- router.HandleRequest("test", cxt, true)
+	}()
+	<-published
+	for len(topic.Subscribers()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	medium.Delete("test")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// The subscribed event comes first. Then every message should arrive
+	// once, in order, with the marker after the replayed ones.
+	frames := readFrames(t, res.Buf())
+	if len(frames) == 0 || frames[0].kind != FrameEvent || frameEvent(t, frames[0]).Type != EventSubscribed {
+		t.Fatal("Expected the subscribed event before history.")
+	}
+	next, replayed := 0, -1
+	for _, f := range frames[1:] {
+		if f.kind == FrameMessage {
+			if string(f.payload) != strconv.Itoa(next) {
+				t.Fatalf("Expected message %d, got %s", next, f.payload)
+			}
+			next++
+			continue
+		}
+		if e := frameEvent(t, f); e.Type == EventHistoryComplete {
+			if e.Count != next {
+				t.Errorf("Expected the marker after %d messages, got count %d", next, e.Count)
+			}
+			replayed = e.Count
+		}
+	}
+	if next != 500 {
+		t.Errorf("Expected 500 messages, got %d", next)
+	}
+	if replayed < 100 {
+		t.Errorf("Expected at least 100 replayed messages, got %d", replayed)
+	}
+	if res.Header().Get(XHistoryEnabled) != "True" {
+		t.Error("Expected history to be enabled.")
+	}
+}
+
+func TestSubscribeFilter(t *testing.T) {
+	reg, router, cxt := cookoo.Cookoo()
+
+	medium := NewMedium()
+	cxt.AddDatasource(MediumDS, medium)
+	topic := NewHistoriedTopic("test", 10)
+	medium.Add(topic)
+	eu, us := Metadata{"region": "eu"}, Metadata{"region": "us"}
+	topic.PublishWith([]byte("old-eu,"), PublishOptions{Meta: eu})
+	topic.PublishWith([]byte("old-us,"), PublishOptions{Meta: us})
+	topic.PublishWith([]byte("retained-us,"), PublishOptions{Meta: us, Retain: true})
+
+	reg.Route("test", "Test route").
+		Does(ReplayAndSubscribe, "sub").Using("topic").WithDefault("test")
+
+	req, _ := http.NewRequest("GET", "https://localhost/v1/t/test", nil)
+	req.Header.Add(XHistoryLength, "10")
+	req.Header.Add(XFilter, `region == "eu"`)
+	res := &mockResponseWriter{}
+	cxt.Put("http.Request", req)
+	cxt.Put("http.ResponseWriter", res)
+
+	done := make(chan error)
+	go func() {
+		done <- router.HandleRequest("test", cxt, true)
+	}()
+	for len(topic.Subscribers()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	topic.PublishWith([]byte("new-us,"), PublishOptions{Meta: us})
+	topic.PublishWith([]byte("new-eu,"), PublishOptions{Meta: eu})
+	topic.Publish([]byte("none,"))
+	medium.Delete("test")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if got := res.String(); got != "old-eu,new-eu," {
+		t.Errorf("Expected only eu messages, got %q", got)
+	}
+
+	// A bad filter is rejected before subscribing.
+	req.Header.Set(XFilter, `region ==`)
+	res = &mockResponseWriter{}
+	cxt.Put("http.ResponseWriter", res)
+	router.HandleRequest("test", cxt, true)
+	if res.code != http.StatusBadRequest {
+		t.Errorf("Expected a 400, got %d", res.code)
+	}
+}
+
+func TestSubscribeJSONView(t *testing.T) {
+	reg, router, cxt := cookoo.Cookoo()
+
+	medium := NewMedium()
+	cxt.AddDatasource(MediumDS, medium)
+	topic := NewHistoriedTopic("test", 10)
+	medium.Add(topic)
+	topic.Publish([]byte(`{"level":5,"msg":"old","host":"a"}`))
+	topic.Publish([]byte(`{"level":1,"msg":"quiet"}`))
+
+	reg.Route("test", "Test route").
+		Does(ReplayAndSubscribe, "sub").Using("topic").WithDefault("test")
+
+	req, _ := http.NewRequest("GET", "https://localhost/v1/t/test", nil)
+	req.Header.Add(XHistoryLength, "10")
+	req.Header.Add(XJSONFilter, "/level >= 3")
+	req.Header.Add(XJSONFields, "/msg")
+	res := &mockResponseWriter{}
+	cxt.Put("http.Request", req)
+	cxt.Put("http.ResponseWriter", res)
+
+	done := make(chan error)
+	go func() {
+		done <- router.HandleRequest("test", cxt, true)
+	}()
+	for len(topic.Subscribers()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	topic.Publish([]byte(`not json`))
+	topic.Publish([]byte(`{"level":9,"msg":"new","host":"b"}`))
+	medium.Delete("test")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if got := res.String(); got != `{"msg":"old"}{"msg":"new"}` {
+		t.Errorf("Expected projected messages, got %q", got)
+	}
+
+	req.Header.Set(XJSONFields, "msg")
+	res = &mockResponseWriter{}
+	cxt.Put("http.ResponseWriter", res)
+	router.HandleRequest("test", cxt, true)
+	if res.code != http.StatusBadRequest {
+		t.Errorf("Expected a 400, got %d", res.code)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"90":    90 * time.Second,
+		"90s":   90 * time.Second,
+		"1h30m": 90 * time.Minute,
+	}
+	for in, expect := range tests {
+		d, err := parseDuration(in)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %s", in, err)
+		}
+		if d != expect {
+			t.Errorf("Expected %s for %s, got %s", expect, in, d)
+		}
+	}
+	for _, in := range []string{"", "0", "-5", "soon"} {
+		if _, err := parseDuration(in); err == nil {
+			t.Errorf("Expected an error for %q", in)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := map[string]time.Time{
+		"1436464998":                     time.Unix(1436464998, 0),
+		"1436464998.5":                   time.Unix(1436464998, 500000000),
+		"1436464998.123456789":           time.Unix(1436464998, 123456789),
+		"1436464998123":                  time.Unix(1436464998, 123000000),
+		"2015-07-09T18:03:18Z":           time.Unix(1436464998, 0),
+		"2015-07-09T18:03:18.000000001Z": time.Unix(1436464998, 1),
+	}
+	for in, expect := range tests {
+		ts, err := ParseTime(in)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %s", in, err)
+			continue
+		}
+		if !ts.Equal(expect) {
+			t.Errorf("Expected %s for %s, got %s", expect, in, ts)
+		}
+	}
+	for _, in := range []string{"", "yesterday", "1.2.3", "12.x"} {
+		if _, err := ParseTime(in); err == nil {
+			t.Errorf("Expected an error for %q", in)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package pubsub
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/Masterminds/cookoo"
+)
+
+// HeartbeatInterval is how often a heartbeat event is sent on a framed
+// subscription stream. Zero turns heartbeats off.
+var HeartbeatInterval = 30 * time.Second
+
+// Kinds of frame on a framed subscription stream.
+//
+// A subscriber that sends the X-Stream-Events header gets a framed stream.
+// Each frame is a kind byte, the length of the payload as a four byte
+// big-endian integer, and the payload. Frames may be split across HTTP/2
+// DATA frames, or share one.
+const (
+	// FrameMessage carries a message published to the topic.
+	FrameMessage byte = 'M'
+	// FrameEvent carries an Event encoded as JSON.
+	FrameEvent byte = 'E'
+)
+
+// frameHeaderLen is the length of a frame's kind and length.
+const frameHeaderLen = 5
+
+// Types of Event.
+const (
+	// EventSubscribed is sent once the subscription is attached to the
+	// topic. It carries the heartbeat interval.
+	EventSubscribed = "subscribed"
+	// EventHeartbeat is sent every HeartbeatInterval, so that the
+	// subscriber and any proxies can tell the stream is alive.
+	EventHeartbeat = "heartbeat"
+	// EventHistoryComplete is sent after history has been replayed. It
+	// carries the number of history messages sent.
+	EventHistoryComplete = "history-complete"
+	// EventLag warns that the subscriber is falling behind, and may hold
+	// up publishers. It carries the number of messages waiting to be sent.
+	EventLag = "lag"
+)
+
+// Event is a control event on a framed subscription stream.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Count is the number of messages sent, for EventHistoryComplete, or
+	// waiting, for EventLag.
+	Count int `json:"count,omitempty"`
+	// Heartbeat is the heartbeat interval as a duration, such as "30s", for
+	// EventSubscribed. It is empty if heartbeats are off.
+	Heartbeat string `json:"heartbeat,omitempty"`
+}
+
+// WriteFrame writes a single frame to w.
+func WriteFrame(w io.Writer, kind byte, payload []byte) error {
+	// One write keeps small frames in a single DATA frame.
+	buf := make([]byte, frameHeaderLen+len(payload))
+	buf[0] = kind
+	binary.BigEndian.PutUint32(buf[1:frameHeaderLen], uint32(len(payload)))
+	copy(buf[frameHeaderLen:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// WriteEvent writes an event frame to w. If the event has no time, it is
+// set to now.
+func WriteEvent(w io.Writer, e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(w, FrameEvent, data)
+}
+
+// writeMessage sends a message to a subscriber, framed if need be.
+func writeMessage(w ResponseWriterFlusher, msg []byte, framed bool) error {
+	var err error
+	if framed {
+		err = WriteFrame(w, FrameMessage, msg)
+	} else {
+		_, err = w.Write(msg)
+	}
+	w.Flush()
+	return err
+}
+
+// writeEvent sends an event to a subscriber.
+func writeEvent(w ResponseWriterFlusher, e Event) error {
+	err := WriteEvent(w, e)
+	w.Flush()
+	return err
+}
+
+// streamEvents returns true if the subscriber asked for a framed stream. If
+// so, it tells the subscriber that the stream is framed.
+//
+// It must be called before anything is written to the stream.
+func streamEvents(c cookoo.Context) bool {
+	on, err := headerBool(c, XStreamEvents)
+	if err != nil || !on {
+		return false
+	}
+	if res, ok := c.Get("http.ResponseWriter", nil).(ResponseWriterFlusher); ok {
+		res.Header().Set(XStreamEvents, "true")
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/cookoo"
+)
+
+type frame struct {
+	kind    byte
+	payload []byte
+}
+
+// readFrames splits a framed stream into frames.
+func readFrames(t *testing.T, data []byte) []frame {
+	frames := []frame{}
+	for len(data) > 0 {
+		if len(data) < frameHeaderLen {
+			t.Fatalf("Short frame header: %q", data)
+		}
+		n := int(binary.BigEndian.Uint32(data[1:frameHeaderLen]))
+		if len(data) < frameHeaderLen+n {
+			t.Fatalf("Short frame: %q", data)
+		}
+		frames = append(frames, frame{data[0], data[frameHeaderLen : frameHeaderLen+n]})
+		data = data[frameHeaderLen+n:]
+	}
+	return frames
+}
+
+func frameEvent(t *testing.T, f frame) Event {
+	if f.kind != FrameEvent {
+		t.Fatalf("Expected an event, got %c frame %q", f.kind, f.payload)
+	}
+	e := Event{}
+	if err := json.Unmarshal(f.payload, &e); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestWriteFrame(t *testing.T) {
+	var buf bytes.Buffer
+	WriteFrame(&buf, FrameMessage, []byte("hello"))
+	WriteFrame(&buf, FrameMessage, []byte{})
+	WriteEvent(&buf, Event{Type: EventHeartbeat})
+
+	frames := readFrames(t, buf.Bytes())
+	if len(frames) != 3 {
+		t.Fatalf("Expected 3 frames, got %d", len(frames))
+	}
+	if frames[0].kind != FrameMessage || string(frames[0].payload) != "hello" {
+		t.Errorf("Expected message 'hello', got %c %q", frames[0].kind, frames[0].payload)
+	}
+	if len(frames[1].payload) != 0 {
+		t.Errorf("Expected an empty message, got %q", frames[1].payload)
+	}
+	if e := frameEvent(t, frames[2]); e.Type != EventHeartbeat || e.Time.IsZero() {
+		t.Errorf("Expected a heartbeat with a time, got %+v", e)
+	}
+}
+
+func TestReplayHistoryFramed(t *testing.T) {
+	reg, router, cxt := cookoo.Cookoo()
+	medium := NewMedium()
+	cxt.AddDatasource(MediumDS, medium)
+
+	topic := NewHistoriedTopic("test", 5)
+	medium.Add(topic)
+	topic.Publish([]byte("first"))
+	topic.Publish([]byte("second"))
+
+	req, _ := http.NewRequest("GET", "https://localhost/v1/t/test", nil)
+	req.Header.Add(XHistoryLength, "4")
+	req.Header.Add(XStreamEvents, "true")
+	res := &mockResponseWriter{}
+	cxt.Put("http.Request", req)
+	cxt.Put("http.ResponseWriter", res)
+
+	reg.Route("test", "Test route").
+		Does(ReplayHistory, "res").Using("topic").WithDefault("test")
+	if err := router.HandleRequest("test", cxt, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Header().Get(XStreamEvents) != "true" {
+		t.Error("Expected the stream to be marked as framed.")
+	}
+	frames := readFrames(t, res.Buf())
+	if len(frames) != 3 {
+		t.Fatalf("Expected 3 frames, got %d", len(frames))
+	}
+	for i, want := range []string{"first", "second"} {
+		if frames[i].kind != FrameMessage || string(frames[i].payload) != want {
+			t.Errorf("Expected message %q, got %c %q", want, frames[i].kind, frames[i].payload)
+		}
+	}
+	if e := frameEvent(t, frames[2]); e.Type != EventHistoryComplete || e.Count != 2 {
+		t.Errorf("Expected history-complete with 2 messages, got %+v", e)
+	}
+
+	// With no history, the marker is still sent.
+	res = &mockResponseWriter{}
+	cxt.Put("http.ResponseWriter", res)
+	req.Header.Del(XHistoryLength)
+	router.HandleRequest("test", cxt, true)
+	frames = readFrames(t, res.Buf())
+	if len(frames) != 1 {
+		t.Fatalf("Expected 1 frame, got %d", len(frames))
+	}
+	if e := frameEvent(t, frames[0]); e.Type != EventHistoryComplete || e.Count != 0 {
+		t.Errorf("Expected history-complete with no messages, got %+v", e)
+	}
+}
+
+func TestListenEvents(t *testing.T) {
+	res := &mockResponseWriter{}
+	sub := NewSubscription(res)
+	sub.framed = true
+	sub.heartbeat = 10 * time.Millisecond
+
+	// A backlog of more than half the queue should warn of lag once.
+	for i := 0; i < 7; i++ {
+		sub.Queue <- []byte("m")
+	}
+	stop := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		sub.Listen(stop)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	stop <- true
+	<-done
+
+	var messages, lags, beats int
+	for _, f := range readFrames(t, res.Buf()) {
+		if f.kind == FrameMessage {
+			messages++
+			continue
+		}
+		switch e := frameEvent(t, f); e.Type {
+		case EventLag:
+			lags++
+			if e.Count != 6 {
+				t.Errorf("Expected 6 messages waiting, got %d", e.Count)
+			}
+		case EventHeartbeat:
+			beats++
+		}
+	}
+	if messages != 7 {
+		t.Errorf("Expected 7 messages, got %d", messages)
+	}
+	if lags != 1 {
+		t.Errorf("Expected 1 lag event, got %d", lags)
+	}
+	if beats == 0 {
+		t.Error("Expected heartbeats.")
+	}
+
+	// Without framing, only messages are written.
+	res = &mockResponseWriter{}
+	sub = NewSubscription(res)
+	sub.heartbeat = time.Millisecond
+	sub.Queue <- []byte("raw")
+	sub.Close()
+	sub.Listen(make(chan bool))
+	if res.String() != "raw" {
+		t.Errorf("Expected 'raw', got %q", res.String())
+	}
+}
@@ -0,0 +1,373 @@
+package pubsub
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MaxFilterLength is the longest filter expression accepted.
+var MaxFilterLength = 1024
+
+// Metadata is a set of named values that a publisher attaches to a message.
+// Subscribers can filter messages by it. Names are lower case.
+type Metadata map[string]string
+
+// lookup is a fieldLookup for metadata.
+func (m Metadata) lookup(name string) (string, bool, bool) {
+	v, ok := m[name]
+	return v, ok, ok
+}
+
+// fieldLookup finds the value of a field for a filter. present is false if
+// there is no such field, and scalar is false if the field has a value that
+// cannot be compared, such as a JSON object.
+type fieldLookup func(name string) (value string, present, scalar bool)
+
+// metadataFromHeader reads message metadata from headers with the
+// XMetaPrefix prefix. It returns nil if there are none.
+func metadataFromHeader(h http.Header) Metadata {
+	var meta Metadata
+	for name, v := range h {
+		if len(v) == 0 || !strings.HasPrefix(strings.ToLower(name), XMetaPrefix) {
+			continue
+		}
+		field := strings.ToLower(name[len(XMetaPrefix):])
+		if len(field) == 0 {
+			continue
+		}
+		if meta == nil {
+			meta = Metadata{}
+		}
+		meta[field] = v[0]
+	}
+	return meta
+}
+
+// Filter selects messages by their metadata.
+//
+// A filter is an expression such as
+//
+//	region == "eu" && priority > 3
+//
+// A comparison is a metadata field, one of ==, !=, <, <=, >, or >=, and a
+// value. A number value compares numerically, and is false for a field that
+// is not a number. Any other value compares as a string, and may be quoted
+// with double quotes. A field on its own is true if the message has it.
+// Comparisons are always false for a field the message does not have.
+//
+// Expressions are combined with &&, ||, and !, and grouped with parentheses.
+// Field names are not case sensitive.
+//
+// A nil *Filter matches every message.
+type Filter struct {
+	expr string
+	root filterNode
+	// pointers holds the parsed JSON Pointer of each field, if fields are
+	// pointers.
+	pointers map[string][]string
+}
+
+// ParseFilter parses a filter expression.
+func ParseFilter(expr string) (*Filter, error) {
+	return parseFilter(expr, false)
+}
+
+// parseFilter parses a filter expression. If pointers is true, fields are
+// JSON Pointers, such as /user/name, rather than metadata names.
+func parseFilter(expr string, pointers bool) (*Filter, error) {
+	if len(expr) > MaxFilterLength {
+		return nil, fmt.Errorf("Filter is longer than %d bytes.", MaxFilterLength)
+	}
+	p := &filterParser{src: expr, pointers: pointers}
+	if pointers {
+		p.parsed = map[string][]string{}
+	}
+	p.next()
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return &Filter{expr: expr, root: root, pointers: p.parsed}, nil
+}
+
+// Match returns true if a message with the given metadata passes the filter.
+func (f *Filter) Match(meta Metadata) bool {
+	return f.matchFields(meta.lookup)
+}
+
+// matchFields returns true if the fields found by lookup pass the filter.
+func (f *Filter) matchFields(lookup fieldLookup) bool {
+	if f == nil {
+		return true
+	}
+	return f.root.match(lookup)
+}
+
+// String returns the filter expression.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+type filterNode interface {
+	match(fieldLookup) bool
+}
+
+type andNode struct{ l, r filterNode }
+
+func (n andNode) match(f fieldLookup) bool { return n.l.match(f) && n.r.match(f) }
+
+type orNode struct{ l, r filterNode }
+
+func (n orNode) match(f fieldLookup) bool { return n.l.match(f) || n.r.match(f) }
+
+type notNode struct{ n filterNode }
+
+func (n notNode) match(f fieldLookup) bool { return !n.n.match(f) }
+
+// hasNode is a field on its own.
+type hasNode struct{ field string }
+
+func (n hasNode) match(f fieldLookup) bool {
+	_, ok, _ := f(n.field)
+	return ok
+}
+
+// cmpNode compares a field to a value.
+type cmpNode struct {
+	field string
+	op    string
+	str   string
+	num   float64
+	isNum bool
+}
+
+func (n cmpNode) match(lookup fieldLookup) bool {
+	v, _, scalar := lookup(n.field)
+	if !scalar {
+		return false
+	}
+	c := strings.Compare(v, n.str)
+	if n.isNum {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return false
+		}
+		switch {
+		case f < n.num:
+			c = -1
+		case f > n.num:
+			c = 1
+		default:
+			c = 0
+		}
+	}
+	switch n.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokWord
+	tokString
+	tokOp
+	tokError
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of filter"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// filterParser is a recursive descent parser for filter expressions.
+type filterParser struct {
+	src      string
+	pos      int
+	tok      token
+	pointers bool
+	parsed   map[string][]string
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid filter at %d: %s.", p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+// next reads the next token into p.tok.
+func (p *filterParser) next() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos == len(p.src) {
+		p.tok = token{kind: tokEOF, pos: start}
+		return
+	}
+
+	c := p.src[p.pos]
+	switch {
+	case c == '"':
+		s, err := strconv.QuotedPrefix(p.src[p.pos:])
+		if err != nil {
+			p.tok = token{kind: tokError, text: p.src[p.pos:], pos: start}
+			p.pos = len(p.src)
+			return
+		}
+		p.pos += len(s)
+		text, _ := strconv.Unquote(s)
+		p.tok = token{kind: tokString, text: text, pos: start}
+	case isWordByte(c):
+		for p.pos < len(p.src) && isWordByte(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = token{kind: tokWord, text: p.src[start:p.pos], pos: start}
+	default:
+		for _, op := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"} {
+			if strings.HasPrefix(p.src[p.pos:], op) {
+				p.pos += len(op)
+				p.tok = token{kind: tokOp, text: op, pos: start}
+				return
+			}
+		}
+		p.tok = token{kind: tokError, text: string(c), pos: start}
+		p.pos++
+	}
+}
+
+// field reads the field name in the current token.
+func (p *filterParser) field() (string, error) {
+	name := p.tok.text
+	if !p.pointers {
+		if strings.ContainsAny(name, "/~") {
+			return "", p.errorf("%s is not a metadata field", p.tok)
+		}
+		return strings.ToLower(name), nil
+	}
+	ptr, err := parsePointer(name)
+	if err != nil {
+		return "", p.errorf("%s", err)
+	}
+	p.parsed[name] = ptr
+	return name, nil
+}
+
+// isWordByte returns true for the bytes of field names and bare values.
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '-' || c == '.' || c == '/' || c == '~'
+}
+
+func (p *filterParser) isOp(op string) bool {
+	return p.tok.kind == tokOp && p.tok.text == op
+}
+
+// or parses a || b || ...
+func (p *filterParser) or() (filterNode, error) {
+	n, err := p.and()
+	for err == nil && p.isOp("||") {
+		p.next()
+		var r filterNode
+		r, err = p.and()
+		n = orNode{n, r}
+	}
+	return n, err
+}
+
+// and parses a && b && ...
+func (p *filterParser) and() (filterNode, error) {
+	n, err := p.unary()
+	for err == nil && p.isOp("&&") {
+		p.next()
+		var r filterNode
+		r, err = p.unary()
+		n = andNode{n, r}
+	}
+	return n, err
+}
+
+// unary parses !a, (a), and comparisons.
+func (p *filterParser) unary() (filterNode, error) {
+	switch {
+	case p.isOp("!"):
+		p.next()
+		n, err := p.unary()
+		return notNode{n}, err
+	case p.isOp("("):
+		p.next()
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOp(")") {
+			return nil, p.errorf("expected ) but found %s", p.tok)
+		}
+		p.next()
+		return n, nil
+	case p.tok.kind != tokWord:
+		return nil, p.errorf("expected a field but found %s", p.tok)
+	}
+
+	field, err := p.field()
+	if err != nil {
+		return nil, err
+	}
+	p.next()
+	if p.tok.kind != tokOp {
+		return hasNode{field}, nil
+	}
+	op := p.tok.text
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return hasNode{field}, nil
+	}
+	p.next()
+
+	n := cmpNode{field: field, op: op, str: p.tok.text}
+	switch p.tok.kind {
+	case tokString:
+	case tokWord:
+		// Only a word that starts like a number is one, so that words
+		// such as inf stay strings.
+		c := p.tok.text[0]
+		if f, err := strconv.ParseFloat(p.tok.text, 64); err == nil && (c == '-' || c == '.' || c >= '0' && c <= '9') {
+			n.num, n.isNum = f, true
+		}
+	default:
+		return nil, p.errorf("expected a value after %s but found %s", op, p.tok)
+	}
+	p.next()
+	return n, nil
+}
@@ -0,0 +1,78 @@
+package pubsub
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	meta := Metadata{"region": "eu", "priority": "5", "name": "beta"}
+	tests := map[string]bool{
+		`region == "eu"`:                           true,
+		`region == eu`:                             true,
+		`Region == "eu"`:                           true,
+		`region != "eu"`:                           false,
+		`priority > 3`:                             true,
+		`priority > 10`:                            false,
+		`priority >= 5 && priority <= 5`:           true,
+		`priority == 5.0`:                          true,
+		`priority > -1`:                            true,
+		`name > "alpha"`:                           true,
+		`name < "alpha"`:                           false,
+		`region == "us" || priority > 3`:           true,
+		`!(region == "us")`:                        true,
+		`region == "eu" && (priority > 9 || name)`: true,
+		`missing`:                                  false,
+		`!missing`:                                 true,
+		`missing != "x"`:                           false,
+		`region > 3`:                               false,
+		`name == inf`:                              false,
+	}
+	for expr, expect := range tests {
+		f, err := ParseFilter(expr)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s", expr, err)
+			continue
+		}
+		if got := f.Match(meta); got != expect {
+			t.Errorf("Expected %q to be %t, got %t", expr, expect, got)
+		}
+	}
+
+	var none *Filter
+	if !none.Match(nil) {
+		t.Error("Expected a nil filter to match everything.")
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`region ==`,
+		`region == "eu`,
+		`(region`,
+		`region == eu eu`,
+		`&& region`,
+		`region ~ eu`,
+		strings.Repeat("a", MaxFilterLength+1),
+	} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("Expected an error for %q", expr)
+		}
+	}
+}
+
+func TestMetadataFromHeader(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Meta-Region", "eu")
+	h.Set("X-Meta-", "ignored")
+	h.Set("Content-Type", "text/plain")
+	meta := metadataFromHeader(h)
+	if len(meta) != 1 || meta["region"] != "eu" {
+		t.Errorf("Expected only region=eu, got %v", meta)
+	}
+	if meta := metadataFromHeader(http.Header{}); meta != nil {
+		t.Errorf("Expected no metadata, got %v", meta)
+	}
+}
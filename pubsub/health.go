@@ -0,0 +1,125 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Masterminds/cookoo"
+)
+
+// HealthChecker is implemented by anything that can report on its own health.
+//
+// A HistoryStore that implements HealthChecker is checked automatically.
+// Other components, such as cluster or replication support, can be added
+// to a Medium with AddHealthCheck.
+type HealthChecker interface {
+	// Check returns an error if the component is unhealthy.
+	Check() error
+}
+
+// HealthCheckFunc adapts a function to a HealthChecker.
+type HealthCheckFunc func() error
+
+// Check calls f().
+func (f HealthCheckFunc) Check() error {
+	return f()
+}
+
+const (
+	statusOK       = "ok"
+	statusFail     = "fail"
+	statusDisabled = "disabled"
+)
+
+// HealthReport is the JSON document returned by the Health command.
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// CheckResult describes the outcome of a single health check.
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// AddHealthCheck registers a named health check with the Medium.
+//
+// Registered checks are run by the Health command when readiness is
+// requested.
+func (m *Medium) AddHealthCheck(name string, hc HealthChecker) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if m.checks == nil {
+		m.checks = map[string]HealthChecker{}
+	}
+	m.checks[name] = hc
+}
+
+// Health reports on the health of the server as JSON.
+//
+// For a liveness check, only the Medium is checked. For a readiness check,
+// the Medium must also not be shutting down, the HistoryStore (if it
+// implements HealthChecker) must be writable, and every check added with
+// AddHealthCheck must pass. An HTTP 200 is sent if all checks pass, and a
+// 503 otherwise.
+//
+// Params:
+// 	- ready (bool): Run readiness checks instead of liveness checks. Default
+// 		is false.
+//
+// Returns:
+// 	- *HealthReport
+func Health(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	ready := p.Get("ready", false).(bool)
+	res := c.Get("http.ResponseWriter", nil).(http.ResponseWriter)
+
+	report := &HealthReport{Status: statusOK, Checks: map[string]CheckResult{}}
+
+	medium, err := getMedium(c)
+	if err == nil && ready && medium.Closing() {
+		err = errors.New("Medium is shutting down.")
+	}
+	report.add("medium", err)
+
+	if medium != nil && ready {
+		medium.mx.RLock()
+		store := medium.store
+		checks := make(map[string]HealthChecker, len(medium.checks))
+		for name, hc := range medium.checks {
+			checks[name] = hc
+		}
+		medium.mx.RUnlock()
+
+		if hc, ok := store.(HealthChecker); ok {
+			report.add("historyStore", hc.Check())
+		} else if store == nil {
+			report.Checks["historyStore"] = CheckResult{Status: statusDisabled}
+		}
+		for name, hc := range checks {
+			report.add(name, hc.Check())
+		}
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	res.Header().Set("Content-Type", "application/json")
+	if report.Status != statusOK {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+	res.Write(data)
+	return report, nil
+}
+
+// add records the result of a check, failing the report if err is not nil.
+func (r *HealthReport) add(name string, err error) {
+	if err != nil {
+		r.Status = statusFail
+		r.Checks[name] = CheckResult{Status: statusFail, Error: err.Error()}
+		return
+	}
+	r.Checks[name] = CheckResult{Status: statusOK}
+}
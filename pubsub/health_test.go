@@ -0,0 +1,63 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/Masterminds/cookoo"
+)
+
+func TestHealth(t *testing.T) {
+	reg, router, cxt := cookoo.Cookoo()
+
+	medium := NewMedium()
+	cxt.AddDatasource(MediumDS, medium)
+
+	reg.Route("live", "Liveness").
+		Does(Health, "res")
+	reg.Route("ready", "Readiness").
+		Does(Health, "res").Using("ready").WithDefault(true)
+
+	check := func(route string, code int, status string) *HealthReport {
+		res := &mockResponseWriter{}
+		cxt.Put("http.ResponseWriter", res)
+		if err := router.HandleRequest(route, cxt, true); err != nil {
+			t.Fatal(err)
+		}
+		if res.code != code {
+			t.Errorf("%s: expected HTTP %d, got %d", route, code, res.code)
+		}
+		report := &HealthReport{}
+		if err := json.Unmarshal(res.Buf(), report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Status != status {
+			t.Errorf("%s: expected status %s, got %s", route, status, report.Status)
+		}
+		return report
+	}
+
+	r := check("ready", 0, statusOK)
+	if r.Checks["historyStore"].Status != statusDisabled {
+		t.Errorf("Expected disabled history store, got %v", r.Checks["historyStore"])
+	}
+
+	medium.AddHealthCheck("cluster", HealthCheckFunc(func() error {
+		return errors.New("no quorum")
+	}))
+	r = check("ready", 503, statusFail)
+	if r.Checks["cluster"].Error != "no quorum" {
+		t.Errorf("Expected cluster error, got %v", r.Checks["cluster"])
+	}
+
+	// Liveness does not depend on the cluster.
+	check("live", 0, statusOK)
+
+	medium.AddHealthCheck("cluster", HealthCheckFunc(func() error { return nil }))
+	medium.Shutdown()
+	r = check("ready", 503, statusFail)
+	if r.Checks["medium"].Status != statusFail {
+		t.Errorf("Expected medium to fail readiness during shutdown, got %v", r.Checks["medium"])
+	}
+}
@@ -1,59 +1,248 @@
 package pubsub
 
 import (
-	"container/list"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var DefaultMaxHistory = 1000
 
+// DefaultMaxHistoryAge is how long new topics keep messages in history.
+//
+// Zero keeps messages until newer ones push them out of the history.
+var DefaultMaxHistoryAge time.Duration
+
+// DefaultMaxHistoryBytes is the most bytes of messages new topics keep in
+// history. Zero means no limit.
+var DefaultMaxHistoryBytes int64
+
+// HistoryStore is a durable backend for topic history.
+//
+// When a HistoryStore is attached to a Medium, it is given the history of
+// each HistoriedTopic when the Medium shuts down.
+type HistoryStore interface {
+	// Store saves the history of the named topic.
+	Store(name string, h History) error
+}
+
 // historyTopic maintains the history for a channel.
+//
+// The history is kept in a ring. Writers hold mx, but readers do not need
+// it: Since, Last, Range, and oldest read the ring without locking, so
+// subscribers replaying history never hold up publishers.
 type historyTopic struct {
+	// maxAge is a time.Duration, but is accessed atomically so that readers
+	// can check for expired messages without locking. It is first to keep
+	// it aligned.
+	maxAge int64
 	Topic
-	buffer *list.List
-	max    int
-	mx     sync.Mutex
+	// buf holds the current *ring. When the ring fills up with holes, or
+	// needs to grow, it is replaced by a new one.
+	buf      atomic.Value
+	max      int
+	maxBytes int64
+	bytes    int64
+	// live is the number of entries in the ring, not counting holes.
+	live   int
+	budget *Budget
+	// stale is set when a message is added to an empty history, which the
+	// budget has queued last.
+	stale   int32
+	compact bool
+	// closed is set by Close. Nothing is added to a closed history, since
+	// it no longer counts against the budget.
+	closed bool
+	// seq is the sequence number of the last message added.
+	seq uint64
+	// keys indexes the position of the latest keyed message in a compacted
+	// history.
+	keys map[string]uint64
+	mx   sync.Mutex
+	// pub is held while a message is added to history and sent to
+	// subscribers, so that SubscribeWithHistory sees each message in
+	// exactly one of the two.
+	pub sync.Mutex
+	// retainedMeta is the metadata of the retained message. It is guarded
+	// by pub.
+	retainedMeta Metadata
 }
 
 type entry struct {
 	msg []byte
 	ts  time.Time
+	seq uint64
+	// expires is when the message's TTL runs out. Zero means no TTL.
+	expires time.Time
+	key     string
+	meta    Metadata
+	// pos is the entry's position in its ring.
+	pos uint64
+}
+
+// Record is a message in history, along with its metadata.
+type Record struct {
+	// Seq is the position of the message in its topic. Sequence numbers
+	// increase by one with every message published to the topic.
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Key     string    `json:"key,omitempty"`
+	Message []byte    `json:"message"`
+	// Expires is when the message's TTL runs out, if it has one.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Meta is the metadata the message was published with.
+	Meta Metadata `json:"meta,omitempty"`
+}
+
+// HistoryQuery selects a range of history.
+//
+// Each bound is inclusive, and is ignored if it is zero.
+type HistoryQuery struct {
+	FromSeq uint64
+	ToSeq   uint64
+	From    time.Time
+	To      time.Time
+	// Limit is the most records to return. Zero means no limit.
+	Limit int
+}
+
+// match returns true if the entry is within the query's bounds.
+func (q HistoryQuery) match(e *entry) bool {
+	switch {
+	case q.FromSeq > 0 && e.seq < q.FromSeq:
+		return false
+	case q.ToSeq > 0 && e.seq > q.ToSeq:
+		return false
+	case !q.From.IsZero() && e.ts.Before(q.From):
+		return false
+	case !q.To.IsZero() && e.ts.After(q.To):
+		return false
+	}
+	return true
+}
+
+// past returns true if the entry is newer than the query's upper bounds.
+func (q HistoryQuery) past(e *entry) bool {
+	return (q.ToSeq > 0 && e.seq > q.ToSeq) || (!q.To.IsZero() && e.ts.After(q.To))
 }
 
 // TrackHistory takes an existing topic and adds history tracking.
 //
-// The mechanism for history tracking is a doubly linked list no longer than
-// maxLen.
+// The mechanism for history tracking is a ring buffer holding no more than
+// maxLen messages. Messages are also dropped once they are older than
+// DefaultMaxHistoryAge, or once the history holds more than
+// DefaultMaxHistoryBytes, if those are set. The history counts against
+// HistoryBudget.
 func TrackHistory(t Topic, maxLen int) HistoriedTopic {
-	return &historyTopic{
-		Topic:  t,
-		buffer: list.New(),
-		max:    maxLen,
+	h := &historyTopic{
+		Topic:    t,
+		max:      maxLen,
+		maxAge:   int64(DefaultMaxHistoryAge),
+		maxBytes: DefaultMaxHistoryBytes,
+		budget:   HistoryBudget,
 	}
+	// The ring is allocated by the first publish.
+	h.buf.Store(newRing(0))
+	h.budget.register(h)
+	return h
+}
+
+// ring returns the ring that currently holds the history.
+func (h *historyTopic) ring() *ring {
+	return h.buf.Load().(*ring)
+}
+
+// SetMaxBytes sets the most bytes of messages kept in history. Zero means
+// no limit.
+func (h *historyTopic) SetMaxBytes(n int64) {
+	h.mx.Lock()
+	h.maxBytes = n
+	h.trim()
+	h.mx.Unlock()
 }
 
-// Since fetches an array of history entries.
+// SetMaxAge sets how long messages are kept in history. Zero keeps them
+// until newer messages push them out.
+func (h *historyTopic) SetMaxAge(d time.Duration) {
+	atomic.StoreInt64(&h.maxAge, int64(d))
+}
+
+// SetCompact turns key-based compaction on or off.
+//
+// A compacted history keeps only the latest message for each key, so that
+// replaying it gives a snapshot of current state. Messages without a key
+// are kept as usual. Turning compaction on compacts the existing history.
+func (h *historyTopic) SetCompact(on bool) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	h.compact = on
+	h.keys = nil
+	if !on {
+		return
+	}
+	h.keys = map[string]uint64{}
+	// Walk newest to oldest, so the first message seen for a key wins. A
+	// tombstone wins too, but is then dropped.
+	seen := map[string]bool{}
+	r := h.ring()
+	head, tail := r.bounds()
+	for p := tail; p > head; p-- {
+		e := r.at(p - 1)
+		if e == nil || len(e.key) == 0 {
+			continue
+		}
+		if seen[e.key] || len(e.msg) == 0 {
+			h.remove(e)
+			compactedTotal.Inc(h.Name())
+		} else {
+			h.keys[e.key] = e.pos
+		}
+		seen[e.key] = true
+	}
+	h.updateGauges()
+}
+
+// Compacted returns true if the history is compacted.
+func (h *historyTopic) Compacted() bool {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	return h.compact
+}
+
+// expired returns true if an entry has outlived its TTL or the topic's
+// maximum age.
+func (h *historyTopic) expired(e *entry, now time.Time) bool {
+	if !e.expires.IsZero() && !now.Before(e.expires) {
+		return true
+	}
+	maxAge := time.Duration(atomic.LoadInt64(&h.maxAge))
+	return maxAge > 0 && now.Sub(e.ts) > maxAge
+}
+
+// Since fetches an array of history entries newer than t.
 //
 // The entries will be in order, oldest to newest. And the list will not
-// exceed the maximum number of histry items.
+// exceed the maximum number of histry items. The first entry is found by
+// binary search, so this is cheap even for long histories.
 //
-// If the history list grows beyond its max size, the history list is pruned,
-// oldest to youngest.
+// Expired messages are never returned.
 func (h *historyTopic) Since(t time.Time) [][]byte {
+	return h.since(t, nil)
+}
 
+// since is Since for the messages that match f.
+func (h *historyTopic) since(t time.Time, f *Filter) [][]byte {
 	accumulator := [][]byte{}
+	now := time.Now()
 
-	for v := h.buffer.Front(); v != nil; v = v.Next() {
-		e, ok := v.Value.(*entry)
-		if !ok {
-			// Skip anything that's not an entry.
-			continue
-		}
-		if e.ts.After(t) {
+	r := h.ring()
+	head, tail := r.bounds()
+	after := func(e *entry) bool { return e.ts.After(t) }
+	for p := r.search(head, tail, after); p < tail; p++ {
+		if e := r.at(p); e != nil && !h.expired(e, now) && f.Match(e.meta) {
 			accumulator = append(accumulator, e.msg)
-		} else {
-			return accumulator
 		}
 	}
 	return accumulator
@@ -62,51 +251,403 @@ func (h *historyTopic) Since(t time.Time) [][]byte {
 // Last fetches the last n items from the history, regardless of their time.
 //
 // Of course, it will return fewer than n if n is larger than the max length
-// or if the total stored history is less than n.
+// or if the total stored history is less than n. Expired messages are never
+// returned.
 func (h *historyTopic) Last(n int) [][]byte {
+	return h.last(n, nil)
+}
+
+// last is Last for the messages that match f.
+func (h *historyTopic) last(n int, f *Filter) [][]byte {
 	acc := make([][]byte, 0, n)
-	i := 0
-	for v := h.buffer.Front(); v != nil; v = v.Next() {
-		e, ok := v.Value.(*entry)
-		if !ok {
-			// Skip anything that's not an entry.
-			continue
-		}
-		if i < n {
+	now := time.Now()
+
+	r := h.ring()
+	head, tail := r.bounds()
+	for p := head; p < tail && len(acc) < n; p++ {
+		if e := r.at(p); e != nil && !h.expired(e, now) && f.Match(e.meta) {
 			acc = append(acc, e.msg)
-		} else {
-			return acc
 		}
-		i++
 	}
 	return acc
 }
 
-func (h *historyTopic) add(msg []byte) {
+// Range returns the records in history that match a query, oldest first.
+//
+// If more records match than the query's limit allows, more is true, and
+// the query can be repeated from the sequence number after the last record
+// returned. Expired messages are never returned.
+func (h *historyTopic) Range(q HistoryQuery) (records []Record, more bool) {
+	records = []Record{}
+	now := time.Now()
+
+	r := h.ring()
+	head, tail := r.bounds()
+	if q.FromSeq > 0 {
+		head = r.search(head, tail, func(e *entry) bool { return e.seq >= q.FromSeq })
+	}
+	if !q.From.IsZero() {
+		head = r.search(head, tail, func(e *entry) bool { return !e.ts.Before(q.From) })
+	}
+	for p := head; p < tail; p++ {
+		e := r.at(p)
+		if e == nil || h.expired(e, now) {
+			continue
+		}
+		if q.past(e) {
+			// Everything after this entry is newer still.
+			break
+		}
+		if !q.match(e) {
+			continue
+		}
+		if q.Limit > 0 && len(records) == q.Limit {
+			return records, true
+		}
+		records = append(records, e.record())
+	}
+	return records, false
+}
+
+// record describes an entry as a Record.
+func (e *entry) record() Record {
+	r := Record{Seq: e.seq, Time: e.ts.UTC(), Key: e.key, Message: e.msg, Meta: e.meta}
+	if !e.expires.IsZero() {
+		exp := e.expires
+		r.Expires = &exp
+	}
+	return r
+}
+
+// Import adds a record to the end of the history, keeping its timestamp
+// and metadata.
+//
+// Records must be imported oldest first, and cannot be older than the
+// newest message already in the history. A record keeps its sequence
+// number unless the topic has already used it, in which case it is given
+// the next one. Records that have already expired are skipped.
+func (h *historyTopic) Import(r Record) error {
+	h.mx.Lock()
+	if h.closed {
+		h.mx.Unlock()
+		return fmt.Errorf("Cannot import into %s, which has been closed.", h.Name())
+	}
+	if back := h.ring().back(); back != nil && r.Time.Before(back.ts) {
+		h.mx.Unlock()
+		return fmt.Errorf("Cannot import a message from %s into %s, which has newer history.", r.Time.Format(time.RFC3339Nano), h.Name())
+	}
+	seq := r.Seq
+	if seq <= h.seq {
+		seq = h.seq + 1
+	}
+	e := &entry{msg: r.Message, ts: r.Time, seq: seq, key: r.Key, meta: r.Meta}
+	if r.Expires != nil {
+		e.expires = *r.Expires
+	}
+	if !h.expired(e, time.Now()) {
+		h.seq = seq
+		h.push(e)
+	}
+	h.mx.Unlock()
+	h.budget.enforce(h)
+	return nil
+}
+
+// add adds a message to history. It returns false if the history has been
+// closed.
+func (h *historyTopic) add(msg []byte, opts PublishOptions) bool {
 	h.mx.Lock()
 	defer h.mx.Unlock()
+	if h.closed {
+		return false
+	}
+	now := time.Now()
+	h.seq++
 	e := &entry{
-		msg: msg,
-		ts:  time.Now(),
+		msg:  msg,
+		ts:   now,
+		seq:  h.seq,
+		key:  opts.Key,
+		meta: opts.Meta,
 	}
+	if opts.TTL > 0 {
+		e.expires = now.Add(opts.TTL)
+	}
+	h.push(e)
+	return true
+}
+
+// push appends an entry to the history, and then applies compaction and
+// the history's limits.
+//
+// The caller must hold the lock.
+func (h *historyTopic) push(e *entry) {
+	if h.max < 1 {
+		return
+	}
+	now := time.Now()
+	if h.compact && len(e.key) > 0 {
+		if old, ok := h.keys[e.key]; ok {
+			h.remove(h.ring().at(old))
+			compactedTotal.Inc(h.Name())
+		}
+		// A tombstone only deletes the key.
+		if len(e.msg) == 0 {
+			h.updateGauges()
+			return
+		}
+	}
+
+	for h.live >= h.max {
+		h.remove(h.ring().front())
+	}
+	r := h.ring()
+	if r.full() {
+		r = h.resize()
+	}
+	r.push(e)
+	if h.live == 0 {
+		atomic.StoreInt32(&h.stale, 1)
+	}
+	h.live++
+	h.bytes += int64(len(e.msg))
+	h.budget.grow(int64(len(e.msg)))
+	if h.compact && len(e.key) > 0 {
+		h.keys[e.key] = e.pos
+	}
+
+	// Aged-out messages are always at the front, so they are cheap to drop
+	// here. Messages with a TTL can be anywhere, and are left to Expire.
+	n := 0
+	for v := r.front(); v != nil && h.expired(v, now); v = r.front() {
+		h.remove(v)
+		n++
+	}
+	h.expireCount(n)
+	h.trim()
+}
+
+// resize moves the history to a new ring, leaving the holes behind.
+//
+// The new ring has room for as many entries again as the history holds,
+// but never more than twice the maximum length, so that resizing is rare.
+// Readers still using the old ring are unaffected.
+//
+// The caller must hold the lock, and the history must be shorter than its
+// maximum length.
+func (h *historyTopic) resize() *ring {
+	size := 2 * h.live
+	if size < minRing {
+		size = minRing
+	}
+	if size > 2*h.max {
+		size = 2 * h.max
+	}
+
+	old, r := h.ring(), newRing(size)
+	head, tail := old.bounds()
+	for p := head; p < tail; p++ {
+		e := old.at(p)
+		if e == nil {
+			continue
+		}
+		// The entry may be in use by readers, so it is copied rather than
+		// given a new position.
+		c := *e
+		r.push(&c)
+		if h.keys != nil && len(c.key) > 0 && h.keys[c.key] == p {
+			h.keys[c.key] = c.pos
+		}
+	}
+	h.buf.Store(r)
+	return r
+}
+
+// trim drops the oldest messages until the history fits in maxBytes.
+//
+// The caller must hold the lock.
+func (h *historyTopic) trim() {
+	for h.maxBytes > 0 && h.bytes > h.maxBytes && h.live > 0 {
+		h.remove(h.ring().front())
+		evictedTotal.Inc(h.Name())
+	}
+	h.updateGauges()
+}
+
+// remove removes a single message from the history.
+//
+// The caller must hold the lock.
+func (h *historyTopic) remove(e *entry) {
+	if e == nil {
+		return
+	}
+	h.ring().clear(e.pos)
+	h.live--
+	h.bytes -= int64(len(e.msg))
+	h.budget.grow(-int64(len(e.msg)))
+	if len(e.key) > 0 {
+		if p, ok := h.keys[e.key]; ok && p == e.pos {
+			delete(h.keys, e.key)
+		}
+	}
+}
+
+// updateGauges reports the size of the history.
+//
+// The caller must hold the lock.
+func (h *historyTopic) updateGauges() {
+	historyGauge.Set(float64(h.live), h.Name())
+	historyBytes.Set(float64(h.bytes), h.Name())
+}
+
+// oldest returns the time of the oldest message in the history.
+func (h *historyTopic) oldest() (time.Time, bool) {
+	e := h.ring().front()
+	if e == nil {
+		return time.Time{}, false
+	}
+	return e.ts, true
+}
+
+// evictOldest removes the oldest message to free memory for the budget.
+//
+// It returns false if there was nothing to remove.
+func (h *historyTopic) evictOldest() bool {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	e := h.ring().front()
+	if e == nil {
+		return false
+	}
+	h.remove(e)
+	evictedTotal.Inc(h.Name())
+	h.updateGauges()
+	return true
+}
 
-	h.buffer.PushBack(e)
+// Expire removes every expired message from the history.
+//
+// Expired messages are already hidden from Since and Last. This reclaims
+// their memory. It returns the number of messages removed.
+func (h *historyTopic) Expire() int {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	now := time.Now()
+	n := 0
+	r := h.ring()
+	head, tail := r.bounds()
+	for p := head; p < tail; p++ {
+		if e := r.at(p); e != nil && h.expired(e, now) {
+			h.remove(e)
+			n++
+		}
+	}
+	h.expireCount(n)
+	if n > 0 {
+		h.updateGauges()
+	}
+	return n
+}
 
-	for h.buffer.Len() > h.max {
-		h.buffer.Remove(h.buffer.Front())
+// expireCount records that n messages expired.
+func (h *historyTopic) expireCount(n int) {
+	if n > 0 {
+		expiredTotal.Add(float64(n), h.Name())
 	}
 }
 
 // Publish stores this msg as history and then forwards the publish request to the Topic.
 func (h *historyTopic) Publish(msg []byte) error {
-	h.add(msg)
-	h.Topic.Publish(msg)
-	return nil
+	return h.PublishWith(msg, PublishOptions{})
+}
+
+// PublishWith stores this msg as history according to opts, and then
+// forwards the publish request to the Topic.
+//
+// The options only apply to history. Current subscribers receive the
+// message immediately regardless.
+func (h *historyTopic) PublishWith(msg []byte, opts PublishOptions) error {
+	err := h.publish(msg, opts)
+	// This must happen after the locks are released, since the budget may
+	// need to lock other topics.
+	h.budget.enforce(h)
+	return err
+}
+
+// publish adds a message to history and sends it to subscribers as one
+// step.
+func (h *historyTopic) publish(msg []byte, opts PublishOptions) error {
+	h.pub.Lock()
+	defer h.pub.Unlock()
+	if opts.Retain {
+		h.retainedMeta = opts.Meta
+		if len(msg) == 0 {
+			// This only clears the retained message.
+			h.retainedMeta = nil
+			return h.Topic.PublishWith(msg, opts)
+		}
+	}
+	if !h.add(msg, opts) {
+		return errors.New("Topic is being deleted.")
+	}
+	return h.Topic.PublishWith(msg, opts)
+}
+
+// SubscribeWithHistory attaches a subscription, and returns the retained
+// message and the history selected by query.
+//
+// This is atomic with respect to publishing: every message is either in
+// the returned history or sent to the subscription, never both and never
+// neither. The retained message is returned rather than queued, so that
+// it can be sent before the history. Both are filtered by the
+// subscription's filter.
+func (h *historyTopic) SubscribeWithHistory(s *Subscription, query func(History) [][]byte) ([]byte, [][]byte) {
+	h.pub.Lock()
+	defer h.pub.Unlock()
+	retained, _ := h.Retained()
+	if !s.filter.Match(h.retainedMeta) {
+		retained = nil
+	}
+	var hist [][]byte
+	if query != nil {
+		hist = query(filteredHistory{h, s.filter})
+	}
+	s.skipRetained = true
+	h.Topic.Subscribe(s)
+	return retained, hist
+}
+
+// filteredHistory is a view of a history with only the messages that match
+// a filter.
+type filteredHistory struct {
+	h *historyTopic
+	f *Filter
+}
+
+func (v filteredHistory) Since(t time.Time) [][]byte { return v.h.since(t, v.f) }
+func (v filteredHistory) Last(n int) [][]byte        { return v.h.last(n, v.f) }
+
+// PublishRetained stores this msg as history and then retains and
+// publishes it.
+func (h *historyTopic) PublishRetained(msg []byte) error {
+	return h.PublishWith(msg, PublishOptions{Retain: true})
 }
 
 func (h *historyTopic) Close() error {
 	err := h.Topic.Close()
-	// We don't want nil pointers during shutdown.
-	h.buffer = list.New()
+	h.budget.unregister(h)
+	// Readers may still hold the old ring, so it is replaced, not cleared.
+	h.mx.Lock()
+	h.closed = true
+	h.buf.Store(newRing(0))
+	if h.keys != nil {
+		h.keys = map[string]uint64{}
+	}
+	h.budget.grow(-h.bytes)
+	h.bytes = 0
+	h.live = 0
+	h.mx.Unlock()
+	historyGauge.Delete(h.Name())
+	historyBytes.Delete(h.Name())
 	return err
 }
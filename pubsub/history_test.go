@@ -51,3 +51,154 @@ func TestHistorySince(t *testing.T) {
 	}
 
 }
+
+func TestHistoryTTL(t *testing.T) {
+	topic := NewHistoriedTopic("test", 5)
+
+	topic.Publish([]byte("a"))
+	topic.PublishWith([]byte("b"), PublishOptions{TTL: 20 * time.Millisecond})
+	topic.Publish([]byte("c"))
+
+	if str := string(bytes.Join(topic.Last(5), []byte(""))); str != "abc" {
+		t.Errorf("Expected abc, got %s", str)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if str := string(bytes.Join(topic.Last(5), []byte(""))); str != "ac" {
+		t.Errorf("Expected ac, got %s", str)
+	}
+	if str := string(bytes.Join(topic.Since(time.Now().Add(-time.Minute)), []byte(""))); str != "ac" {
+		t.Errorf("Expected ac, got %s", str)
+	}
+	if n := topic.Expire(); n != 1 {
+		t.Errorf("Expected 1 message to expire, got %d", n)
+	}
+	if n := topic.Expire(); n != 0 {
+		t.Errorf("Expected nothing left to expire, got %d", n)
+	}
+}
+
+func TestHistoryMaxAge(t *testing.T) {
+	topic := NewHistoriedTopic("test", 5)
+	topic.SetMaxAge(20 * time.Millisecond)
+
+	topic.Publish([]byte("a"))
+	topic.Publish([]byte("b"))
+	time.Sleep(30 * time.Millisecond)
+
+	if l := topic.Last(5); len(l) != 0 {
+		t.Errorf("Expected no history, got %d messages", len(l))
+	}
+
+	// Publishing drops aged-out messages from the front of the history.
+	topic.Publish([]byte("c"))
+	if str := string(bytes.Join(topic.Last(5), []byte(""))); str != "c" {
+		t.Errorf("Expected c, got %s", str)
+	}
+	if n := topic.Expire(); n != 0 {
+		t.Errorf("Expected nothing left to expire, got %d", n)
+	}
+
+	m := NewMedium()
+	m.Add(topic)
+	time.Sleep(30 * time.Millisecond)
+	if n := m.ExpireHistory(); n != 1 {
+		t.Errorf("Expected 1 message to expire, got %d", n)
+	}
+}
+
+func TestHistoryMaxBytes(t *testing.T) {
+	topic := NewHistoriedTopic("test", 5)
+	topic.SetMaxBytes(4)
+
+	for _, s := range []string{"aa", "bb", "c"} {
+		topic.Publish([]byte(s))
+	}
+	if str := string(bytes.Join(topic.Last(5), []byte(""))); str != "bbc" {
+		t.Errorf("Expected bbc, got %s", str)
+	}
+
+	// A message larger than the limit cannot be kept at all.
+	topic.Publish([]byte("toolong"))
+	if l := topic.Last(5); len(l) != 0 {
+		t.Errorf("Expected no history, got %d messages", len(l))
+	}
+}
+
+func TestHistoryCompact(t *testing.T) {
+	topic := NewHistoriedTopic("test", 10)
+
+	topic.PublishWith([]byte("a1"), PublishOptions{Key: "a"})
+	topic.PublishWith([]byte("b1"), PublishOptions{Key: "b"})
+	topic.PublishWith([]byte("a2"), PublishOptions{Key: "a"})
+	topic.PublishWith([]byte(""), PublishOptions{Key: "b"})
+
+	// Turning on compaction compacts what is already there.
+	topic.SetCompact(true)
+	if !topic.Compacted() {
+		t.Error("Expected the topic to be compacted.")
+	}
+	if str := string(bytes.Join(topic.Last(10), []byte(","))); str != "a2" {
+		t.Errorf("Expected a2, got %s", str)
+	}
+
+	topic.PublishWith([]byte("b2"), PublishOptions{Key: "b"})
+	topic.Publish([]byte("x"))
+	topic.PublishWith([]byte("c1"), PublishOptions{Key: "c"})
+	topic.PublishWith([]byte("a3"), PublishOptions{Key: "a"})
+	if str := string(bytes.Join(topic.Last(10), []byte(","))); str != "b2,x,c1,a3" {
+		t.Errorf("Expected b2,x,c1,a3, got %s", str)
+	}
+
+	// A tombstone deletes the key.
+	topic.PublishWith([]byte{}, PublishOptions{Key: "c"})
+	if str := string(bytes.Join(topic.Last(10), []byte(","))); str != "b2,x,a3" {
+		t.Errorf("Expected b2,x,a3, got %s", str)
+	}
+}
+
+func TestHistoryRange(t *testing.T) {
+	topic := NewHistoriedTopic("test", 10)
+	for _, s := range []string{"a", "b", "c", "d", "e"} {
+		topic.Publish([]byte(s))
+	}
+
+	records, more := topic.Range(HistoryQuery{FromSeq: 2, ToSeq: 4})
+	if more || len(records) != 3 {
+		t.Fatalf("Expected 3 records and no more, got %d, %t", len(records), more)
+	}
+	if records[0].Seq != 2 || string(records[0].Message) != "b" || records[2].Seq != 4 {
+		t.Errorf("Unexpected records: %+v", records)
+	}
+
+	records, more = topic.Range(HistoryQuery{FromSeq: 2, Limit: 2})
+	if !more || len(records) != 2 || string(records[1].Message) != "c" {
+		t.Errorf("Expected b, c and more, got %+v, %t", records, more)
+	}
+
+	records, _ = topic.Range(HistoryQuery{From: time.Now().Add(time.Minute)})
+	if len(records) != 0 {
+		t.Errorf("Expected no records in the future, got %d", len(records))
+	}
+	records, _ = topic.Range(HistoryQuery{To: time.Now()})
+	if len(records) != 5 {
+		t.Errorf("Expected 5 records, got %d", len(records))
+	}
+}
+
+func TestHistorySinceMiddle(t *testing.T) {
+	topic := NewHistoriedTopic("test", 5)
+	for _, s := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		topic.Publish([]byte(s))
+	}
+
+	// Since must find the first newer message, not stop at an older one.
+	records, _ := topic.Range(HistoryQuery{})
+	if str := string(bytes.Join(topic.Since(records[1].Time), []byte(""))); str != "efg" {
+		t.Errorf("Expected efg, got %s", str)
+	}
+	if l := topic.Since(records[4].Time); len(l) != 0 {
+		t.Errorf("Expected nothing newer than the last message, got %d", len(l))
+	}
+}
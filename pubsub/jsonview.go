@@ -0,0 +1,206 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// JSONView selects and reshapes JSON messages for a subscriber.
+//
+// A view has a filter, in the syntax of Filter but with JSON Pointers
+// (RFC 6901) as fields, such as
+//
+//	/type == "order" && /total > 100
+//
+// and a list of JSON Pointers to project, such as /id and /customer/name.
+// Only messages that match the filter are sent, and a message with
+// projected fields is replaced by an object with only those fields, at the
+// same paths. A pointer that passes through an array projects the whole
+// array. Fields that are missing are left out.
+//
+// JSON strings, numbers, booleans, and null compare as their text. Objects
+// and arrays can be tested for, but never compare. Messages that are not
+// JSON are never sent. Messages that are JSON, but not objects, are sent
+// whole if they match.
+//
+// Each message is decoded for each subscriber with a view, so views cost
+// more than metadata filters.
+//
+// A nil *JSONView sends every message unchanged.
+type JSONView struct {
+	filter *Filter
+	fields [][]string
+}
+
+// ParseJSONView parses a view from a filter expression and a comma
+// separated list of JSON Pointers to project. Either may be empty. If both
+// are, it returns a nil view.
+func ParseJSONView(filter, fields string) (*JSONView, error) {
+	if len(filter) == 0 && len(fields) == 0 {
+		return nil, nil
+	}
+	v := &JSONView{}
+	if len(filter) > 0 {
+		f, err := parseFilter(filter, true)
+		if err != nil {
+			return nil, err
+		}
+		v.filter = f
+	}
+	if len(fields) > 0 {
+		for _, field := range strings.Split(fields, ",") {
+			field = strings.TrimSpace(field)
+			ptr, err := parsePointer(field)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid field %q: %s.", field, err)
+			}
+			v.fields = append(v.fields, ptr)
+		}
+	}
+	return v, nil
+}
+
+// Apply filters and projects a message. It returns the message to send, and
+// false if the message should not be sent.
+func (v *JSONView) Apply(msg []byte) ([]byte, bool) {
+	if v == nil {
+		return msg, true
+	}
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, false
+	}
+	// Anything after the value, other than space, is not JSON.
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, false
+	}
+	lookup := func(name string) (string, bool, bool) {
+		return jsonField(doc, v.filter.pointers[name])
+	}
+	if !v.filter.matchFields(lookup) {
+		return nil, false
+	}
+
+	obj, ok := doc.(map[string]interface{})
+	if len(v.fields) == 0 || !ok {
+		return msg, true
+	}
+	out, err := json.Marshal(project(obj, v.fields))
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
+
+// parsePointer splits a JSON Pointer into its reference tokens.
+func parsePointer(s string) ([]string, error) {
+	if !strings.HasPrefix(s, "/") {
+		return nil, errors.New("a JSON Pointer must start with /")
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, t := range tokens {
+		// Every ~ must be part of ~0 or ~1.
+		if strings.Count(t, "~") != strings.Count(t, "~0")+strings.Count(t, "~1") {
+			return nil, errors.New("~ must be followed by 0 or 1")
+		}
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// resolve follows a JSON Pointer into a decoded document.
+func resolve(doc interface{}, ptr []string) (interface{}, bool) {
+	for _, t := range ptr {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[t]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case []interface{}:
+			i, err := strconv.Atoi(t)
+			if err != nil || i < 0 || i >= len(d) || (len(t) > 1 && t[0] == '0') {
+				return nil, false
+			}
+			doc = d[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// jsonField is a fieldLookup into a decoded document.
+func jsonField(doc interface{}, ptr []string) (string, bool, bool) {
+	v, ok := resolve(doc, ptr)
+	if !ok {
+		return "", false, false
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true, true
+	case json.Number:
+		return v.String(), true, true
+	case bool:
+		return strconv.FormatBool(v), true, true
+	case nil:
+		return "null", true, true
+	}
+	return "", true, false
+}
+
+// project builds an object with only the given fields of obj.
+func project(obj map[string]interface{}, fields [][]string) map[string]interface{} {
+	out := map[string]interface{}{}
+	for _, ptr := range fields {
+		// Follow the pointer through objects. Stop early at an array, and
+		// take all of it.
+		src, path := obj, ptr
+		var val interface{}
+		found := false
+		for i, t := range ptr {
+			v, ok := src[t]
+			if !ok {
+				break
+			}
+			child, isObj := v.(map[string]interface{})
+			if i == len(ptr)-1 || !isObj {
+				if _, isArr := v.([]interface{}); i == len(ptr)-1 || isArr {
+					val, path, found = v, ptr[:i+1], true
+				}
+				break
+			}
+			src = child
+		}
+		if found && len(path) > 0 {
+			insert(out, path, val)
+		}
+	}
+	return out
+}
+
+// insert sets a value at a path in obj, making objects on the way as
+// needed.
+func insert(obj map[string]interface{}, path []string, val interface{}) {
+	for _, t := range path[:len(path)-1] {
+		child, ok := obj[t].(map[string]interface{})
+		if !ok {
+			if _, exists := obj[t]; exists {
+				// A whole array or value is already projected here.
+				return
+			}
+			child = map[string]interface{}{}
+			obj[t] = child
+		}
+		obj = child
+	}
+	obj[path[len(path)-1]] = val
+}
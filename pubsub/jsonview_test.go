@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	"reflect"
+	"testing"
+)
+
+const order = `{"type":"order","total":250,"paid":true,"note":null,"id":"a1",
+	"customer":{"name":"Ana","address":{"city":"Lisbon"}},"items":[{"sku":"x"},{"sku":"y"}],"a/b":1}`
+
+func TestJSONViewFilter(t *testing.T) {
+	tests := map[string]bool{
+		`/type == "order"`:                  true,
+		`/type == order && /total > 100`:    true,
+		`/total > 1000`:                     false,
+		`/paid == true`:                     true,
+		`/note == null`:                     true,
+		`/customer/name == "Ana"`:           true,
+		`/customer/address/city != "Porto"`: true,
+		`/items/1/sku == "y"`:               true,
+		`/items/2/sku == "y"`:               false,
+		`/items/01/sku == "y"`:              false,
+		`/a~1b == 1`:                        true,
+		`/customer`:                         true,
+		`/customer == "x"`:                  false,
+		`!/missing`:                         true,
+	}
+	for expr, expect := range tests {
+		v, err := ParseJSONView(expr, "")
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s", expr, err)
+			continue
+		}
+		if _, got := v.Apply([]byte(order)); got != expect {
+			t.Errorf("Expected %q to be %t, got %t", expr, expect, got)
+		}
+	}
+}
+
+func TestJSONViewProject(t *testing.T) {
+	v, err := ParseJSONView("", "/id, /customer/address/city, /items/0/sku, /missing, /total/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, ok := v.Apply([]byte(order))
+	if !ok {
+		t.Fatal("Expected the message to be sent.")
+	}
+	expect := `{"customer":{"address":{"city":"Lisbon"}},"id":"a1","items":[{"sku":"x"},{"sku":"y"}]}`
+	if string(out) != expect {
+		t.Errorf("Expected %s, got %s", expect, out)
+	}
+
+	// Messages that are not JSON are not sent, and other JSON is not
+	// projected.
+	if _, ok := v.Apply([]byte("plain text")); ok {
+		t.Error("Expected a message that is not JSON to be dropped.")
+	}
+	for _, msg := range []string{`{"id":"a1"} x`, `{"id":"a1"}{}`, `1 2`} {
+		if _, ok := v.Apply([]byte(msg)); ok {
+			t.Errorf("Expected %q, with data after the value, to be dropped.", msg)
+		}
+	}
+	if _, ok := v.Apply([]byte(" {\"id\":\"a1\"}\n")); !ok {
+		t.Error("Expected space around the value to be allowed.")
+	}
+	if out, ok := v.Apply([]byte(`[1,2]`)); !ok || string(out) != `[1,2]` {
+		t.Errorf("Expected an array to be sent whole, got %s", out)
+	}
+
+	var none *JSONView
+	if out, ok := none.Apply([]byte("plain text")); !ok || string(out) != "plain text" {
+		t.Error("Expected a nil view to send everything unchanged.")
+	}
+}
+
+func TestParseJSONView(t *testing.T) {
+	if v, err := ParseJSONView("", ""); v != nil || err != nil {
+		t.Errorf("Expected no view, got %v, %v", v, err)
+	}
+	for _, c := range [][2]string{
+		{`type == "order"`, ""},
+		{`/a~2 == 1`, ""},
+		{"", "id"},
+		{"", "/ok,/bad~"},
+	} {
+		if _, err := ParseJSONView(c[0], c[1]); err == nil {
+			t.Errorf("Expected an error for %q %q", c[0], c[1])
+		}
+	}
+	// Pointers are parsed once, with the filter.
+	v, err := ParseJSONView(`/a~1b == 1 || /c/0 && !/a~1b`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string][]string{"/a~1b": {"a/b"}, "/c/0": {"c", "0"}}
+	if !reflect.DeepEqual(v.filter.pointers, expect) {
+		t.Errorf("Expected pointers %q, got %q", expect, v.filter.pointers)
+	}
+
+	// Metadata filters do not take pointers.
+	if _, err := ParseFilter(`/type == "order"`); err == nil {
+		t.Error("Expected a metadata filter to reject a JSON Pointer.")
+	}
+
+	ptr, _ := parsePointer("/a~1b/c~0d/")
+	if !reflect.DeepEqual(ptr, []string{"a/b", "c~d", ""}) {
+		t.Errorf("Unexpected pointer tokens %q", ptr)
+	}
+}
@@ -0,0 +1,57 @@
+package pubsub
+
+import (
+	"github.com/technosophos/drift/metrics"
+)
+
+// Metrics for topics and history. These are written by the metrics.Serve
+// command along with everything else in metrics.Default.
+var (
+	publishedTotal  = metrics.Default.Counter("drift_messages_published_total", "Messages published, by topic.", "topic")
+	deliveredTotal  = metrics.Default.Counter("drift_messages_delivered_total", "Messages queued for delivery to a subscriber, by topic.", "topic")
+	droppedTotal    = metrics.Default.Counter("drift_messages_dropped_total", "Messages that could not be queued for a subscriber, by topic.", "topic")
+	filteredTotal   = metrics.Default.Counter("drift_messages_filtered_total", "Messages not queued for a subscriber because they did not match its filter, by topic.", "topic")
+	rejectedTotal   = metrics.Default.Counter("drift_messages_rejected_total", "Messages rejected because they did not match the topic's schema, by topic.", "topic")
+	subscriberGauge = metrics.Default.Gauge("drift_subscribers", "Current subscriptions, by topic.", "topic")
+	historyGauge    = metrics.Default.Gauge("drift_history_messages", "Messages held in history, by topic.", "topic")
+	expiredTotal    = metrics.Default.Counter("drift_history_expired_total", "Messages dropped from history because they expired, by topic.", "topic")
+	evictedTotal    = metrics.Default.Counter("drift_history_evicted_total", "Messages dropped from history to stay within a byte limit or the memory budget, by topic.", "topic")
+	compactedTotal  = metrics.Default.Counter("drift_history_compacted_total", "Messages dropped from a compacted history because a newer message has the same key, by topic.", "topic")
+	historyBytes    = metrics.Default.Gauge("drift_history_bytes", "Bytes of messages held in history, by topic.", "topic")
+	memoryGauge     = metrics.Default.Gauge("drift_history_memory_bytes", "Bytes of messages held in the history of all topics.")
+	budgetGauge     = metrics.Default.Gauge("drift_history_memory_budget_bytes", "The memory budget for the history of all topics. Zero is unlimited.")
+	topicGauge      = metrics.Default.Gauge("drift_topics", "Number of topics.")
+	publishLatency  = metrics.Default.Histogram("drift_publish_duration_seconds", "Time taken to handle a publish, including history.", nil)
+	fanoutLatency   = metrics.Default.Histogram("drift_fanout_duration_seconds", "Time taken to queue a message for every subscriber.", nil)
+	queueDepth      = metrics.Default.Histogram("drift_subscriber_queue_depth", "Subscriber queue depth seen when a message is queued.", []float64{0, 1, 2, 5, 10})
+)
+
+// topicStats holds a topic's series of the counters that are updated on
+// every publish, so that their labels are not looked up each time.
+type topicStats struct {
+	published, delivered, dropped, filtered *metrics.CounterSeries
+}
+
+func newTopicStats(name string) topicStats {
+	return topicStats{
+		published: publishedTotal.With(name),
+		delivered: deliveredTotal.With(name),
+		dropped:   droppedTotal.With(name),
+		filtered:  filteredTotal.With(name),
+	}
+}
+
+// forgetTopic removes all per-topic metrics for the named topic.
+func forgetTopic(name string) {
+	publishedTotal.Delete(name)
+	deliveredTotal.Delete(name)
+	droppedTotal.Delete(name)
+	filteredTotal.Delete(name)
+	rejectedTotal.Delete(name)
+	subscriberGauge.Delete(name)
+	historyGauge.Delete(name)
+	expiredTotal.Delete(name)
+	evictedTotal.Delete(name)
+	compactedTotal.Delete(name)
+	historyBytes.Delete(name)
+}
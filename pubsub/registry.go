@@ -0,0 +1,144 @@
+package pubsub
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// registryShards is the number of shards in a Medium's topic registry.
+const registryShards = 64
+
+// registry is a concurrent map of topics by name.
+//
+// Topics are spread across shards by a hash of their name, and each shard
+// has its own lock, so that work on one topic rarely waits for work on
+// another. No operation holds more than one shard lock at a time.
+type registry struct {
+	// count is only accessed atomically.
+	count  int64
+	shards []shard
+}
+
+type shard struct {
+	mx     sync.RWMutex
+	topics map[string]Topic
+}
+
+// newRegistry creates a registry with n shards.
+func newRegistry(n int) *registry {
+	r := &registry{shards: make([]shard, n)}
+	for i := range r.shards {
+		r.shards[i].topics = map[string]Topic{}
+	}
+	return r
+}
+
+// shard returns the shard that holds the named topic.
+func (r *registry) shard(name string) *shard {
+	// FNV-1a, inline so that it does not allocate.
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return &r.shards[h%uint32(len(r.shards))]
+}
+
+// get returns the named topic.
+func (r *registry) get(name string) (Topic, bool) {
+	s := r.shard(name)
+	s.mx.RLock()
+	t, ok := s.topics[name]
+	s.mx.RUnlock()
+	return t, ok
+}
+
+// put adds a topic, replacing any topic of the same name.
+func (r *registry) put(t Topic) {
+	s := r.shard(t.Name())
+	s.mx.Lock()
+	if _, ok := s.topics[t.Name()]; !ok {
+		r.changed(1)
+	}
+	s.topics[t.Name()] = t
+	s.mx.Unlock()
+}
+
+// getOrCreate returns the named topic, calling create to add it if it does
+// not exist.
+//
+// Fetching and creating are atomic: if several goroutines ask for the same
+// missing topic at once, create is called only once, and all of them get
+// the same topic. create is called with the shard locked, so it must not
+// use the registry. It returns true if the topic was created.
+func (r *registry) getOrCreate(name string, create func(string) Topic) (Topic, bool) {
+	s := r.shard(name)
+	s.mx.RLock()
+	t, ok := s.topics[name]
+	s.mx.RUnlock()
+	if ok {
+		return t, false
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	// Someone may have created it since we looked.
+	if t, ok := s.topics[name]; ok {
+		return t, false
+	}
+	t = create(name)
+	s.topics[name] = t
+	r.changed(1)
+	return t, true
+}
+
+// remove removes the named topic, and returns it.
+func (r *registry) remove(name string) (Topic, bool) {
+	return r.removeIf(name, func(Topic) bool { return true })
+}
+
+// removeIf removes the named topic if f returns true for it, and returns
+// it.
+//
+// f is called with the shard locked, so it must not use the registry.
+func (r *registry) removeIf(name string, f func(Topic) bool) (Topic, bool) {
+	s := r.shard(name)
+	s.mx.Lock()
+	t, ok := s.topics[name]
+	if ok && f(t) {
+		delete(s.topics, name)
+		r.changed(-1)
+	} else {
+		t, ok = nil, false
+	}
+	s.mx.Unlock()
+	return t, ok
+}
+
+// all returns every topic.
+//
+// The shards are locked one at a time, so topics added or removed during
+// the call may or may not be included.
+func (r *registry) all() []Topic {
+	topics := make([]Topic, 0, r.len())
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mx.RLock()
+		for _, t := range s.topics {
+			topics = append(topics, t)
+		}
+		s.mx.RUnlock()
+	}
+	return topics
+}
+
+// len returns the number of topics.
+func (r *registry) len() int {
+	return int(atomic.LoadInt64(&r.count))
+}
+
+// changed records that n topics were added, or removed if n is negative.
+func (r *registry) changed(n int64) {
+	count := atomic.AddInt64(&r.count, n)
+	topicGauge.Set(float64(count))
+}
@@ -0,0 +1,125 @@
+package pubsub
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := newRegistry(4)
+	for i := 0; i < 10; i++ {
+		r.put(NewTopic(fmt.Sprintf("t%d", i)))
+	}
+	// Replacing a topic does not count it twice.
+	r.put(NewTopic("t0"))
+	if n := r.len(); n != 10 {
+		t.Errorf("Expected 10 topics, got %d", n)
+	}
+	if n := len(r.all()); n != 10 {
+		t.Errorf("Expected all 10 topics, got %d", n)
+	}
+
+	if _, ok := r.get("t3"); !ok {
+		t.Error("Expected to find t3.")
+	}
+	if _, ok := r.remove("t3"); !ok {
+		t.Error("Expected to remove t3.")
+	}
+	if _, ok := r.remove("t3"); ok {
+		t.Error("Expected t3 to be gone.")
+	}
+	if n := r.len(); n != 9 {
+		t.Errorf("Expected 9 topics, got %d", n)
+	}
+}
+
+func TestFetchOrCreate(t *testing.T) {
+	m := NewMedium()
+	var created int32
+	create := func(name string) Topic {
+		atomic.AddInt32(&created, 1)
+		return NewTopic(name)
+	}
+
+	topics := make([]Topic, 50)
+	var wg sync.WaitGroup
+	for i := range topics {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			topics[i], _ = m.FetchOrCreate("race", create)
+		}(i)
+	}
+	wg.Wait()
+
+	if created != 1 {
+		t.Errorf("Expected the topic to be created once, got %d", created)
+	}
+	for _, topic := range topics {
+		if topic != topics[0] {
+			t.Fatal("Expected every caller to get the same topic.")
+		}
+	}
+	if _, ok := m.FetchOrCreate("race", create); ok {
+		t.Error("Expected the existing topic to be fetched.")
+	}
+}
+
+// TestMediumConcurrent is meant to be run with the race detector.
+func TestMediumConcurrent(t *testing.T) {
+	m := NewMedium()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				name := fmt.Sprintf("t%d", j%20)
+				fetchOrCreateTopic(m, name, j%2 == 0, 10).Publish([]byte("x"))
+				m.Topic(name)
+				if j%5 == i%5 {
+					m.Delete(name)
+				}
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			m.ExpireHistory()
+		}
+	}()
+	wg.Wait()
+
+	if n, all := m.topics.len(), len(m.topics.all()); n != all {
+		t.Errorf("Expected the count to match the %d topics, got %d", all, n)
+	}
+}
+
+func BenchmarkRegistry1Shard(b *testing.B) {
+	benchmarkRegistry(b, 1)
+}
+
+func BenchmarkRegistry64Shards(b *testing.B) {
+	benchmarkRegistry(b, registryShards)
+}
+
+// benchmarkRegistry creates, looks up, and deletes short-lived topics from
+// every goroutine. Compare with -cpu to see how it scales.
+func benchmarkRegistry(b *testing.B, shards int) {
+	r := newRegistry(shards)
+	var next int64
+	b.RunParallel(func(pb *testing.PB) {
+		create := func(name string) Topic { return &channeledTopic{name: name} }
+		for pb.Next() {
+			name := fmt.Sprintf("topic%d", atomic.AddInt64(&next, 1)%100000)
+			r.getOrCreate(name, create)
+			r.get(name)
+			r.get(name)
+			r.remove(name)
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package pubsub
+
+import (
+	"sync/atomic"
+)
+
+// minRing is the smallest number of slots a ring is created with.
+const minRing = 16
+
+// ring is a fixed-capacity buffer of history entries, oldest first.
+//
+// Every entry added to a ring is given the next position. The entry at
+// position p lives in slot p modulo the capacity, so positions in
+// [head, tail) are in the ring. Removing an entry clears its slot and leaves
+// a hole, which readers skip.
+//
+// Only one goroutine may change a ring at a time, but any number of readers
+// may use it concurrently without locking. Entries are never changed once
+// they are added, and a reader that finds a slot reused for a newer position
+// treats it as a hole. So a reader sees the history as it was at some point
+// while it was reading, never a torn entry.
+type ring struct {
+	// head and tail are only accessed atomically.
+	head, tail uint64
+	slots      []atomic.Value
+}
+
+// newRing creates an empty ring with room for size entries.
+func newRing(size int) *ring {
+	return &ring{slots: make([]atomic.Value, size)}
+}
+
+// bounds returns the position of the oldest slot and the position after the
+// newest.
+func (r *ring) bounds() (head, tail uint64) {
+	return atomic.LoadUint64(&r.head), atomic.LoadUint64(&r.tail)
+}
+
+// full returns true if there is no free slot, counting holes as used.
+func (r *ring) full() bool {
+	head, tail := r.bounds()
+	return tail-head >= uint64(len(r.slots))
+}
+
+// at returns the entry at position p, or nil if it has been removed.
+func (r *ring) at(p uint64) *entry {
+	if len(r.slots) == 0 {
+		return nil
+	}
+	e, _ := r.slots[p%uint64(len(r.slots))].Load().(*entry)
+	if e == nil || e.pos != p {
+		return nil
+	}
+	return e
+}
+
+// push adds an entry after the newest one, setting its position.
+//
+// The ring must not be full, and the entry must not yet be visible to any
+// reader.
+func (r *ring) push(e *entry) {
+	tail := r.tail
+	e.pos = tail
+	r.slots[tail%uint64(len(r.slots))].Store(e)
+	atomic.StoreUint64(&r.tail, tail+1)
+}
+
+// clear removes the entry at position p, and then frees any holes at the
+// front of the ring.
+func (r *ring) clear(p uint64) {
+	r.slots[p%uint64(len(r.slots))].Store((*entry)(nil))
+	head, tail := r.bounds()
+	for head < tail && r.at(head) == nil {
+		head++
+	}
+	atomic.StoreUint64(&r.head, head)
+}
+
+// front returns the oldest entry, or nil if the ring is empty.
+func (r *ring) front() *entry {
+	head, tail := r.bounds()
+	for p := head; p < tail; p++ {
+		if e := r.at(p); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// back returns the newest entry, or nil if the ring is empty.
+func (r *ring) back() *entry {
+	head, tail := r.bounds()
+	for p := tail; p > head; p-- {
+		if e := r.at(p - 1); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// search uses binary search to find the first position in [from, to) whose
+// entry satisfies f.
+//
+// f must be false for older entries and true for newer ones, as it is for
+// comparisons by time or sequence number. Holes are skipped. If no entry
+// satisfies f, search returns to.
+func (r *ring) search(from, to uint64, f func(*entry) bool) uint64 {
+	lo, hi := from, to
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		// Find the first entry at or after mid. Everything in between is a
+		// hole, so if it satisfies f, so does mid.
+		p := mid
+		var e *entry
+		for ; p < hi; p++ {
+			if e = r.at(p); e != nil {
+				break
+			}
+		}
+		if e == nil || f(e) {
+			hi = mid
+		} else {
+			lo = p + 1
+		}
+	}
+	return lo
+}
@@ -0,0 +1,299 @@
+package pubsub
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	r := newRing(4)
+	if r.front() != nil || r.back() != nil {
+		t.Error("Expected an empty ring.")
+	}
+	for i := uint64(1); i <= 4; i++ {
+		r.push(&entry{seq: i})
+	}
+	if !r.full() {
+		t.Error("Expected the ring to be full.")
+	}
+
+	// A hole in the middle is skipped, and one at the front frees a slot.
+	r.clear(2)
+	if r.at(2) != nil {
+		t.Error("Expected a hole at position 2.")
+	}
+	if p := r.search(0, 4, func(e *entry) bool { return e.seq >= 2 }); p != 1 {
+		t.Errorf("Expected position 1, got %d", p)
+	}
+	if p := r.search(0, 4, func(e *entry) bool { return e.seq >= 4 }); p != 2 {
+		t.Errorf("Expected the search to stop at the hole, got %d", p)
+	}
+	if p := r.search(0, 4, func(e *entry) bool { return e.seq > 4 }); p != 4 {
+		t.Errorf("Expected no match, got %d", p)
+	}
+	r.clear(0)
+	if head, _ := r.bounds(); head != 1 || r.full() {
+		t.Errorf("Expected the head to move to 1, got %d", head)
+	}
+	if r.front().seq != 2 || r.back().seq != 4 {
+		t.Errorf("Expected 2 and 4 at the ends, got %d and %d", r.front().seq, r.back().seq)
+	}
+
+	// Position 4 reuses the slot of position 0, which readers that started
+	// earlier must not mistake for the old entry.
+	r.push(&entry{seq: 5})
+	if r.at(0) != nil {
+		t.Error("Expected a reused slot to read as a hole.")
+	}
+	if e := r.at(4); e == nil || e.seq != 5 {
+		t.Errorf("Expected seq 5 at position 4, got %v", e)
+	}
+}
+
+func TestHistoryResize(t *testing.T) {
+	topic := NewHistoriedTopic("test", 4)
+	topic.SetCompact(true)
+
+	// Updating the same keys leaves holes behind, so the ring is rebuilt
+	// many times over.
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("k%d", i%3)
+		topic.PublishWith([]byte(fmt.Sprintf("%s=%d", key, i)), PublishOptions{Key: key})
+	}
+	records, _ := topic.Range(HistoryQuery{})
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(records))
+	}
+	for i, want := range []string{"k1=97", "k2=98", "k0=99"} {
+		if string(records[i].Message) != want {
+			t.Errorf("Expected %s, got %s", want, records[i].Message)
+		}
+	}
+
+	h := topic.(*historyTopic)
+	if n := len(h.ring().slots); n > 8 {
+		t.Errorf("Expected at most 8 slots, got %d", n)
+	}
+	if len(h.keys) != 3 || h.live != 3 {
+		t.Errorf("Expected 3 keys and entries, got %d and %d", len(h.keys), h.live)
+	}
+}
+
+// TestHistoryConcurrent is meant to be run with the race detector.
+func TestHistoryConcurrent(t *testing.T) {
+	topic := NewHistoriedTopic("test", 50)
+	topic.SetCompact(true)
+	start := time.Now()
+
+	var publishers, readers sync.WaitGroup
+	stop := make(chan bool)
+	for i := 0; i < 2; i++ {
+		publishers.Add(1)
+		go func(i int) {
+			defer publishers.Done()
+			for j := 0; j < 2000; j++ {
+				opts := PublishOptions{}
+				switch j % 4 {
+				case 1:
+					opts.Key = fmt.Sprintf("k%d", j%10)
+				case 2:
+					opts.TTL = time.Millisecond
+				}
+				topic.PublishWith([]byte(fmt.Sprintf("%d-%d", i, j)), opts)
+			}
+		}(i)
+	}
+
+	errs := make(chan error, 3)
+	read := func(f func() error) {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := f(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}
+	readers.Add(3)
+	go read(func() error {
+		records, _ := topic.Range(HistoryQuery{})
+		for i := 1; i < len(records); i++ {
+			if records[i].Seq <= records[i-1].Seq {
+				return fmt.Errorf("Records out of order: %d after %d", records[i].Seq, records[i-1].Seq)
+			}
+		}
+		return nil
+	})
+	go read(func() error {
+		topic.Since(start)
+		topic.Last(10)
+		topic.(*historyTopic).oldest()
+		return nil
+	})
+	go read(func() error {
+		topic.Expire()
+		return nil
+	})
+
+	publishers.Wait()
+	close(stop)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// listHistory keeps history the way historyTopic did before it used a
+// ring: in a linked list, behind a single lock. It is here to benchmark
+// against. Its since scans the whole list, as a correct Since would have to.
+type listHistory struct {
+	name   string
+	buffer *list.List
+	max    int
+	maxAge time.Duration
+	bytes  int64
+	budget *Budget
+	seq    uint64
+	mx     sync.Mutex
+}
+
+func newListHistory(max int) *listHistory {
+	return &listHistory{name: "list", buffer: list.New(), max: max, budget: NewBudget(0)}
+}
+
+func (h *listHistory) expired(e *entry, now time.Time) bool {
+	if !e.expires.IsZero() && !now.Before(e.expires) {
+		return true
+	}
+	return h.maxAge > 0 && now.Sub(e.ts) > h.maxAge
+}
+
+func (h *listHistory) add(msg []byte) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	h.seq++
+	h.buffer.PushBack(&entry{msg: msg, ts: time.Now(), seq: h.seq})
+	h.bytes += int64(len(msg))
+	h.budget.grow(int64(len(msg)))
+	for h.buffer.Len() > h.max {
+		e := h.buffer.Remove(h.buffer.Front()).(*entry)
+		h.bytes -= int64(len(e.msg))
+		h.budget.grow(-int64(len(e.msg)))
+	}
+	historyGauge.Set(float64(h.buffer.Len()), h.name)
+	historyBytes.Set(float64(h.bytes), h.name)
+}
+
+func (h *listHistory) since(t time.Time) [][]byte {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	acc := [][]byte{}
+	now := time.Now()
+	for v := h.buffer.Front(); v != nil; v = v.Next() {
+		if e := v.Value.(*entry); !h.expired(e, now) && e.ts.After(t) {
+			acc = append(acc, e.msg)
+		}
+	}
+	return acc
+}
+
+// fillHistory adds 1000 messages to a history, and returns the time of the
+// message 10 from the end.
+func fillHistory(add func([]byte)) time.Time {
+	msg := []byte("benchmark")
+	var t time.Time
+	for i := 0; i < 1000; i++ {
+		if i == 990 {
+			t = time.Now()
+		}
+		add(msg)
+	}
+	return t
+}
+
+func newBenchTopic() *historyTopic {
+	h := TrackHistory(NewTopic("bench"), 1000).(*historyTopic)
+	h.budget = NewBudget(0)
+	return h
+}
+
+func BenchmarkHistoryAddRing(b *testing.B) {
+	h := newBenchTopic()
+	benchmarkAdd(b, func(m []byte) { h.add(m, PublishOptions{}) })
+}
+
+func BenchmarkHistoryAddList(b *testing.B) {
+	benchmarkAdd(b, newListHistory(1000).add)
+}
+
+func benchmarkAdd(b *testing.B, add func([]byte)) {
+	msg := []byte("benchmark")
+	for i := 0; i < b.N; i++ {
+		add(msg)
+	}
+}
+
+func BenchmarkHistorySinceRing(b *testing.B) {
+	h := newBenchTopic()
+	benchmarkSince(b, func(m []byte) { h.add(m, PublishOptions{}) }, h.Since)
+}
+
+func BenchmarkHistorySinceList(b *testing.B) {
+	h := newListHistory(1000)
+	benchmarkSince(b, h.add, h.since)
+}
+
+// benchmarkSince reads the last 10 messages of a full history.
+func benchmarkSince(b *testing.B, add func([]byte), since func(time.Time) [][]byte) {
+	t := fillHistory(add)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		since(t)
+	}
+}
+
+func BenchmarkHistoryContendedRing(b *testing.B) {
+	h := newBenchTopic()
+	benchmarkContended(b, func(m []byte) { h.add(m, PublishOptions{}) }, h.Since)
+}
+
+func BenchmarkHistoryContendedList(b *testing.B) {
+	h := newListHistory(1000)
+	benchmarkContended(b, h.add, h.since)
+}
+
+// benchmarkContended publishes while four readers replay the whole history
+// over and over, as new subscribers would.
+func benchmarkContended(b *testing.B, add func([]byte), since func(time.Time) [][]byte) {
+	fillHistory(add)
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					since(time.Time{})
+				}
+			}
+		}()
+	}
+	b.ResetTimer()
+	benchmarkAdd(b, add)
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,878 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Masterminds/cookoo"
+	"github.com/technosophos/drift/httputil"
+)
+
+// MaxSchemaViolations is the most violations reported for one message.
+var MaxSchemaViolations = 20
+
+// Schema is a compiled JSON Schema that a topic's messages must match.
+//
+// It supports the validation keywords of JSON Schema draft 2020-12 that
+// apply to single JSON documents: type, enum, const, properties, required,
+// additionalProperties, items, minItems, maxItems, uniqueItems, minimum,
+// maximum, exclusiveMinimum, exclusiveMaximum, multipleOf, minLength,
+// maxLength, pattern, minProperties, maxProperties, allOf, anyOf, oneOf,
+// not, and $ref to a JSON Pointer within the schema, such as
+// #/$defs/address. Annotations such as title, description, and format are
+// allowed but not checked. Any other keyword is rejected, so that a schema
+// is never silently looser than it reads.
+type Schema struct {
+	raw     json.RawMessage
+	root    *schemaNode
+	version int
+}
+
+// ParseSchema compiles a JSON Schema.
+func ParseSchema(data []byte) (*Schema, error) {
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("Schema is not valid JSON: %s", err)
+	}
+	var raw bytes.Buffer
+	if err := json.Compact(&raw, data); err != nil {
+		return nil, fmt.Errorf("Schema is not valid JSON: %s", err)
+	}
+	sc := &schemaCompiler{doc: doc, nodes: map[string]*schemaNode{}}
+	root, err := sc.compile(doc, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := sc.resolveRefs(); err != nil {
+		return nil, err
+	}
+	return &Schema{raw: raw.Bytes(), root: root}, nil
+}
+
+// Version returns the schema's version on its topic. It is zero for a
+// schema that has not been added to a topic.
+func (s *Schema) Version() int {
+	return s.version
+}
+
+// JSON returns the schema document.
+func (s *Schema) JSON() json.RawMessage {
+	return s.raw
+}
+
+// Validate checks a message against the schema. If the message does not
+// match, the error is a *SchemaError.
+func (s *Schema) Validate(msg []byte) error {
+	e := &SchemaError{Version: s.version}
+	doc, err := decodeJSON(msg)
+	if err != nil {
+		e.Violations = []SchemaViolation{{Message: fmt.Sprintf("is not valid JSON: %s", err)}}
+		return e
+	}
+	s.root.validate(doc, "", e)
+	if len(e.Violations) > 0 {
+		return e
+	}
+	return nil
+}
+
+// SchemaError reports why a message does not match a topic's schema.
+type SchemaError struct {
+	Topic   string `json:"topic,omitempty"`
+	Version int    `json:"version"`
+	// Violations lists what is wrong, up to MaxSchemaViolations.
+	Violations []SchemaViolation `json:"violations"`
+}
+
+// SchemaViolation is one way in which a message does not match a schema.
+type SchemaViolation struct {
+	// Path is a JSON Pointer to the part of the message that is wrong. It
+	// is empty for the whole message.
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e *SchemaError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Message does not match schema version %d", e.Version)
+	for i, v := range e.Violations {
+		sep := ";"
+		if i == 0 {
+			sep = ":"
+		}
+		path := v.Path
+		if len(path) == 0 {
+			path = "message"
+		}
+		fmt.Fprintf(&b, "%s %s %s", sep, path, v.Message)
+	}
+	b.WriteString(".")
+	return b.String()
+}
+
+// add records a violation, unless there are already too many.
+func (e *SchemaError) add(path, format string, args ...interface{}) {
+	if len(e.Violations) < MaxSchemaViolations {
+		e.Violations = append(e.Violations, SchemaViolation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// decodeJSON decodes a single JSON document, keeping numbers exact.
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err == nil {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return doc, nil
+}
+
+// schemaNode is a compiled schema or subschema.
+type schemaNode struct {
+	// always is set for the boolean schemas true and false.
+	always *bool
+	types  []string
+	enum   []string
+	// konst is the canonical form of const, if set.
+	konst *string
+
+	properties map[string]*schemaNode
+	required   []string
+	// additional is the schema for properties not in properties. Nil
+	// allows anything.
+	additional *schemaNode
+	// Counts are -1 when unset.
+	minProps, maxProps int
+
+	items              *schemaNode
+	uniqueItems        bool
+	minItems, maxItems int
+
+	minimum, maximum, exclMin, exclMax, multipleOf *schemaNum
+
+	minLength, maxLength int
+	pattern              *regexp.Regexp
+
+	allOf, anyOf, oneOf []*schemaNode
+	not                 *schemaNode
+	// ref is the pointer in a $ref, and refNode what it points to.
+	ref     string
+	refNode *schemaNode
+}
+
+// schemaAnnotations are keywords that are allowed but not checked.
+var schemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "$defs": true, "definitions": true,
+	"title": true, "description": true, "default": true, "examples": true, "format": true,
+	"readOnly": true, "writeOnly": true, "deprecated": true,
+}
+
+type schemaCompiler struct {
+	doc interface{}
+	// nodes holds the compiled schema at each pointer, for $ref.
+	nodes map[string]*schemaNode
+	refs  []*schemaNode
+}
+
+func schemaErrorf(ptr, format string, args ...interface{}) error {
+	if len(ptr) == 0 {
+		ptr = "/"
+	}
+	return fmt.Errorf("Invalid schema at %s: %s.", ptr, fmt.Sprintf(format, args...))
+}
+
+// compile compiles the schema v, found at the JSON Pointer ptr.
+func (sc *schemaCompiler) compile(v interface{}, ptr string) (*schemaNode, error) {
+	n := &schemaNode{minItems: -1, maxItems: -1, minLength: -1, maxLength: -1, minProps: -1, maxProps: -1}
+	sc.nodes[ptr] = n
+	if b, ok := v.(bool); ok {
+		n.always = &b
+		return n, nil
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, schemaErrorf(ptr, "a schema must be an object or a boolean")
+	}
+
+	// Compile keywords in order, so that errors are predictable.
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := sc.keyword(n, k, obj[k], ptr+"/"+escapePointer(k)); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// keyword compiles one keyword of a schema into n.
+func (sc *schemaCompiler) keyword(n *schemaNode, k string, v interface{}, ptr string) error {
+	var err error
+	switch k {
+	case "type":
+		n.types, err = schemaTypes(v, ptr)
+	case "enum":
+		list, ok := v.([]interface{})
+		if !ok {
+			return schemaErrorf(ptr, "enum must be an array")
+		}
+		for _, item := range list {
+			n.enum = append(n.enum, canonicalJSON(item))
+		}
+	case "const":
+		c := canonicalJSON(v)
+		n.konst = &c
+	case "properties":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return schemaErrorf(ptr, "properties must be an object")
+		}
+		n.properties = map[string]*schemaNode{}
+		for name, sub := range obj {
+			if n.properties[name], err = sc.compile(sub, ptr+"/"+escapePointer(name)); err != nil {
+				return err
+			}
+		}
+	case "required":
+		list, ok := v.([]interface{})
+		if !ok {
+			return schemaErrorf(ptr, "required must be an array of strings")
+		}
+		for _, item := range list {
+			name, ok := item.(string)
+			if !ok {
+				return schemaErrorf(ptr, "required must be an array of strings")
+			}
+			n.required = append(n.required, name)
+		}
+	case "additionalProperties":
+		n.additional, err = sc.compile(v, ptr)
+	case "items":
+		n.items, err = sc.compile(v, ptr)
+	case "uniqueItems":
+		b, ok := v.(bool)
+		if !ok {
+			return schemaErrorf(ptr, "uniqueItems must be a boolean")
+		}
+		n.uniqueItems = b
+	case "minItems":
+		n.minItems, err = schemaCount(v, ptr)
+	case "maxItems":
+		n.maxItems, err = schemaCount(v, ptr)
+	case "minLength":
+		n.minLength, err = schemaCount(v, ptr)
+	case "maxLength":
+		n.maxLength, err = schemaCount(v, ptr)
+	case "minProperties":
+		n.minProps, err = schemaCount(v, ptr)
+	case "maxProperties":
+		n.maxProps, err = schemaCount(v, ptr)
+	case "minimum":
+		n.minimum, err = schemaNumber(v, ptr)
+	case "maximum":
+		n.maximum, err = schemaNumber(v, ptr)
+	case "exclusiveMinimum":
+		n.exclMin, err = schemaNumber(v, ptr)
+	case "exclusiveMaximum":
+		n.exclMax, err = schemaNumber(v, ptr)
+	case "multipleOf":
+		if n.multipleOf, err = schemaNumber(v, ptr); err == nil && n.multipleOf.rat.Sign() <= 0 {
+			return schemaErrorf(ptr, "multipleOf must be greater than 0")
+		}
+	case "pattern":
+		s, ok := v.(string)
+		if !ok {
+			return schemaErrorf(ptr, "pattern must be a string")
+		}
+		if n.pattern, err = regexp.Compile(s); err != nil {
+			return schemaErrorf(ptr, "%s", err)
+		}
+	case "allOf", "anyOf", "oneOf":
+		list, ok := v.([]interface{})
+		if !ok || len(list) == 0 {
+			return schemaErrorf(ptr, "%s must be a non-empty array", k)
+		}
+		nodes := make([]*schemaNode, len(list))
+		for i, sub := range list {
+			if nodes[i], err = sc.compile(sub, ptr+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+		switch k {
+		case "allOf":
+			n.allOf = nodes
+		case "anyOf":
+			n.anyOf = nodes
+		default:
+			n.oneOf = nodes
+		}
+	case "not":
+		n.not, err = sc.compile(v, ptr)
+	case "$ref":
+		ref, ok := v.(string)
+		if !ok || !strings.HasPrefix(ref, "#") {
+			return schemaErrorf(ptr, "only $ref to a JSON Pointer within the schema, such as #/$defs/name, is supported")
+		}
+		n.ref = ref[1:]
+		sc.refs = append(sc.refs, n)
+	default:
+		if !schemaAnnotations[k] {
+			return schemaErrorf(ptr, "keyword %q is not supported", k)
+		}
+	}
+	return err
+}
+
+// resolveRefs links each $ref to the schema it points to, compiling
+// schemas that are only reached by $ref, such as those in $defs.
+func (sc *schemaCompiler) resolveRefs() error {
+	// Compiling a target may add more refs.
+	for i := 0; i < len(sc.refs); i++ {
+		n := sc.refs[i]
+		target, ok := sc.nodes[n.ref]
+		if !ok {
+			if len(n.ref) > 0 {
+				ptr, err := parsePointer(n.ref)
+				if err != nil {
+					return fmt.Errorf("Invalid schema: $ref #%s: %s.", n.ref, err)
+				}
+				v, ok := resolve(sc.doc, ptr)
+				if !ok {
+					return fmt.Errorf("Invalid schema: $ref #%s points to nothing.", n.ref)
+				}
+				if target, err = sc.compile(v, n.ref); err != nil {
+					return err
+				}
+			}
+		}
+		n.refNode = target
+	}
+	for _, n := range sc.refs {
+		if n.loops(map[*schemaNode]bool{}) {
+			return fmt.Errorf("Invalid schema: $ref #%s refers back to itself without going deeper into the message.", n.ref)
+		}
+	}
+	return nil
+}
+
+// loops returns true if validating a value against n can come back to a
+// schema on the path without moving to a child of the value, which would
+// never end.
+func (n *schemaNode) loops(path map[*schemaNode]bool) bool {
+	if path[n] {
+		return true
+	}
+	path[n] = true
+	defer delete(path, n)
+	same := append(append(append([]*schemaNode{n.refNode, n.not}, n.allOf...), n.anyOf...), n.oneOf...)
+	for _, sub := range same {
+		if sub != nil && sub.loops(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaTypes reads the value of the type keyword.
+func schemaTypes(v interface{}, ptr string) ([]string, error) {
+	var list []interface{}
+	switch t := v.(type) {
+	case string:
+		list = []interface{}{t}
+	case []interface{}:
+		list = t
+	default:
+		return nil, schemaErrorf(ptr, "type must be a string or an array of strings")
+	}
+	types := []string{}
+	for _, item := range list {
+		s, _ := item.(string)
+		switch s {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+			types = append(types, s)
+		default:
+			return nil, schemaErrorf(ptr, "unknown type %v", item)
+		}
+	}
+	return types, nil
+}
+
+// schemaCount reads a non-negative integer keyword.
+func schemaCount(v interface{}, ptr string) (int, error) {
+	n, ok := v.(json.Number)
+	if ok {
+		if i, err := n.Int64(); err == nil && i >= 0 && i <= math.MaxInt32 {
+			return int(i), nil
+		}
+	}
+	return -1, schemaErrorf(ptr, "must be a non-negative integer")
+}
+
+// schemaNum is a number keyword, kept exact so that, for example, 19.99 is
+// a multiple of 0.01.
+type schemaNum struct {
+	rat  *big.Rat
+	text string
+}
+
+// schemaNumber reads a number keyword.
+func schemaNumber(v interface{}, ptr string) (*schemaNum, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return nil, schemaErrorf(ptr, "must be a number")
+	}
+	r, ok := exactNumber(n)
+	if !ok {
+		return nil, schemaErrorf(ptr, "must be a number between 1e-%d and 1e%d", maxExponent, maxExponent)
+	}
+	return &schemaNum{rat: r, text: n.String()}, nil
+}
+
+// maxExponent bounds the numbers that are compared exactly, so that a
+// message cannot make the server build a huge number from 1e999999999.
+const maxExponent = 1000
+
+// decimal splits a JSON number into a sign, its significant digits without
+// leading or trailing zeros, and a power of ten.
+func decimal(n json.Number) (neg bool, digits string, exp int, ok bool) {
+	s := n.String()
+	if strings.HasPrefix(s, "-") {
+		neg, s = true, s[1:]
+	}
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.Atoi(strings.TrimPrefix(s[i+1:], "+"))
+		if err != nil {
+			return false, "", 0, false
+		}
+		exp, s = e, s[:i]
+	}
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		exp -= len(s) - i - 1
+		s = s[:i] + s[i+1:]
+	}
+	s = strings.TrimLeft(s, "0")
+	trimmed := strings.TrimRight(s, "0")
+	exp += len(s) - len(trimmed)
+	if len(trimmed) == 0 {
+		return false, "0", 0, true
+	}
+	return neg, trimmed, exp, true
+}
+
+// exactNumber converts a JSON number to a big.Rat. It returns false for a
+// number too large or too precise to compare exactly.
+func exactNumber(n json.Number) (*big.Rat, bool) {
+	neg, digits, exp, ok := decimal(n)
+	if !ok || exp > maxExponent || exp < -maxExponent || len(digits) > maxExponent {
+		return nil, false
+	}
+	num, _ := new(big.Int).SetString(digits, 10)
+	if neg {
+		num.Neg(num)
+	}
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(exp))), nil)
+	if exp < 0 {
+		return new(big.Rat).SetFrac(num, pow), true
+	}
+	return new(big.Rat).SetInt(num.Mul(num, pow)), true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// escapePointer escapes a reference token for a JSON Pointer.
+func escapePointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
+
+// canonicalJSON encodes a decoded value so that equal JSON values encode
+// the same way.
+func canonicalJSON(v interface{}) string {
+	data, _ := json.Marshal(canonicalValue(v))
+	return string(data)
+}
+
+func canonicalValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		// Equal numbers have the same digits and exponent, however they
+		// are written, without rounding large integers as float64 does.
+		neg, digits, exp, ok := decimal(v)
+		if !ok {
+			return v
+		}
+		if neg {
+			digits = "-" + digits
+		}
+		return json.Number(digits + "e" + strconv.Itoa(exp))
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = canonicalValue(item)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = canonicalValue(item)
+		}
+		return out
+	}
+	return v
+}
+
+// jsonType returns the JSON Schema type of a decoded value. Numbers are
+// "number" even if they are integers.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case json.Number:
+		return "number"
+	}
+	return "string"
+}
+
+// valid returns true if v matches the schema, without recording why not.
+func (n *schemaNode) valid(v interface{}) bool {
+	e := &SchemaError{}
+	n.validate(v, "", e)
+	return len(e.Violations) == 0
+}
+
+// validate checks v, found at path in the message, against the schema,
+// adding any violations to e.
+func (n *schemaNode) validate(v interface{}, path string, e *SchemaError) {
+	if n.always != nil {
+		if !*n.always {
+			e.add(path, "is not allowed")
+		}
+		return
+	}
+	if n.refNode != nil {
+		n.refNode.validate(v, path, e)
+	}
+
+	if len(n.types) > 0 && !n.hasType(v) {
+		e.add(path, "must be of type %s", strings.Join(n.types, " or "))
+		// Other checks would only repeat this.
+		return
+	}
+	if n.enum != nil {
+		c := canonicalJSON(v)
+		found := false
+		for _, item := range n.enum {
+			found = found || item == c
+		}
+		if !found {
+			e.add(path, "must be one of the values in enum")
+		}
+	}
+	if n.konst != nil && canonicalJSON(v) != *n.konst {
+		e.add(path, "must be %s", *n.konst)
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		n.validateObject(v, path, e)
+	case []interface{}:
+		n.validateArray(v, path, e)
+	case json.Number:
+		n.validateNumber(v, path, e)
+	case string:
+		n.validateString(v, path, e)
+	}
+
+	for _, sub := range n.allOf {
+		sub.validate(v, path, e)
+	}
+	if n.anyOf != nil {
+		matched := false
+		for _, sub := range n.anyOf {
+			if sub.valid(v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			e.add(path, "must match at least one schema in anyOf")
+		}
+	}
+	if n.oneOf != nil {
+		matched := 0
+		for _, sub := range n.oneOf {
+			if sub.valid(v) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			e.add(path, "must match exactly one schema in oneOf, but matches %d", matched)
+		}
+	}
+	if n.not != nil && n.not.valid(v) {
+		e.add(path, "must not match the schema in not")
+	}
+}
+
+func (n *schemaNode) hasType(v interface{}) bool {
+	t := jsonType(v)
+	for _, want := range n.types {
+		if want == t {
+			return true
+		}
+		if want == "integer" && t == "number" {
+			// 1.0 and 1e3 are integers too.
+			if _, _, exp, ok := decimal(v.(json.Number)); ok && exp >= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (n *schemaNode) validateObject(obj map[string]interface{}, path string, e *SchemaError) {
+	for _, name := range n.required {
+		if _, ok := obj[name]; !ok {
+			e.add(path, "is missing required property %q", name)
+		}
+	}
+	if n.minProps >= 0 && len(obj) < n.minProps {
+		e.add(path, "must have at least %d properties", n.minProps)
+	}
+	if n.maxProps >= 0 && len(obj) > n.maxProps {
+		e.add(path, "must have at most %d properties", n.maxProps)
+	}
+
+	// Check properties in order, so that errors are predictable.
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sub, ok := n.properties[name]
+		if !ok {
+			sub = n.additional
+		}
+		if sub != nil {
+			sub.validate(obj[name], path+"/"+escapePointer(name), e)
+		}
+	}
+}
+
+func (n *schemaNode) validateArray(list []interface{}, path string, e *SchemaError) {
+	if n.minItems >= 0 && len(list) < n.minItems {
+		e.add(path, "must have at least %d items", n.minItems)
+	}
+	if n.maxItems >= 0 && len(list) > n.maxItems {
+		e.add(path, "must have at most %d items", n.maxItems)
+	}
+	if n.uniqueItems {
+		seen := map[string]bool{}
+		for _, item := range list {
+			c := canonicalJSON(item)
+			if seen[c] {
+				e.add(path, "must not have duplicate items")
+				break
+			}
+			seen[c] = true
+		}
+	}
+	if n.items != nil {
+		for i, item := range list {
+			n.items.validate(item, path+"/"+strconv.Itoa(i), e)
+		}
+	}
+}
+
+func (n *schemaNode) validateNumber(num json.Number, path string, e *SchemaError) {
+	if n.minimum == nil && n.maximum == nil && n.exclMin == nil && n.exclMax == nil && n.multipleOf == nil {
+		return
+	}
+	r, ok := exactNumber(num)
+	if !ok {
+		e.add(path, "must be between 1e-%d and 1e%d to be checked", maxExponent, maxExponent)
+		return
+	}
+	if n.minimum != nil && r.Cmp(n.minimum.rat) < 0 {
+		e.add(path, "must be at least %s", n.minimum.text)
+	}
+	if n.maximum != nil && r.Cmp(n.maximum.rat) > 0 {
+		e.add(path, "must be at most %s", n.maximum.text)
+	}
+	if n.exclMin != nil && r.Cmp(n.exclMin.rat) <= 0 {
+		e.add(path, "must be greater than %s", n.exclMin.text)
+	}
+	if n.exclMax != nil && r.Cmp(n.exclMax.rat) >= 0 {
+		e.add(path, "must be less than %s", n.exclMax.text)
+	}
+	if n.multipleOf != nil {
+		if q := new(big.Rat).Quo(r, n.multipleOf.rat); !q.IsInt() {
+			e.add(path, "must be a multiple of %s", n.multipleOf.text)
+		}
+	}
+}
+
+func (n *schemaNode) validateString(s, path string, e *SchemaError) {
+	length := utf8.RuneCountInString(s)
+	if n.minLength >= 0 && length < n.minLength {
+		e.add(path, "must be at least %d characters long", n.minLength)
+	}
+	if n.maxLength >= 0 && length > n.maxLength {
+		e.add(path, "must be at most %d characters long", n.maxLength)
+	}
+	if n.pattern != nil && !n.pattern.MatchString(s) {
+		e.add(path, "must match the pattern %q", n.pattern.String())
+	}
+}
+
+// SetSchema adds a new version of a topic's JSON Schema.
+//
+// The request body is the schema. If it is the same as the topic's latest
+// schema, no new version is added. The response is a JSON object with the
+// topic and the version. Every message published to the topic from then on
+// must match the schema, unless the publisher asks for an older version
+// with X-Schema-Version.
+//
+// Params:
+// 	- topic (string): The topic.
+// 	- body ([]byte): The JSON Schema.
+//
+// Returns:
+// 	- *Schema
+func SetSchema(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	res := c.Get("http.ResponseWriter", nil).(http.ResponseWriter)
+	name := p.Get("topic", "").(string)
+	body := p.Get("body", []byte{}).([]byte)
+
+	medium, err := getMedium(c)
+	if err != nil {
+		return nil, &cookoo.FatalError{Message: "No medium."}
+	}
+	t, ok := medium.Topic(name)
+	if !ok {
+		http.Error(res, fmt.Sprintf("No topic named %s.", name), http.StatusNotFound)
+		return nil, nil
+	}
+	s, err := ParseSchema(body)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return nil, nil
+	}
+	s = t.AddSchema(s)
+	httputil.Logger(c).Infof("Topic %s has schema version %d.", name, s.Version())
+	return s, writeJSON(res, http.StatusOK, schemaInfo(name, s))
+}
+
+// GetSchema writes a version of a topic's JSON Schema.
+//
+// The "version" query parameter selects the version. The default is the
+// latest.
+//
+// Params:
+// 	- topic (string): The topic.
+//
+// Returns:
+// 	- *Schema
+func GetSchema(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	req := c.Get("http.Request", nil).(*http.Request)
+	res := c.Get("http.ResponseWriter", nil).(http.ResponseWriter)
+	name := p.Get("topic", "").(string)
+
+	medium, err := getMedium(c)
+	if err != nil {
+		return nil, &cookoo.FatalError{Message: "No medium."}
+	}
+	version := 0
+	if v := req.URL.Query().Get("version"); len(v) > 0 {
+		if version, err = strconv.Atoi(v); err != nil || version < 1 {
+			http.Error(res, fmt.Sprintf("Invalid version %q", v), http.StatusBadRequest)
+			return nil, nil
+		}
+	}
+
+	t, ok := medium.Topic(name)
+	if !ok {
+		http.Error(res, fmt.Sprintf("No topic named %s.", name), http.StatusNotFound)
+		return nil, nil
+	}
+	s := t.Schema(version)
+	if s == nil {
+		http.Error(res, fmt.Sprintf("Topic %s has no schema version %d.", name, version), http.StatusNotFound)
+		return nil, nil
+	}
+	return s, writeJSON(res, http.StatusOK, schemaInfo(name, s))
+}
+
+// SchemaInfo describes a version of a topic's schema.
+type SchemaInfo struct {
+	Topic   string          `json:"topic"`
+	Version int             `json:"version"`
+	Schema  json.RawMessage `json:"schema"`
+}
+
+func schemaInfo(topic string, s *Schema) SchemaInfo {
+	return SchemaInfo{Topic: topic, Version: s.Version(), Schema: s.JSON()}
+}
+
+// validateMessage checks a message published to t against the schema
+// version the publisher asked for, or the latest. It returns a
+// *SchemaError if the message does not match, or the version does not
+// exist.
+func validateMessage(t Topic, msg []byte, version int) error {
+	s := t.Schema(version)
+	if s == nil {
+		if version == 0 {
+			return nil
+		}
+		return &SchemaError{Topic: t.Name(), Version: version, Violations: []SchemaViolation{
+			{Message: fmt.Sprintf("cannot be checked, because topic %s has no schema version %d", t.Name(), version)},
+		}}
+	}
+	err := s.Validate(msg)
+	if se, ok := err.(*SchemaError); ok {
+		se.Topic = t.Name()
+		rejectedTotal.Inc(t.Name())
+	}
+	return err
+}
+
+// rejectMessage sends an HTTP 422 describing why a message does not match a
+// schema, if there is a response to write to.
+//
+// It returns an Interrupt that stops the route.
+func rejectMessage(c cookoo.Context, err *SchemaError) cookoo.Interrupt {
+	if res, ok := c.Get("http.ResponseWriter", nil).(http.ResponseWriter); ok {
+		writeJSON(res, http.StatusUnprocessableEntity, struct {
+			Error string `json:"error"`
+			*SchemaError
+		}{err.Error(), err})
+	}
+	return &cookoo.Stop{}
+}
@@ -0,0 +1,302 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/cookoo"
+)
+
+const orderSchema = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"title": "Order",
+	"type": "object",
+	"required": ["id", "total"],
+	"properties": {
+		"id": {"type": "string", "pattern": "^o-[0-9]+$"},
+		"total": {"type": "number", "minimum": 0},
+		"items": {
+			"type": "array",
+			"minItems": 1,
+			"items": {"$ref": "#/$defs/item"}
+		},
+		"status": {"enum": ["new", "paid", "shipped"]}
+	},
+	"additionalProperties": false,
+	"$defs": {
+		"item": {
+			"type": "object",
+			"required": ["sku"],
+			"properties": {
+				"sku": {"type": "string", "minLength": 3},
+				"qty": {"type": "integer", "exclusiveMinimum": 0}
+			}
+		}
+	}
+}`
+
+func TestSchemaValidate(t *testing.T) {
+	s, err := ParseSchema([]byte(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := []string{
+		`{"id":"o-1","total":10}`,
+		`{"id":"o-2","total":0,"status":"paid","items":[{"sku":"abc","qty":2.0}]}`,
+	}
+	for _, msg := range valid {
+		if err := s.Validate([]byte(msg)); err != nil {
+			t.Errorf("Expected %s to be valid, got %s", msg, err)
+		}
+	}
+
+	invalid := map[string][]SchemaViolation{
+		`{"id":"o-1"}`:                      {{"", `is missing required property "total"`}},
+		`{"id":7,"total":-1}`:               {{"/id", "must be of type string"}, {"/total", "must be at least 0"}},
+		`{"id":"x","total":1,"extra":true}`: {{"/extra", "is not allowed"}, {"/id", `must match the pattern "^o-[0-9]+$"`}},
+		`{"id":"o-1","total":1,"items":[]}`: {{"/items", "must have at least 1 items"}},
+		`{"id":"o-1","total":1,"status":"lost","items":[{"sku":"a","qty":1.5}]}`: {
+			{"/items/0/qty", "must be of type integer"},
+			{"/items/0/sku", "must be at least 3 characters long"},
+			{"/status", "must be one of the values in enum"},
+		},
+		`[1, 2]`:   {{"", "must be of type object"}},
+		`not json`: nil,
+	}
+	for msg, expect := range invalid {
+		err := s.Validate([]byte(msg))
+		se, ok := err.(*SchemaError)
+		if !ok {
+			t.Errorf("Expected a SchemaError for %s, got %v", msg, err)
+			continue
+		}
+		if expect == nil {
+			if len(se.Violations) != 1 || !strings.HasPrefix(se.Violations[0].Message, "is not valid JSON") {
+				t.Errorf("Expected invalid JSON for %s, got %v", msg, se.Violations)
+			}
+			continue
+		}
+		if len(se.Violations) != len(expect) {
+			t.Errorf("Expected %v for %s, got %v", expect, msg, se.Violations)
+			continue
+		}
+		for i, v := range se.Violations {
+			if v != expect[i] {
+				t.Errorf("Expected %v for %s, got %v", expect[i], msg, v)
+			}
+		}
+	}
+}
+
+func TestSchemaCombinators(t *testing.T) {
+	tests := []struct {
+		schema, msg string
+		valid       bool
+	}{
+		{`true`, `"anything"`, true},
+		{`false`, `"anything"`, false},
+		{`{"type":["string","null"]}`, `null`, true},
+		{`{"type":["string","null"]}`, `1`, false},
+		{`{"const":{"a":[1,2]}}`, `{"a":[1.0,2]}`, true},
+		{`{"uniqueItems":true}`, `[1,"1",1.0]`, false},
+		{`{"multipleOf":0.5}`, `2.5`, true},
+		{`{"multipleOf":0.5}`, `2.25`, false},
+		{`{"multipleOf":0.01}`, `19.99`, true},
+		{`{"multipleOf":0.01}`, `4.35`, true},
+		{`{"multipleOf":0.1}`, `0.3`, true},
+		{`{"multipleOf":0.01}`, `19.999`, false},
+		{`{"type":"integer"}`, `1e3`, true},
+		{`{"type":"integer"}`, `1.5e1`, true},
+		{`{"type":"integer"}`, `1.25e1`, false},
+		{`{"maximum":9007199254740992}`, `9007199254740993`, false},
+		{`{"const":9007199254740993}`, `9007199254740992`, false},
+		{`{"const":9007199254740993}`, `9007199254740993.0`, true},
+		{`{"enum":[12345678901234567890]}`, `12345678901234567891`, false},
+		{`{"uniqueItems":true}`, `[9007199254740992,9007199254740993]`, true},
+		{`{"minimum":0}`, `1e999999999`, false},
+		{`{"anyOf":[{"type":"string"},{"minimum":5}]}`, `6`, true},
+		{`{"anyOf":[{"type":"string"},{"minimum":5}]}`, `4`, false},
+		{`{"oneOf":[{"type":"integer"},{"minimum":5}]}`, `6`, false},
+		{`{"oneOf":[{"type":"integer"},{"minimum":5}]}`, `5.5`, true},
+		{`{"not":{"type":"null"}}`, `null`, false},
+		{`{"allOf":[{"minLength":2},{"maxLength":3}]}`, `"abcd"`, false},
+		{`{"additionalProperties":{"type":"integer"},"maxProperties":2}`, `{"a":1,"b":2}`, true},
+		{`{"additionalProperties":{"type":"integer"},"maxProperties":2}`, `{"a":"x"}`, false},
+		{`{"items":{"$ref":"#"},"type":["array","integer"]}`, `[1,[2,[3]]]`, true},
+		{`{"items":{"$ref":"#"},"type":["array","integer"]}`, `[1,[2,["3"]]]`, false},
+		{`{"format":"email","description":"Not checked."}`, `"nope"`, true},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchema([]byte(tt.schema))
+		if err != nil {
+			t.Errorf("Failed to parse %s: %s", tt.schema, err)
+			continue
+		}
+		if err := s.Validate([]byte(tt.msg)); (err == nil) != tt.valid {
+			t.Errorf("Expected %s valid=%t against %s, got %v", tt.msg, tt.valid, tt.schema, err)
+		}
+	}
+}
+
+func TestParseSchemaErrors(t *testing.T) {
+	bad := map[string]string{
+		`{"type":`:                             "not valid JSON",
+		`[]`:                                   "must be an object or a boolean",
+		`{"type":"decimal"}`:                   "unknown type",
+		`{"properties":{"a":{"minimum":"1"}}}`: "/properties/a/minimum",
+		`{"pattern":"(?=x)"}`:                  "/pattern",
+		`{"if":{"type":"string"}}`:             `keyword "if" is not supported`,
+		`{"$ref":"other.json"}`:                "only $ref to a JSON Pointer",
+		`{"$ref":"#/$defs/missing"}`:           "points to nothing",
+		`{"minItems":-1}`:                      "non-negative integer",
+		`{"multipleOf":0}`:                     "greater than 0",
+		`{"anyOf":[]}`:                         "non-empty array",
+		`{"allOf":[{"$ref":"#"}]}`:             "refers back to itself",
+	}
+	for schema, expect := range bad {
+		_, err := ParseSchema([]byte(schema))
+		if err == nil {
+			t.Errorf("Expected %s to be invalid", schema)
+			continue
+		}
+		if !strings.Contains(err.Error(), expect) {
+			t.Errorf("Expected an error about %q for %s, got %s", expect, schema, err)
+		}
+	}
+}
+
+func TestAddSchema(t *testing.T) {
+	topic := NewHistoriedTopic("test", 5)
+	if topic.Schema(0) != nil {
+		t.Error("Expected no schema.")
+	}
+	v1, _ := ParseSchema([]byte(`{"type": "string"}`))
+	v2, _ := ParseSchema([]byte(`{"type": "number"}`))
+
+	if s := topic.AddSchema(v1); s.Version() != 1 {
+		t.Errorf("Expected version 1, got %d", s.Version())
+	}
+	// The same schema, formatted differently, is not a new version.
+	same, _ := ParseSchema([]byte(`{"type":"string"}`))
+	if s := topic.AddSchema(same); s.Version() != 1 {
+		t.Errorf("Expected version 1 again, got %d", s.Version())
+	}
+	if s := topic.AddSchema(v2); s.Version() != 2 {
+		t.Errorf("Expected version 2, got %d", s.Version())
+	}
+	if v1.Version() != 0 {
+		t.Error("Expected the parsed schema to be left alone.")
+	}
+
+	if s := topic.Schema(0); s == nil || s.Version() != 2 {
+		t.Errorf("Expected the latest to be version 2, got %v", s)
+	}
+	if s := topic.Schema(1); s == nil || string(s.JSON()) != `{"type":"string"}` {
+		t.Errorf("Expected version 1, got %v", s)
+	}
+	if topic.Schema(3) != nil {
+		t.Error("Expected no version 3.")
+	}
+}
+
+func TestPublishSchema(t *testing.T) {
+	reg, router, cxt := cookoo.Cookoo()
+	medium := NewMedium()
+	cxt.AddDatasource(MediumDS, medium)
+
+	reg.Route("create", "Test route").
+		Does(CreateTopic, "topic").Using("topic").WithDefault("test").Using("descriptor").From("cxt:descriptor")
+	reg.Route("publish", "Test route").
+		Does(Publish, "res").Using("topic").WithDefault("test").Using("message").From("cxt:message")
+	reg.Route("set", "Test route").
+		Does(SetSchema, "schema").Using("topic").WithDefault("test").Using("body").From("cxt:descriptor")
+	reg.Route("get", "Test route").
+		Does(GetSchema, "schema").Using("topic").WithDefault("test")
+
+	do := func(route, header, value string, body string) *mockResponseWriter {
+		req, _ := http.NewRequest("POST", "https://localhost/v1/t/test", nil)
+		if len(header) > 0 {
+			req.Header.Set(header, value)
+		}
+		res := &mockResponseWriter{}
+		cxt.Put("http.Request", req)
+		cxt.Put("http.ResponseWriter", res)
+		cxt.Put("descriptor", []byte(body))
+		cxt.Put("message", []byte(body))
+		if err := router.HandleRequest(route, cxt, true); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res := do("create", "", "", `{"schema": {"type": "object"`); res.code != http.StatusBadRequest {
+		t.Errorf("Expected a 400 for a bad descriptor, got %d", res.code)
+	}
+	if _, ok := medium.Topic("test"); ok {
+		t.Error("Expected no topic to be created from a bad descriptor.")
+	}
+	do("create", "", "", `{"schema": {"type": "object", "required": ["id"]}}`)
+	topic, _ := medium.Topic("test")
+
+	if res := do("publish", "", "", `{"id": 1}`); res.code != 0 && res.code != http.StatusOK {
+		t.Errorf("Expected a valid message to be published, got %d", res.code)
+	}
+	res := do("publish", "", "", `{"name": "x"}`)
+	if res.code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected a 422, got %d", res.code)
+	}
+	se := SchemaError{}
+	if err := json.Unmarshal(res.Buf(), &se); err != nil {
+		t.Fatal(err)
+	}
+	if se.Topic != "test" || se.Version != 1 || len(se.Violations) != 1 {
+		t.Errorf("Expected one violation of version 1, got %+v", se)
+	}
+
+	res = do("set", "", "", `{"type": "string"}`)
+	info := SchemaInfo{}
+	if err := json.Unmarshal(res.Buf(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 2 {
+		t.Errorf("Expected version 2, got %d", info.Version)
+	}
+	if res := do("publish", "", "", `{"id": 2}`); res.code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected an object to fail version 2, got %d", res.code)
+	}
+	if res := do("publish", XSchemaVersion, "1", `{"id": 2}`); res.code == http.StatusUnprocessableEntity {
+		t.Errorf("Expected an object to pass version 1: %s", res.String())
+	}
+	if res := do("publish", XSchemaVersion, "9", `"text"`); res.code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a 422 for a missing version, got %d", res.code)
+	}
+	if res := do("publish", XSchemaVersion, "x", `"text"`); res.code != http.StatusBadRequest {
+		t.Errorf("Expected a 400 for a bad version, got %d", res.code)
+	}
+	// Clearing the retained message is not checked.
+	if res := do("publish", XMessageRetain, "true", ``); res.code == http.StatusUnprocessableEntity {
+		t.Errorf("Expected an empty retained message to pass: %s", res.String())
+	}
+	if got := len(topic.(HistoriedTopic).Last(10)); got != 2 {
+		t.Errorf("Expected 2 messages published, got %d", got)
+	}
+
+	res = do("get", "", "", "")
+	if err := json.Unmarshal(res.Buf(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 2 || string(info.Schema) != `{"type":"string"}` {
+		t.Errorf("Expected version 2, got %+v", info)
+	}
+	req, _ := http.NewRequest("GET", "https://localhost/v1/t/test/schema?version=3", nil)
+	res = &mockResponseWriter{}
+	cxt.Put("http.Request", req)
+	cxt.Put("http.ResponseWriter", res)
+	router.HandleRequest("get", cxt, true)
+	if res.code != http.StatusNotFound {
+		t.Errorf("Expected a 404 for a missing version, got %d", res.code)
+	}
+}
@@ -1,6 +1,7 @@
 package pubsub
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"math"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	"github.com/Masterminds/cookoo"
+	"github.com/technosophos/drift/logging"
 )
 
 // ResponseWriterFlusher handles both HTTP response writing and flushing.
@@ -21,6 +23,10 @@ type ResponseWriterFlusher interface {
 	http.CloseNotifier
 }
 
+// MaxMessageBytes is the largest message that can be published to any
+// topic. A topic can set a lower limit of its own. Zero is unlimited.
+var MaxMessageBytes int64 = 1 << 20
+
 // Topic is the main channel for sending messages to subscribers.
 //
 // A publisher is anything that sends a message to a Topic. All
@@ -28,6 +34,16 @@ type ResponseWriterFlusher interface {
 type Topic interface {
 	// Publish sends a message to all subscribers.
 	Publish([]byte) error
+	// PublishRetained sends a message to all subscribers, and keeps it as
+	// the retained message, which is delivered first to every new
+	// subscription. An empty message clears the retained message.
+	PublishRetained([]byte) error
+	// PublishWith sends a message to all subscribers whose filters match
+	// its metadata. Options that only apply to history are ignored by
+	// topics without history.
+	PublishWith([]byte, PublishOptions) error
+	// Retained returns the retained message, if there is one.
+	Retained() ([]byte, bool)
 	// Subscribe attaches a subscription to this topic.
 	Subscribe(*Subscription)
 	// Unsubscribe detaches a subscription from the topic.
@@ -36,6 +52,27 @@ type Topic interface {
 	Name() string
 	// Subscribers returns a list of subscriptions attached to this topic.
 	Subscribers() []*Subscription
+	// LastActive returns when a message was last published to the topic,
+	// or a subscriber last joined or left.
+	LastActive() time.Time
+	// Ephemeral returns true if the topic is deleted when its last
+	// subscriber leaves.
+	Ephemeral() bool
+	// SetEphemeral marks the topic as ephemeral, or not.
+	SetEphemeral(bool)
+	// Schema returns a version of the topic's schema, or the latest if the
+	// version is 0. It returns nil if there is no such version.
+	Schema(version int) *Schema
+	// MaxMessageBytes returns the topic's own limit on the size of a
+	// message, or 0 if it has none. See messageLimit.
+	MaxMessageBytes() int64
+	// SetMaxMessageBytes sets the topic's own limit on the size of a
+	// message. Zero removes it.
+	SetMaxMessageBytes(int64)
+	// AddSchema makes a schema the latest version of the topic's schema,
+	// and returns it with its version set. If it is the same as the latest
+	// version, that version is returned instead.
+	AddSchema(*Schema) *Schema
 	// Close and destroy the topic.
 	Close() error
 }
@@ -52,6 +89,45 @@ type History interface {
 type HistoriedTopic interface {
 	History
 	Topic
+	// SetMaxAge sets how long messages are kept in history. Zero means
+	// messages do not expire by age.
+	SetMaxAge(time.Duration)
+	// SetMaxBytes sets the most bytes of messages kept in history. Zero
+	// means no limit.
+	SetMaxBytes(int64)
+	// Expire removes expired messages from history, returning how many
+	// were removed.
+	Expire() int
+	// SetCompact turns key-based compaction on or off.
+	SetCompact(bool)
+	// Compacted returns true if the history is compacted.
+	Compacted() bool
+	// Range returns the records that match a query, oldest first, and
+	// whether more records matched than the query's limit allowed.
+	Range(HistoryQuery) ([]Record, bool)
+	// Import adds a record to the end of the history, keeping its
+	// timestamp and metadata.
+	Import(Record) error
+	// SubscribeWithHistory attaches a subscription, and returns the
+	// retained message and the history selected by the query function,
+	// with no gap or overlap between the history and what the subscription
+	// receives.
+	SubscribeWithHistory(*Subscription, func(History) [][]byte) ([]byte, [][]byte)
+}
+
+// PublishOptions control how a published message is kept in history.
+type PublishOptions struct {
+	// TTL is how long the message stays in history. Zero means the message
+	// does not expire on its own.
+	TTL time.Duration
+	// Key identifies what the message is about. In a compacted history, a
+	// message replaces the previous message with the same key, and an empty
+	// message with a key (a tombstone) deletes the key.
+	Key string
+	// Retain makes the message the topic's retained message.
+	Retain bool
+	// Meta is metadata that subscribers can filter the message by.
+	Meta Metadata
 }
 
 // NewTopic creates a new Topic with no history capabilities.
@@ -59,7 +135,9 @@ func NewTopic(name string) Topic {
 	ct := &channeledTopic{
 		name:        name,
 		subscribers: make(map[uint64]*Subscription, 512), // Sane default space?
+		stats:       newTopicStats(name),
 	}
+	ct.touch()
 	return ct
 }
 
@@ -71,10 +149,23 @@ func NewHistoriedTopic(name string, length int) HistoriedTopic {
 }
 
 type channeledTopic struct {
+	// active is the UNIX time in nanoseconds of the last activity. It is
+	// only accessed atomically.
+	active      int64
+	ephemeral   bool
 	name        string
 	subscribers map[uint64]*Subscription
 	mx          sync.RWMutex
 	closed      bool
+	retained    []byte
+	// retainedMeta is the metadata of the retained message.
+	retainedMeta Metadata
+	// schemas holds every version of the topic's schema, oldest first.
+	schemas []*Schema
+	// maxMessage is the topic's own message size limit.
+	maxMessage int64
+	// stats are the topic's series of the per-topic counters.
+	stats topicStats
 }
 
 func (t *channeledTopic) Close() error {
@@ -85,44 +176,127 @@ func (t *channeledTopic) Close() error {
 	}
 	t.subscribers = map[uint64]*Subscription{}
 	t.mx.Unlock()
+	forgetTopic(t.name)
 	return nil
 }
 
 func (t *channeledTopic) Publish(msg []byte) error {
+	return t.publish(msg, false, nil)
+}
+
+func (t *channeledTopic) PublishRetained(msg []byte) error {
+	return t.publish(msg, true, nil)
+}
+
+func (t *channeledTopic) PublishWith(msg []byte, opts PublishOptions) error {
+	return t.publish(msg, opts.Retain, opts.Meta)
+}
+
+func (t *channeledTopic) Retained() ([]byte, bool) {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+	return t.retained, t.retained != nil
+}
+
+// publish sends a message to every subscriber whose filter matches meta,
+// optionally retaining it.
+//
+// The retained message is replaced under the same lock as the fan-out, so
+// a new subscriber sees either the old retained message and then msg, or
+// only msg.
+func (t *channeledTopic) publish(msg []byte, retain bool, meta Metadata) error {
 	if t.closed {
 		return errors.New("Topic is being deleted.")
 	}
+	start := time.Now()
 	t.mx.Lock()
+	if retain {
+		if len(msg) == 0 {
+			// Clearing the retained message does not publish anything.
+			t.retained = nil
+			t.retainedMeta = nil
+			t.mx.Unlock()
+			return nil
+		}
+		t.retained = msg
+		t.retainedMeta = meta
+	}
+	t.touch()
+
+	// Metrics are counted here and recorded once the lock is released, so
+	// that fan-out on one topic does not wait on the metrics of others.
+	var delivered, dropped, filtered float64
+	depths := make([]float64, 0, len(t.subscribers))
 	defer func() {
 		t.mx.Unlock()
 		if err := recover(); err != nil {
-			fmt.Printf("Recovered from failed publish. Some messages probably didn't get through. %s\n", err)
+			dropped++
+			t.log().Errorf("Recovered from failed publish. Some messages probably didn't get through. %s", err)
 		}
+		t.stats.published.Inc()
+		t.stats.delivered.Add(delivered)
+		t.stats.dropped.Add(dropped)
+		t.stats.filtered.Add(filtered)
+		queueDepth.ObserveAll(depths)
+		fanoutLatency.Observe(time.Since(start).Seconds())
 	}()
 
 	for _, s := range t.subscribers {
 		if s.Queue == nil {
-			fmt.Printf("Channel appears to be closed. Skipping.\n")
+			dropped++
+			t.log().Warnf("Channel appears to be closed. Skipping.")
+			continue
+		}
+		if !s.filter.Match(meta) {
+			filtered++
 			continue
 		}
 		//fmt.Printf("Sending msg to subscriber %d: %s\n", s.Id, msg)
+		depths = append(depths, float64(len(s.Queue)))
+		if s.lossy {
+			select {
+			case s.Queue <- msg:
+				delivered++
+			default:
+				dropped++
+			}
+			continue
+		}
 		s.Queue <- msg
+		delivered++
 	}
 	//fmt.Printf("Message sent.\n")
 	return nil
 }
 
+// Subscribe attaches a subscription.
+//
+// If the topic has already been closed, the subscription is closed, so that
+// a subscriber that raced with the deletion of the topic does not wait
+// forever.
 func (t *channeledTopic) Subscribe(s *Subscription) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
 	if t.closed {
+		s.SetCloseReason(CloseDeleted)
+		s.Close()
 		return
 	}
-	t.mx.Lock()
-	defer t.mx.Unlock()
+	t.touch()
 	//t.subscribers = append(t.subscribers, s)
 	if _, ok := t.subscribers[s.Id]; ok {
-		fmt.Printf("Surprisingly got the same ID as an existing subscriber.")
+		t.log().Warnf("Surprisingly got the same ID as an existing subscriber.")
 	}
 	t.subscribers[s.Id] = s
+	subscriberGauge.Set(float64(len(t.subscribers)), t.name)
+	if t.retained != nil && !s.skipRetained && s.filter.Match(t.retainedMeta) {
+		select {
+		case s.Queue <- t.retained:
+			t.stats.delivered.Inc()
+		default:
+			t.stats.dropped.Inc()
+		}
+	}
 	//fmt.Printf("There are now %d subscribers", len(t.subscribers))
 }
 
@@ -132,7 +306,82 @@ func (t *channeledTopic) Unsubscribe(s *Subscription) {
 	}
 	t.mx.Lock()
 	defer t.mx.Unlock()
+	t.touch()
 	delete(t.subscribers, s.Id)
+	subscriberGauge.Set(float64(len(t.subscribers)), t.name)
+}
+
+// touch records activity on the topic.
+func (t *channeledTopic) touch() {
+	atomic.StoreInt64(&t.active, time.Now().UnixNano())
+}
+
+func (t *channeledTopic) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.active))
+}
+
+func (t *channeledTopic) Ephemeral() bool {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+	return t.ephemeral
+}
+
+func (t *channeledTopic) SetEphemeral(on bool) {
+	t.mx.Lock()
+	t.ephemeral = on
+	t.mx.Unlock()
+}
+
+func (t *channeledTopic) MaxMessageBytes() int64 {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+	return t.maxMessage
+}
+
+func (t *channeledTopic) SetMaxMessageBytes(n int64) {
+	t.mx.Lock()
+	t.maxMessage = n
+	t.mx.Unlock()
+}
+
+// messageLimit returns the largest message that can be published to t: the
+// lower of MaxMessageBytes and the topic's own limit. It returns 0 if
+// neither is set.
+func messageLimit(t Topic) int64 {
+	max := MaxMessageBytes
+	if n := t.MaxMessageBytes(); n > 0 && (max <= 0 || n < max) {
+		max = n
+	}
+	return max
+}
+
+func (t *channeledTopic) Schema(version int) *Schema {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+	if version == 0 {
+		version = len(t.schemas)
+	}
+	if version < 1 || version > len(t.schemas) {
+		return nil
+	}
+	return t.schemas[version-1]
+}
+
+func (t *channeledTopic) AddSchema(s *Schema) *Schema {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if n := len(t.schemas); n > 0 && bytes.Equal(t.schemas[n-1].raw, s.raw) {
+		return t.schemas[n-1]
+	}
+	v := *s
+	v.version = len(t.schemas) + 1
+	t.schemas = append(t.schemas, &v)
+	return &v
+}
+
+// log returns a logger tagged with the topic name.
+func (t *channeledTopic) log() *logging.Logger {
+	return logging.Default.With(logging.Fields{"topic": t.name})
 }
 
 func (t *channeledTopic) Name() string {
@@ -157,6 +406,26 @@ type Subscription struct {
 	Id     uint64
 	Writer ResponseWriterFlusher
 	Queue  chan []byte
+	closer sync.Once
+	// closed is set, atomically, by Close.
+	closed int32
+	// skipRetained is set when the retained message was already sent.
+	skipRetained bool
+	// reason holds the string passed to SetCloseReason.
+	reason atomic.Value
+	// framed is set when the subscriber asked for a framed stream, with
+	// control events as well as messages.
+	framed bool
+	// heartbeat is how often Listen sends a heartbeat on a framed stream.
+	heartbeat time.Duration
+	// filter selects the messages sent to the subscriber. Nil sends all of
+	// them.
+	filter *Filter
+	// view filters and projects JSON messages as they are sent.
+	view *JSONView
+	// lossy is set for subscribers that drop messages when their queue is
+	// full, rather than make the publisher wait.
+	lossy bool
 }
 
 // NewSubscription creates a new subscription.
@@ -175,28 +444,119 @@ func NewSubscription(r ResponseWriterFlusher) *Subscription {
 // Listen copies messages fromt the Queue into the Writer.
 //
 // It listens on the Queue unless the `stop` channel receives a message.
+// When the Queue is closed, anything still buffered in it is written out
+// before Listen returns. This is how subscriptions are drained on shutdown.
+//
+// On a framed stream, Listen also sends a heartbeat event every heartbeat
+// interval, and a lag event when the Queue fills past half way.
 func (s *Subscription) Listen(stop <-chan bool) {
-	// s.Queue <- []byte("SUBSCRIBED")
+	var tick <-chan time.Time
+	if s.framed && s.heartbeat > 0 {
+		t := time.NewTicker(s.heartbeat)
+		defer t.Stop()
+		tick = t.C
+	}
+	lagging := false
 	for {
-		//for msg := range s.Queue {
 		select {
-		case msg := <-s.Queue:
-			//fmt.Printf("Forwarding message.\n")
+		case msg, ok := <-s.Queue:
+			if !ok {
+				return
+			}
 			// Queue is always serial, and this should be the only writer to the
 			// RequestWriter, so we don't explicitly sync right now.
-			s.Writer.Write(msg)
-			s.Writer.Flush()
+			if msg, ok = s.view.Apply(msg); ok {
+				writeMessage(s.Writer, msg, s.framed)
+			}
+			if !s.framed {
+				continue
+			}
+			// Warn once each time the subscriber falls behind.
+			if n := len(s.Queue); n == 0 {
+				lagging = false
+			} else if !lagging && n >= cap(s.Queue)/2 {
+				lagging = true
+				writeEvent(s.Writer, Event{Type: EventLag, Count: n})
+			}
+		case <-tick:
+			writeEvent(s.Writer, Event{Type: EventHeartbeat})
 		case <-stop:
-			//fmt.Printf("Subscription ended.\n")
 			return
-		default:
 		}
 	}
 }
 
+// ReplayBufferLen is the most live messages buffered for a subscriber
+// while its history is replayed. If more arrive, the subscriber is sent
+// what was buffered, and then its stream is ended with CloseOverflow, so
+// that it knows to resubscribe rather than miss messages unawares.
+var ReplayBufferLen = 1000
+
+// hold drains the Queue into a buffer until the returned function is
+// called, which returns the buffered messages in order, and false if the
+// buffer overflowed and later messages were dropped.
+//
+// It is used while history is written to a subscriber that is already
+// attached, so that a slow subscriber cannot fill its Queue and hold up
+// publishers before Listen starts.
+func (s *Subscription) hold(topic string) func() ([][]byte, bool) {
+	stop := make(chan struct{})
+	done := make(chan [][]byte)
+	complete := true
+	go func() {
+		var buf [][]byte
+		defer func() { done <- buf }()
+		for {
+			select {
+			case msg, ok := <-s.Queue:
+				if !ok {
+					return
+				}
+				if len(buf) >= ReplayBufferLen {
+					complete = false
+					droppedTotal.Inc(topic)
+					continue
+				}
+				buf = append(buf, msg)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() ([][]byte, bool) {
+		close(stop)
+		buf := <-done
+		return buf, complete
+	}
+}
+
+// SetCloseReason records why the subscription is about to be closed by the
+// server, such as CloseDeleted. The reason is sent to the subscriber when
+// its stream ends.
+func (s *Subscription) SetCloseReason(reason string) {
+	s.reason.Store(reason)
+}
+
+// CloseReason returns the reason set with SetCloseReason, if any.
+func (s *Subscription) CloseReason() string {
+	r, _ := s.reason.Load().(string)
+	return r
+}
+
 // Close closes things and cleans up.
+//
+// It is safe to call Close more than once.
 func (s *Subscription) Close() {
-	close(s.Queue)
+	s.closer.Do(func() {
+		atomic.StoreInt32(&s.closed, 1)
+		close(s.Queue)
+	})
+}
+
+// isClosed returns true once Close has been called. Messages still in the
+// Queue may be read after that.
+func (s *Subscription) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
 }
 
 // getMedium fetches the Medium from the Datasources list.
@@ -211,7 +571,7 @@ func getMedium(c cookoo.Context) (*Medium, error) {
 // NewMedium creates and initializes a Medium.
 func NewMedium() *Medium {
 	return &Medium{
-		topics: make(map[string]Topic, 256), // Premature optimization...
+		topics: newRegistry(registryShards),
 	}
 }
 
@@ -219,39 +579,244 @@ func NewMedium() *Medium {
 //
 // You should always create one with NewMedium or else you will not be able
 // to add new topics.
+//
+// Topics are kept in a sharded registry, so that looking up, creating, and
+// deleting topics scales to large numbers of short-lived topics. mx guards
+// everything else.
 type Medium struct {
-	topics map[string]Topic
-	mx     sync.RWMutex
+	topics   *registry
+	mx       sync.RWMutex
+	store    HistoryStore
+	checks   map[string]HealthChecker
+	webhooks map[uint64]*Webhook
+	closing  bool
+	gcStop   chan bool
+	// idleTimeout is how long a topic may go unused before it is deleted.
+	idleTimeout time.Duration
+	// manualCreate disallows creating topics implicitly.
+	manualCreate bool
 }
 
 // Topic gets a Topic by name.
 //
 // If no topic is found, the ok flag will return false.
 func (m *Medium) Topic(name string) (Topic, bool) {
-	m.mx.RLock()
-	defer m.mx.RUnlock()
-	t, ok := m.topics[name]
-	return t, ok
+	return m.topics.get(name)
 }
 
 // Add a new Topic to the Medium.
+//
+// It replaces any existing topic of the same name. Use FetchOrCreate to
+// add a topic only if it does not exist.
 func (m *Medium) Add(t Topic) {
-	m.mx.Lock()
-	m.topics[t.Name()] = t
-	m.mx.Unlock()
+	m.topics.put(t)
+}
+
+// FetchOrCreate gets a Topic by name, calling create to make it if it does
+// not exist.
+//
+// This is atomic: when many clients race to use a new topic, create is
+// called once, and they all get the same topic. The create function must not
+// call back into the Medium's topic methods. The created flag is true if
+// the topic was created.
+func (m *Medium) FetchOrCreate(name string, create func(name string) Topic) (t Topic, created bool) {
+	return m.topics.getOrCreate(name, create)
 }
 
-// Delete closes a topic and removes it.
+// Delete removes a topic and closes it.
+//
+// The topic is removed first, so that no new subscriber can find it once
+// it starts closing. Subscribers are told that the topic was deleted.
 func (m *Medium) Delete(name string) error {
-	t, ok := m.topics[name]
+	t, ok := m.topics.remove(name)
 	if !ok {
 		return fmt.Errorf("Cannot delete. No topic named %s.", name)
 	}
-	t.Close()
+	closeTopic(t, CloseDeleted)
+	return nil
+}
+
+// closeTopic closes a topic, telling its subscribers why.
+func closeTopic(t Topic, reason string) error {
+	for _, s := range t.Subscribers() {
+		s.SetCloseReason(reason)
+	}
+	return t.Close()
+}
+
+// SetAutoCreate sets whether publishing or subscribing to a topic that does
+// not exist creates it. This is on by default.
+//
+// With it off, topics must be created explicitly, so that a typo in a topic
+// name is an error instead of a new topic.
+func (m *Medium) SetAutoCreate(on bool) {
 	m.mx.Lock()
-	delete(m.topics, name)
+	m.manualCreate = !on
 	m.mx.Unlock()
-	return nil
+}
+
+// AutoCreate returns true if topics are created implicitly.
+func (m *Medium) AutoCreate() bool {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	return !m.manualCreate
+}
+
+// SetIdleTimeout sets how long a topic may go without subscribers or
+// publishes before ExpireTopics deletes it. Zero, the default, keeps topics
+// until they are deleted explicitly.
+func (m *Medium) SetIdleTimeout(d time.Duration) {
+	m.mx.Lock()
+	m.idleTimeout = d
+	m.mx.Unlock()
+}
+
+// ExpireTopics deletes every topic that has had no subscribers and no
+// publishes for longer than the idle timeout.
+//
+// It returns the number of topics deleted.
+func (m *Medium) ExpireTopics() int {
+	m.mx.RLock()
+	timeout := m.idleTimeout
+	m.mx.RUnlock()
+	if timeout <= 0 {
+		return 0
+	}
+
+	cutoff := time.Now().Add(-timeout)
+	n := 0
+	for _, t := range m.topics.all() {
+		if m.removeIf(t, CloseExpired, func(t Topic) bool { return t.LastActive().Before(cutoff) }) {
+			logging.Default.Infof("Deleted idle topic %s.", t.Name())
+			n++
+		}
+	}
+	return n
+}
+
+// release deletes an ephemeral topic if it has no subscribers left.
+//
+// It is called whenever a subscriber leaves a topic.
+func (m *Medium) release(t Topic) {
+	if !t.Ephemeral() {
+		return
+	}
+	if m.removeIf(t, CloseDeleted, func(Topic) bool { return true }) {
+		logging.Default.Debugf("Deleted ephemeral topic %s.", t.Name())
+	}
+}
+
+// removeIf deletes a topic if it has no subscribers and f returns true.
+//
+// It returns true if the topic was deleted. The check is atomic with
+// respect to other changes to the Medium's topics. The reason is given to
+// any subscriber that joins while the topic is being closed.
+func (m *Medium) removeIf(t Topic, reason string, f func(Topic) bool) bool {
+	_, ok := m.topics.removeIf(t.Name(), func(cur Topic) bool {
+		return cur == t && len(t.Subscribers()) == 0 && f(t)
+	})
+	if ok {
+		closeTopic(t, reason)
+	}
+	return ok
+}
+
+// SetHistoryStore attaches a durable backend for topic history.
+//
+// History is written to the store when the Medium is shut down.
+func (m *Medium) SetHistoryStore(s HistoryStore) {
+	m.mx.Lock()
+	m.store = s
+	m.mx.Unlock()
+}
+
+// Closing returns true once Shutdown has been called.
+func (m *Medium) Closing() bool {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	return m.closing
+}
+
+// Shutdown stops the Medium from accepting new subscriptions and closes
+// every topic.
+//
+// Closing a topic closes its subscriptions' queues, so each subscriber
+// receives whatever was already queued before its stream ends, and is then
+// told that the server is shutting down. If a
+// HistoryStore is attached, the history of every HistoriedTopic is saved
+// before the topic is closed. The first error encountered while saving
+// history is returned, but all topics are closed regardless.
+func (m *Medium) Shutdown() error {
+	m.mx.Lock()
+	m.closing = true
+	if m.gcStop != nil {
+		close(m.gcStop)
+		m.gcStop = nil
+	}
+	store := m.store
+	m.mx.Unlock()
+	topics := m.topics.all()
+
+	var first error
+	for _, t := range topics {
+		if h, ok := t.(HistoriedTopic); ok && store != nil {
+			if err := store.Store(t.Name(), h); err != nil && first == nil {
+				first = fmt.Errorf("Failed to store history for %s: %s", t.Name(), err)
+			}
+		}
+		closeTopic(t, CloseShutdown)
+	}
+	return first
+}
+
+// ExpireHistory removes expired messages from the history of every topic.
+//
+// It returns the total number of messages removed.
+func (m *Medium) ExpireHistory() int {
+	n := 0
+	for _, t := range m.topics.all() {
+		if h, ok := t.(HistoriedTopic); ok {
+			n += h.Expire()
+		}
+	}
+	return n
+}
+
+// CollectHistory calls ExpireHistory and ExpireTopics every interval in
+// the background, until the Medium is shut down.
+//
+// Calling it again replaces the previous collector. An interval of zero
+// stops collection.
+func (m *Medium) CollectHistory(interval time.Duration) {
+	stop := make(chan bool)
+	m.mx.Lock()
+	if m.gcStop != nil {
+		close(m.gcStop)
+		m.gcStop = nil
+	}
+	if interval > 0 {
+		m.gcStop = stop
+	}
+	m.mx.Unlock()
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				if n := m.ExpireHistory(); n > 0 {
+					logging.Default.Debugf("Expired %d history messages.", n)
+				}
+				m.ExpireTopics()
+			case <-stop:
+				return
+			}
+		}
+	}()
 }
 
 var lastSubId uint64 = 0
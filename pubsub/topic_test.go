@@ -94,6 +94,91 @@ func TestTopic(t *testing.T) {
 
 }
 
+func TestMediumShutdown(t *testing.T) {
+	medium := NewMedium()
+	store := &mockHistoryStore{stored: map[string][][]byte{}}
+	medium.SetHistoryStore(store)
+
+	topic := NewHistoriedTopic("test", 5)
+	medium.Add(topic)
+
+	rw := &mockResponseWriter{}
+	sub := NewSubscription(rw)
+	topic.Subscribe(sub)
+
+	topic.Publish([]byte("hi"))
+	topic.Publish([]byte("there"))
+
+	if err := medium.Shutdown(); err != nil {
+		t.Errorf("Error shutting down: %s", err)
+	}
+	if !medium.Closing() {
+		t.Error("Expected medium to be closing.")
+	}
+
+	// Listen should drain the queue and then return on its own.
+	done := make(chan bool)
+	go func() {
+		sub.Listen(make(chan bool))
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Listen did not return after the queue was closed.")
+	}
+
+	if rw.String() != "hithere" {
+		t.Errorf("Expected queued messages 'hithere', got '%s'", rw.String())
+	}
+
+	// Closing an already closed subscription must not panic.
+	sub.Close()
+
+	if h := string(bytes.Join(store.stored["test"], []byte(""))); h != "hithere" {
+		t.Errorf("Expected stored history 'hithere', got '%s'", h)
+	}
+}
+
+func TestRetained(t *testing.T) {
+	for _, topic := range []Topic{NewTopic("plain"), NewHistoriedTopic("historied", 5)} {
+		if _, ok := topic.Retained(); ok {
+			t.Errorf("%s: Expected no retained message.", topic.Name())
+		}
+		topic.PublishRetained([]byte("one"))
+		topic.Publish([]byte("not retained"))
+		topic.PublishRetained([]byte("two"))
+
+		sub := NewSubscription(&mockResponseWriter{})
+		topic.Subscribe(sub)
+		if msg := <-sub.Queue; string(msg) != "two" {
+			t.Errorf("%s: Expected retained message first, got %s", topic.Name(), msg)
+		}
+		topic.Publish([]byte("three"))
+		if msg := <-sub.Queue; string(msg) != "three" {
+			t.Errorf("%s: Expected three, got %s", topic.Name(), msg)
+		}
+
+		// A subscriber that was already sent the retained message does not
+		// get it twice.
+		skip := NewSubscription(&mockResponseWriter{})
+		skip.skipRetained = true
+		topic.Subscribe(skip)
+		if len(skip.Queue) != 0 {
+			t.Errorf("%s: Expected an empty queue, got %d messages", topic.Name(), len(skip.Queue))
+		}
+
+		// An empty retained message clears it without publishing.
+		topic.PublishRetained([]byte{})
+		if _, ok := topic.Retained(); ok {
+			t.Errorf("%s: Expected the retained message to be cleared.", topic.Name())
+		}
+		if len(sub.Queue) != 0 {
+			t.Errorf("%s: Expected clearing not to publish.", topic.Name())
+		}
+	}
+}
+
 func BenchmarkTopic1Client(b *testing.B) {
 	benchmarkTopic(1, b.N)
 }
@@ -144,6 +229,7 @@ type mockResponseWriter struct {
 	headers http.Header
 	writer  bytes.Buffer
 	mx      sync.Mutex
+	code    int
 }
 
 func (r *mockResponseWriter) Header() http.Header {
@@ -168,6 +254,7 @@ func (r *mockResponseWriter) String() string {
 	return r.writer.String()
 }
 func (r *mockResponseWriter) WriteHeader(c int) {
+	r.code = c
 }
 
 func (r *mockResponseWriter) Flush() {}
@@ -176,6 +263,15 @@ func (r *mockResponseWriter) CloseNotify() <-chan bool {
 	return make(chan bool, 1)
 }
 
+type mockHistoryStore struct {
+	stored map[string][][]byte
+}
+
+func (s *mockHistoryStore) Store(name string, h History) error {
+	s.stored[name] = h.Last(DefaultMaxHistory)
+	return nil
+}
+
 // For benchmarking.
 type nilResponseWriter struct {
 	headers http.Header
@@ -195,3 +291,65 @@ func (r *nilResponseWriter) Write(d []byte) (int, error) {
 func (r *nilResponseWriter) WriteHeader(c int) {}
 
 func (r *nilResponseWriter) Flush() {}
+
+func TestExpireTopics(t *testing.T) {
+	medium := NewMedium()
+	if n := medium.ExpireTopics(); n != 0 {
+		t.Errorf("Expected no expiry without a timeout, got %d", n)
+	}
+	medium.SetIdleTimeout(20 * time.Millisecond)
+
+	idle := NewHistoriedTopic("idle", 5)
+	busy := NewTopic("busy")
+	watched := NewTopic("watched")
+	for _, topic := range []Topic{idle, busy, watched} {
+		medium.Add(topic)
+	}
+	watched.Subscribe(NewSubscription(&mockResponseWriter{}))
+
+	time.Sleep(30 * time.Millisecond)
+	busy.Publish([]byte("hi"))
+
+	if n := medium.ExpireTopics(); n != 1 {
+		t.Errorf("Expected 1 topic to expire, got %d", n)
+	}
+	if _, ok := medium.Topic("idle"); ok {
+		t.Error("Expected the idle topic to be deleted.")
+	}
+	for _, name := range []string{"busy", "watched"} {
+		if _, ok := medium.Topic(name); !ok {
+			t.Errorf("Expected %s to be kept.", name)
+		}
+	}
+}
+
+func TestEphemeralTopic(t *testing.T) {
+	medium := NewMedium()
+	topic := NewTopic("test")
+	topic.SetEphemeral(true)
+	medium.Add(topic)
+
+	one := NewSubscription(&mockResponseWriter{})
+	two := NewSubscription(&mockResponseWriter{})
+	topic.Subscribe(one)
+	topic.Subscribe(two)
+
+	topic.Unsubscribe(one)
+	medium.release(topic)
+	if _, ok := medium.Topic("test"); !ok {
+		t.Fatal("Expected the topic to be kept while it has a subscriber.")
+	}
+
+	topic.Unsubscribe(two)
+	medium.release(topic)
+	if _, ok := medium.Topic("test"); ok {
+		t.Error("Expected the topic to be deleted with its last subscriber.")
+	}
+
+	// A subscriber that raced with the deletion is closed right away.
+	late := NewSubscription(&mockResponseWriter{})
+	topic.Subscribe(late)
+	if _, ok := <-late.Queue; ok {
+		t.Error("Expected the late subscription to be closed.")
+	}
+}
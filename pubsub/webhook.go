@@ -0,0 +1,532 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Masterminds/cookoo"
+	"github.com/technosophos/drift/httputil"
+	"github.com/technosophos/drift/logging"
+)
+
+const (
+	// XDriftTopic is sent with each webhook delivery to name the topic.
+	XDriftTopic = "X-Drift-Topic"
+	// XDriftTimestamp is the UNIX time at which a webhook delivery was signed.
+	XDriftTimestamp = "X-Drift-Timestamp"
+	// XDriftSignature is the HMAC-SHA256 signature of a webhook delivery.
+	//
+	// The value is "sha256=" followed by the hex-encoded HMAC of the
+	// timestamp, a period, and the message body, keyed by the webhook secret.
+	XDriftSignature = "X-Drift-Signature"
+)
+
+var (
+	// DefaultWebhookRetries is how many times a delivery is retried.
+	DefaultWebhookRetries = 5
+	// DefaultWebhookBackoff is the delay before the first retry. It doubles
+	// with each retry, up to MaxWebhookBackoff.
+	DefaultWebhookBackoff = 500 * time.Millisecond
+	// MaxWebhookBackoff caps the delay between retries.
+	MaxWebhookBackoff = time.Minute
+	// DefaultWebhookMaxFailures is how many deliveries in a row may fail
+	// before the webhook is disabled.
+	DefaultWebhookMaxFailures = 10
+	// WebhookQueueLen is the queue depth of a webhook subscription. When
+	// the queue is full, new messages are dropped for that webhook rather
+	// than holding up the topic.
+	WebhookQueueLen = 100
+	// WebhookTimeout limits each delivery attempt, so that a hung endpoint
+	// cannot stall its webhook forever.
+	WebhookTimeout = 10 * time.Second
+	// WebhookDenyPrivate refuses webhooks to loopback, private, link-local
+	// and unspecified addresses, such as a cloud metadata service. The
+	// address is checked for every connection, after the host name has
+	// been resolved, so a name cannot be pointed somewhere private later.
+	WebhookDenyPrivate = false
+)
+
+// webhookTransport is shared by every webhook. It checks the address of
+// each connection against WebhookDenyPrivate.
+var webhookTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return checkWebhookIP(net.ParseIP(host))
+		},
+	}).DialContext
+	return t
+}()
+
+// checkWebhookIP returns an error if WebhookDenyPrivate forbids ip.
+func checkWebhookIP(ip net.IP) error {
+	if !WebhookDenyPrivate || ip == nil {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("Webhooks to private address %s are not allowed.", ip)
+	}
+	return nil
+}
+
+// Webhook is a push subscription that POSTs each message on a topic to a URL.
+//
+// A Webhook is an ordinary Subscription whose Writer delivers messages over
+// HTTP, so topics treat it like any other subscriber. Each delivery is
+// retried with exponential backoff. Messages that arrive while the queue is
+// full are dropped, as are the messages still queued when the webhook is
+// detached or its topic is closed. After MaxFailures deliveries in a row
+// have failed, the Webhook disables itself and leaves the topic.
+type Webhook struct {
+	URL         string
+	Secret      string
+	Retries     int
+	Backoff     time.Duration
+	MaxFailures int
+	Client      *http.Client
+
+	topic   string
+	sub     *Subscription
+	header  http.Header
+	stop    chan bool
+	onClose func()
+	// ctx is cancelled by Detach, which ends a delivery in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mx        sync.Mutex
+	failures  int
+	delivered uint64
+	disabled  bool
+}
+
+// NewWebhook creates a Webhook with the default retry settings.
+func NewWebhook(target, secret string) *Webhook {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Webhook{
+		URL:         target,
+		Secret:      secret,
+		Retries:     DefaultWebhookRetries,
+		Backoff:     DefaultWebhookBackoff,
+		MaxFailures: DefaultWebhookMaxFailures,
+		Client:      &http.Client{Timeout: WebhookTimeout, Transport: webhookTransport},
+		header:      http.Header{},
+		stop:        make(chan bool, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Id returns the ID of the webhook's subscription. It is 0 until attached.
+func (w *Webhook) Id() uint64 {
+	if w.sub == nil {
+		return 0
+	}
+	return w.sub.Id
+}
+
+// Attach subscribes the webhook to a topic and starts delivering messages.
+func (w *Webhook) Attach(t Topic) {
+	w.topic = t.Name()
+	w.sub = &Subscription{
+		Id:     newSubId(),
+		Writer: w,
+		Queue:  make(chan []byte, WebhookQueueLen),
+		// A slow endpoint must never block publishers.
+		lossy: true,
+	}
+	t.Subscribe(w.sub)
+	go func() {
+		w.sub.Listen(w.stop)
+		t.Unsubscribe(w.sub)
+		// Whatever is still queued is dropped.
+		if n := len(w.sub.Queue); n > 0 {
+			droppedTotal.Add(float64(n), w.topic)
+		}
+		w.sub.Close()
+		if w.onClose != nil {
+			w.onClose()
+		}
+	}()
+}
+
+// Detach stops deliveries and removes the webhook from its topic. Messages
+// still queued for the webhook are dropped.
+func (w *Webhook) Detach() {
+	w.cancel()
+	select {
+	case w.stop <- true:
+	default:
+	}
+}
+
+// Disabled returns true if the webhook disabled itself after repeated failures.
+func (w *Webhook) Disabled() bool {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return w.disabled
+}
+
+// Header returns the extra headers sent with every delivery.
+func (w *Webhook) Header() http.Header {
+	return w.header
+}
+
+// Write delivers a single message, retrying as necessary.
+func (w *Webhook) Write(msg []byte) (int, error) {
+	if w.stopped() {
+		droppedTotal.Inc(w.topic)
+		return 0, errors.New("Webhook detached.")
+	}
+	log := logging.Default.With(logging.Fields{"topic": w.topic, "webhook": w.Id()})
+	backoff := w.Backoff
+	var err error
+	for attempt := 0; attempt <= w.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-w.ctx.Done():
+				droppedTotal.Inc(w.topic)
+				return 0, errors.New("Webhook detached during retry.")
+			}
+			if w.stopped() {
+				droppedTotal.Inc(w.topic)
+				return 0, errors.New("Webhook detached during retry.")
+			}
+			backoff *= 2
+			if backoff > MaxWebhookBackoff {
+				backoff = MaxWebhookBackoff
+			}
+		}
+		if err = w.deliver(msg); err == nil {
+			w.mx.Lock()
+			w.failures = 0
+			w.delivered++
+			w.mx.Unlock()
+			return len(msg), nil
+		}
+		log.Warnf("Webhook delivery to %s failed (attempt %d): %s", w.URL, attempt+1, err)
+	}
+
+	w.mx.Lock()
+	w.failures++
+	if w.MaxFailures > 0 && w.failures >= w.MaxFailures && !w.disabled {
+		w.disabled = true
+		log.Errorf("Disabling webhook to %s after %d failed deliveries.", w.URL, w.failures)
+		w.Detach()
+	}
+	w.mx.Unlock()
+	return 0, err
+}
+
+// stopped returns true once the webhook has been detached, or its topic
+// closed, so that queued messages are dropped rather than delivered.
+func (w *Webhook) stopped() bool {
+	return w.ctx.Err() != nil || (w.sub != nil && w.sub.isClosed())
+}
+
+// deliver makes a single delivery attempt.
+func (w *Webhook) deliver(msg []byte) error {
+	req, err := http.NewRequestWithContext(w.ctx, "POST", w.URL, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	for k, vv := range w.header {
+		for _, v := range vv {
+			req.Header.Add(k, v)
+		}
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(XDriftTopic, w.topic)
+	req.Header.Set(XDriftTimestamp, ts)
+	if len(w.Secret) > 0 {
+		req.Header.Set(XDriftSignature, Sign(w.Secret, ts, msg))
+	}
+
+	res, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+// Sign computes the XDriftSignature value for a webhook delivery.
+func Sign(secret, timestamp string, msg []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(msg)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WriteHeader is a no-op. Webhook deliveries have no response to write.
+func (w *Webhook) WriteHeader(int) {}
+
+// Flush is a no-op. Every Write is delivered immediately.
+func (w *Webhook) Flush() {}
+
+// CloseNotify returns a channel that never fires. Webhooks are stopped with
+// Detach.
+func (w *Webhook) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+// WebhookInfo describes a webhook to API clients.
+type WebhookInfo struct {
+	Id          uint64 `json:"id"`
+	Topic       string `json:"topic"`
+	URL         string `json:"url"`
+	Retries     int    `json:"retries"`
+	Backoff     string `json:"backoff"`
+	MaxFailures int    `json:"maxFailures"`
+	Failures    int    `json:"failures"`
+	Delivered   uint64 `json:"delivered"`
+	Disabled    bool   `json:"disabled"`
+}
+
+// Info returns a description of the webhook. The secret is never included.
+func (w *Webhook) Info() WebhookInfo {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return WebhookInfo{
+		Id:          w.Id(),
+		Topic:       w.topic,
+		URL:         w.URL,
+		Retries:     w.Retries,
+		Backoff:     w.Backoff.String(),
+		MaxFailures: w.MaxFailures,
+		Failures:    w.failures,
+		Delivered:   w.delivered,
+		Disabled:    w.disabled,
+	}
+}
+
+// AddWebhook attaches a webhook to a topic and tracks it in the Medium.
+//
+// The webhook is forgotten when it is removed or its topic is deleted. A
+// webhook that disabled itself is kept, so that it can be inspected, until
+// it is removed.
+func (m *Medium) AddWebhook(t Topic, w *Webhook) {
+	w.onClose = func() {
+		defer m.release(t)
+		if w.Disabled() {
+			return
+		}
+		m.mx.Lock()
+		delete(m.webhooks, w.Id())
+		m.mx.Unlock()
+	}
+	// Hold the lock while attaching, so that onClose cannot run before the
+	// webhook has been added.
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	w.Attach(t)
+	if m.webhooks == nil {
+		m.webhooks = map[uint64]*Webhook{}
+	}
+	m.webhooks[w.Id()] = w
+}
+
+// Webhooks returns the webhooks attached to the named topic.
+func (m *Medium) Webhooks(topic string) []*Webhook {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	hooks := []*Webhook{}
+	for _, w := range m.webhooks {
+		if w.topic == topic {
+			hooks = append(hooks, w)
+		}
+	}
+	return hooks
+}
+
+// RemoveWebhook detaches a webhook from its topic.
+func (m *Medium) RemoveWebhook(topic string, id uint64) error {
+	m.mx.Lock()
+	w, ok := m.webhooks[id]
+	if ok && w.topic == topic {
+		delete(m.webhooks, id)
+	}
+	m.mx.Unlock()
+	if !ok || w.topic != topic {
+		return fmt.Errorf("No webhook %d on topic %s.", id, topic)
+	}
+	w.Detach()
+	return nil
+}
+
+// webhookRequest is the JSON body used to create a webhook.
+type webhookRequest struct {
+	URL         string `json:"url"`
+	Secret      string `json:"secret"`
+	Retries     *int   `json:"retries"`
+	Backoff     string `json:"backoff"`
+	MaxFailures *int   `json:"maxFailures"`
+}
+
+// CreateWebhook registers a webhook push subscription on a topic.
+//
+// The request body is a JSON object with a "url" and optionally a
+// "secret", "retries", "backoff" (a duration such as "500ms"), and
+// "maxFailures". The topic is created if it does not exist, unless the
+// Medium does not allow implicit creation. The new webhook is described in
+// the JSON response.
+//
+// Params:
+// 	- topic (string): The topic to subscribe to.
+// 	- body ([]byte): The JSON webhook description.
+//
+// Returns:
+// 	- *Webhook
+func CreateWebhook(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	res := c.Get("http.ResponseWriter", nil).(http.ResponseWriter)
+	name := p.Get("topic", "").(string)
+	body := p.Get("body", []byte{}).([]byte)
+
+	medium, err := getMedium(c)
+	if err != nil {
+		return nil, &cookoo.FatalError{Message: "No medium."}
+	}
+	if len(name) == 0 {
+		http.Error(res, "Topic name required.", http.StatusBadRequest)
+		return nil, nil
+	}
+
+	w, err := parseWebhook(body)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return nil, nil
+	}
+
+	t, ok := implicitTopic(c, medium, name, true)
+	if !ok {
+		return nil, nil
+	}
+	medium.AddWebhook(t, w)
+	httputil.Logger(c).Infof("Added webhook %d to %s for topic %s.", w.Id(), w.URL, name)
+
+	return w, writeJSON(res, http.StatusCreated, w.Info())
+}
+
+// ListWebhooks writes a JSON list of the webhooks on a topic.
+//
+// Params:
+// 	- topic (string): The topic.
+//
+// Returns:
+// 	- []*Webhook
+func ListWebhooks(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	res := c.Get("http.ResponseWriter", nil).(http.ResponseWriter)
+	name := p.Get("topic", "").(string)
+
+	medium, err := getMedium(c)
+	if err != nil {
+		return nil, &cookoo.FatalError{Message: "No medium."}
+	}
+
+	hooks := medium.Webhooks(name)
+	info := make([]WebhookInfo, len(hooks))
+	for i, w := range hooks {
+		info[i] = w.Info()
+	}
+	return hooks, writeJSON(res, http.StatusOK, info)
+}
+
+// DeleteWebhook removes a webhook from a topic.
+//
+// Params:
+// 	- topic (string): The topic.
+// 	- id (string): The webhook ID.
+//
+// Returns:
+//
+func DeleteWebhook(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	res := c.Get("http.ResponseWriter", nil).(http.ResponseWriter)
+	name := p.Get("topic", "").(string)
+	id, err := strconv.ParseUint(p.Get("id", "").(string), 10, 64)
+	if err != nil {
+		http.Error(res, "Invalid webhook ID.", http.StatusBadRequest)
+		return nil, nil
+	}
+
+	medium, err := getMedium(c)
+	if err != nil {
+		return nil, &cookoo.FatalError{Message: "No medium."}
+	}
+
+	if err := medium.RemoveWebhook(name, id); err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+	}
+	return nil, nil
+}
+
+// parseWebhook builds a Webhook from a JSON request body.
+func parseWebhook(body []byte) (*Webhook, error) {
+	req := &webhookRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, fmt.Errorf("Could not parse webhook: %s", err)
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("Webhook URL must be an absolute http or https URL: %q", req.URL)
+	}
+	// Host names are checked when they are resolved, on delivery.
+	if err := checkWebhookIP(net.ParseIP(u.Hostname())); err != nil {
+		return nil, err
+	}
+
+	w := NewWebhook(req.URL, req.Secret)
+	if req.Retries != nil {
+		if *req.Retries < 0 {
+			return nil, errors.New("retries cannot be negative")
+		}
+		w.Retries = *req.Retries
+	}
+	if req.MaxFailures != nil {
+		w.MaxFailures = *req.MaxFailures
+	}
+	if len(req.Backoff) > 0 {
+		d, err := time.ParseDuration(req.Backoff)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid backoff %q", req.Backoff)
+		}
+		w.Backoff = d
+	}
+	return w, nil
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(res http.ResponseWriter, code int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(code)
+	_, err = res.Write(data)
+	return err
+}
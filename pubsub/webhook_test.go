@@ -0,0 +1,229 @@
+package pubsub
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	got := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got <- r
+		bodies <- b
+	}))
+	defer srv.Close()
+
+	medium := NewMedium()
+	topic := NewTopic("test")
+	medium.Add(topic)
+
+	hook := NewWebhook(srv.URL, "s3cr3t")
+	medium.AddWebhook(topic, hook)
+	if hook.Id() == 0 {
+		t.Fatal("Expected the webhook to have an ID.")
+	}
+	if n := len(medium.Webhooks("test")); n != 1 {
+		t.Fatalf("Expected 1 webhook, got %d", n)
+	}
+
+	topic.Publish([]byte("hello"))
+
+	select {
+	case r := <-got:
+		body := <-bodies
+		if string(body) != "hello" {
+			t.Errorf("Expected hello, got %q", body)
+		}
+		if r.Header.Get(XDriftTopic) != "test" {
+			t.Errorf("Expected topic header, got %q", r.Header.Get(XDriftTopic))
+		}
+		sig := Sign("s3cr3t", r.Header.Get(XDriftTimestamp), body)
+		if r.Header.Get(XDriftSignature) != sig {
+			t.Errorf("Expected signature %s, got %s", sig, r.Header.Get(XDriftSignature))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for delivery.")
+	}
+
+	if err := medium.RemoveWebhook("test", hook.Id()); err != nil {
+		t.Fatal(err)
+	}
+	if err := medium.RemoveWebhook("test", hook.Id()); err == nil {
+		t.Error("Expected an error removing a missing webhook.")
+	}
+}
+
+func TestWebhookDisable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	medium := NewMedium()
+	topic := NewTopic("test")
+	medium.Add(topic)
+
+	hook := NewWebhook(srv.URL, "")
+	hook.Retries = 1
+	hook.Backoff = time.Millisecond
+	hook.MaxFailures = 2
+	medium.AddWebhook(topic, hook)
+
+	topic.Publish([]byte("one"))
+	topic.Publish([]byte("two"))
+
+	for i := 0; i < 200 && len(topic.Subscribers()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !hook.Disabled() {
+		t.Fatal("Expected the webhook to be disabled.")
+	}
+	if len(topic.Subscribers()) != 0 {
+		t.Errorf("Expected the webhook to leave the topic.")
+	}
+	info := hook.Info()
+	if info.Failures != 2 || !info.Disabled {
+		t.Errorf("Unexpected webhook info: %+v", info)
+	}
+	if n := len(medium.Webhooks("test")); n != 1 {
+		t.Errorf("Expected the disabled webhook to still be listed, got %d", n)
+	}
+}
+
+func TestWebhookHungEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	medium := NewMedium()
+	topic := NewTopic("hung")
+	medium.Add(topic)
+	hook := NewWebhook(srv.URL, "")
+	hook.Retries = 0
+	medium.AddWebhook(topic, hook)
+
+	// A full webhook queue must drop messages, not block the publisher.
+	dropped := droppedTotal.Value("hung")
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < WebhookQueueLen+10; i++ {
+			topic.Publish([]byte("m"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Publishing blocked on a hung webhook.")
+	}
+	if droppedTotal.Value("hung") <= dropped {
+		t.Error("Expected messages to be dropped for the webhook.")
+	}
+	if hook.Client.Timeout == 0 {
+		t.Error("Expected webhook deliveries to time out.")
+	}
+	hook.Detach()
+}
+
+func TestParseWebhook(t *testing.T) {
+	w, err := parseWebhook([]byte(`{"url": "http://example.com/hook", "retries": 2, "backoff": "1s"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Retries != 2 || w.Backoff != time.Second || w.MaxFailures != DefaultWebhookMaxFailures {
+		t.Errorf("Unexpected webhook: %+v", w)
+	}
+
+	bad := []string{
+		`{"url": "/relative"}`,
+		`{"url": "ftp://example.com"}`,
+		`{"url": "http://example.com", "retries": -1}`,
+		`{"url": "http://example.com", "backoff": "soon"}`,
+		`not json`,
+	}
+	for _, b := range bad {
+		if _, err := parseWebhook([]byte(b)); err == nil {
+			t.Errorf("Expected an error for %s", b)
+		}
+	}
+}
+
+func TestWebhookDenyPrivate(t *testing.T) {
+	defer func(on bool) { WebhookDenyPrivate = on }(WebhookDenyPrivate)
+	WebhookDenyPrivate = true
+
+	for _, u := range []string{"http://127.0.0.1/hook", "http://169.254.169.254/", "http://[::1]:80/", "https://10.0.0.1/"} {
+		if _, err := parseWebhook([]byte(`{"url": "` + u + `"}`)); err == nil {
+			t.Errorf("Expected %s to be refused.", u)
+		}
+	}
+	if _, err := parseWebhook([]byte(`{"url": "https://example.com/hook"}`)); err != nil {
+		t.Errorf("Expected a public host name to be allowed, got %s", err)
+	}
+
+	// A name that resolves to a private address is refused on delivery.
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer srv.Close()
+	hook := NewWebhook(strings.Replace(srv.URL, "127.0.0.1", "localhost", 1), "")
+	if err := hook.deliver([]byte("m")); err == nil || atomic.LoadInt32(&hits) != 0 {
+		t.Errorf("Expected delivery to localhost to be refused, got %v", err)
+	}
+}
+
+func TestWebhookDropQueue(t *testing.T) {
+	stops := map[string]func(m *Medium, h *Webhook){
+		"detach": func(m *Medium, h *Webhook) { h.Detach() },
+		"delete": func(m *Medium, h *Webhook) { m.Delete(h.topic) },
+	}
+	for name, stop := range stops {
+		var hits int32
+		release := make(chan struct{})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}))
+
+		medium := NewMedium()
+		topic := NewTopic("drop-" + name)
+		medium.Add(topic)
+		hook := NewWebhook(srv.URL, "")
+		hook.Retries = 0
+		medium.AddWebhook(topic, hook)
+		for i := 0; i < 10; i++ {
+			topic.Publish([]byte("m"))
+		}
+		for atomic.LoadInt32(&hits) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		// The first delivery is stuck. The other nine are dropped, not
+		// delivered once it is released.
+		dropped := droppedTotal.Value(topic.Name())
+		stop(medium, hook)
+		close(release)
+		time.Sleep(100 * time.Millisecond)
+		if n := atomic.LoadInt32(&hits); n != 1 {
+			t.Errorf("%s: expected queued messages to be dropped, got %d deliveries", name, n)
+		}
+		if name == "detach" && droppedTotal.Value(topic.Name()) < dropped+9 {
+			t.Errorf("%s: expected the queued messages to be counted as dropped", name)
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/technosophos/drift/apidoc"
+	"github.com/technosophos/drift/metrics"
+	"github.com/technosophos/drift/pubsub"
+)
+
+// topicParam is the path parameter for every /v1/t/* route.
+var topicParam = apidoc.Param{Name: "topic", In: apidoc.InPath, Description: "The name of the topic."}
+
+// apiSpec declares the parameters, headers, and responses of each route.
+//
+// Keys are route names in the registry. Routes without an entry here are
+// still listed in the API description, just with less detail.
+var apiSpec = &apidoc.Spec{
+	Title:   "Drift",
+	Version: "v1",
+	Endpoints: map[string]apidoc.Endpoint{
+		"GET /ping": {
+			Responses: map[int]apidoc.Response{
+				200: {Description: "The server is up.", ContentType: "text/plain"},
+			},
+		},
+		"GET /healthz": {
+			Responses: map[int]apidoc.Response{
+				200: {Description: "The server is alive.", ContentType: "application/json"},
+				503: {Description: "The server is unhealthy.", ContentType: "application/json"},
+			},
+		},
+		"GET /readyz": {
+			Responses: map[int]apidoc.Response{
+				200: {Description: "The server is ready to take traffic.", ContentType: "application/json"},
+				503: {Description: "The server is not ready.", ContentType: "application/json"},
+			},
+		},
+		"GET /metrics": {
+			Responses: map[int]apidoc.Response{
+				200: {Description: "Server metrics.", ContentType: metrics.ContentType},
+			},
+		},
+		"GET /v1/time": {
+			Params: []apidoc.Param{
+				{Name: "format", In: apidoc.InQuery, Description: "unix (whole UNIX seconds, the default), ms (UNIX milliseconds), or rfc3339 (RFC 3339 with nanoseconds)."},
+			},
+			Responses: map[int]apidoc.Response{
+				200: {Description: "The server time. Without a format, this is whole UNIX seconds, unlike the millisecond and nanosecond times elsewhere in the API, to stay compatible with older clients. Ask for ms or rfc3339 to get more precision.", ContentType: "text/plain"},
+			},
+		},
+		"GET /v1/openapi.json": {
+			Responses: map[int]apidoc.Response{
+				200: {Description: "This API description.", ContentType: "application/json"},
+			},
+		},
+		"GET /": {
+			Responses: map[int]apidoc.Response{
+				200: {Description: "The API reference.", ContentType: "text/html"},
+			},
+		},
+		"GET /v1/admin/export": {
+			Params: []apidoc.Param{
+				{Name: "topic", In: apidoc.InQuery, Description: "A topic to export. May be repeated. Default is every topic."},
+			},
+			Responses: map[int]apidoc.Response{
+				200: {Description: "A history archive: newline-delimited JSON, with a header line followed by one line per message.", ContentType: pubsub.ArchiveContentType},
+				404: {Description: "A named topic does not exist."},
+			},
+		},
+		"POST /v1/admin/import": {
+			Body: pubsub.ArchiveContentType,
+			Responses: map[int]apidoc.Response{
+				200: {Description: "The number of messages imported for each topic.", ContentType: "application/json"},
+				400: {Description: "The archive could not be imported completely. The response shows what was imported.", ContentType: "application/json"},
+				413: {Description: "The archive is larger than the server's body limit. Messages before the limit were imported."},
+			},
+		},
+		"PUT /v1/t/*": {
+			Params: []apidoc.Param{
+				topicParam,
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XHistoryMaxAge),
+					In:          apidoc.InHeader,
+					Description: "Drop history messages older than this, in seconds or as a duration such as 1h30m.",
+				},
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XHistoryMaxBytes),
+					In:          apidoc.InHeader,
+					Description: "Keep at most this many bytes of messages in history, dropping the oldest first.",
+					Type:        "integer",
+				},
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XHistoryCompact),
+					In:          apidoc.InHeader,
+					Description: "If true, keep only the latest message for each key in history.",
+					Type:        "boolean",
+				},
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XTopicEphemeral),
+					In:          apidoc.InHeader,
+					Description: "If true, delete the topic when its last subscriber leaves.",
+					Type:        "boolean",
+				},
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XTopicMaxMessageBytes),
+					In:          apidoc.InHeader,
+					Description: "Refuse messages larger than this many bytes. It cannot raise the server's limit.",
+					Type:        "integer",
+				},
+			},
+			Body: "application/json",
+			Responses: map[int]apidoc.Response{
+				200: {Description: "The topic exists."},
+				400: {Description: "A header or the topic descriptor is invalid."},
+				413: {Description: "The topic descriptor is too large."},
+			},
+		},
+		"POST /v1/t/*": {
+			Params: []apidoc.Param{
+				topicParam,
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XMessageTTL),
+					In:          apidoc.InHeader,
+					Description: "Drop the message from history after this long, in seconds or as a duration such as 1h30m.",
+				},
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XMessageKey),
+					In:          apidoc.InHeader,
+					Description: "The key of the message. In a compacted topic, it replaces the previous message with this key, and an empty message deletes the key.",
+				},
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XMessageRetain),
+					In:          apidoc.InHeader,
+					Description: "If true, keep the message as the topic's retained message, which is sent first to every new subscriber. An empty retained message clears it.",
+					Type:        "boolean",
+				},
+				{
+					Name:        "X-Meta-*",
+					In:          apidoc.InHeader,
+					Description: "Metadata that subscribers can filter on. X-Meta-Region: eu sets the region field to eu.",
+				},
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XSchemaVersion),
+					In:          apidoc.InHeader,
+					Description: "Check the message against this version of the topic's schema, rather than the latest.",
+					Type:        "integer",
+				},
+			},
+			Body: "application/octet-stream",
+			Responses: map[int]apidoc.Response{
+				200: {Description: "The message was published."},
+				400: {Description: "A header is invalid."},
+				404: {Description: "The topic does not exist, and the server does not create topics implicitly."},
+				413: {Description: "The message is larger than the topic's limit."},
+				422: {Description: "The message does not match the topic's schema, or the schema version does not exist. The response lists what is wrong.", ContentType: "application/json"},
+			},
+		},
+		"GET /v1/t/*": {
+			Params: []apidoc.Param{
+				topicParam,
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XHistorySince),
+					In:          apidoc.InHeader,
+					Description: "Replay history newer than this time before streaming new messages. Accepts an RFC 3339 time with up to nanosecond precision, UNIX seconds with an optional fraction, or UNIX milliseconds.",
+				},
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XHistoryLength),
+					In:          apidoc.InHeader,
+					Description: "Replay at most this many history messages before streaming new messages.",
+					Type:        "integer",
+				},
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XFilter),
+					In:          apidoc.InHeader,
+					Description: "Only send messages whose metadata matches this filter expression, such as region == \"eu\" && priority > 3. Applies to history and the retained message too.",
+				},
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XJSONFilter),
+					In:          apidoc.InHeader,
+					Description: "Only send JSON messages that match this filter expression, with JSON Pointers as fields, such as /type == \"order\" && /total > 100. Messages that are not JSON are not sent.",
+				},
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XJSONFields),
+					In:          apidoc.InHeader,
+					Description: "Send only these fields of JSON messages, as a comma separated list of JSON Pointers, such as /id,/customer/name.",
+				},
+				{
+					Name:        http.CanonicalHeaderKey(pubsub.XStreamEvents),
+					In:          apidoc.InHeader,
+					Description: "If true, frame the stream so that it carries control events, such as heartbeats, as well as messages.",
+					Type:        "boolean",
+				},
+			},
+			Responses: map[int]apidoc.Response{
+				200: {
+					Description: "A stream of messages. Requires HTTP/2.",
+					ContentType: "application/octet-stream",
+					Headers: []apidoc.Header{
+						{
+							Name:        http.CanonicalHeaderKey(pubsub.XHistoryEnabled),
+							Description: "Whether the topic keeps history.",
+						},
+						{
+							Name:        http.CanonicalHeaderKey(pubsub.XStreamEvents),
+							Description: "True if the stream is framed.",
+						},
+						{
+							Name:        http.CanonicalHeaderKey(pubsub.XCloseReason),
+							Description: "A trailer sent when the server ends the stream: deleted, expired, or shutdown.",
+						},
+					},
+				},
+				400: {Description: "The filter expression or JSON view is invalid."},
+				404: {Description: "The topic does not exist, and the server does not create topics implicitly."},
+				503: {Description: "The server is shutting down."},
+			},
+		},
+		"GET /v1/t/*/history": {
+			Params: []apidoc.Param{
+				topicParam,
+				{Name: "from", In: apidoc.InQuery, Description: "The first message to return, as a sequence number or an RFC 3339 time."},
+				{Name: "to", In: apidoc.InQuery, Description: "The last message to return, as a sequence number or an RFC 3339 time."},
+				{Name: "limit", In: apidoc.InQuery, Description: "The most messages to return.", Type: "integer"},
+			},
+			Responses: map[int]apidoc.Response{
+				200: {Description: "A page of history. If there are more messages, next is the sequence number to query from.", ContentType: "application/json"},
+				400: {Description: "The query is invalid."},
+				404: {Description: "The topic does not exist or has no history."},
+			},
+		},
+		"PUT /v1/t/*/schema": {
+			Params: []apidoc.Param{topicParam},
+			Body:   "application/schema+json",
+			Responses: map[int]apidoc.Response{
+				200: {Description: "The version of the schema. A schema that is the same as the latest version does not add a new one.", ContentType: "application/json"},
+				400: {Description: "The schema is invalid, or uses a keyword that is not supported."},
+				404: {Description: "The topic does not exist."},
+				413: {Description: "The schema is too large."},
+			},
+		},
+		"GET /v1/t/*/schema": {
+			Params: []apidoc.Param{
+				topicParam,
+				{Name: "version", In: apidoc.InQuery, Description: "The version to get. Default is the latest.", Type: "integer"},
+			},
+			Responses: map[int]apidoc.Response{
+				200: {Description: "The schema and its version.", ContentType: "application/json"},
+				400: {Description: "The version is invalid."},
+				404: {Description: "The topic or the version does not exist."},
+			},
+		},
+		"POST /v1/t/*/webhooks": {
+			Params: []apidoc.Param{topicParam},
+			Body:   "application/json",
+			Responses: map[int]apidoc.Response{
+				201: {Description: "The webhook was registered.", ContentType: "application/json"},
+				400: {Description: "The webhook description is invalid."},
+				413: {Description: "The webhook description is too large."},
+				404: {Description: "The topic does not exist, and the server does not create topics implicitly."},
+			},
+		},
+		"GET /v1/t/*/webhooks": {
+			Params: []apidoc.Param{topicParam},
+			Responses: map[int]apidoc.Response{
+				200: {Description: "The webhooks on the topic.", ContentType: "application/json"},
+			},
+		},
+		"DELETE /v1/t/*/webhooks/*": {
+			Params: []apidoc.Param{
+				topicParam,
+				{Name: "id", In: apidoc.InPath, Description: "The ID of the webhook.", Type: "integer"},
+			},
+			Responses: map[int]apidoc.Response{
+				200: {Description: "The webhook was removed."},
+				400: {Description: "The webhook ID is invalid."},
+				404: {Description: "The topic has no such webhook."},
+			},
+		},
+		"HEAD /v1/t/*": {
+			Params: []apidoc.Param{topicParam},
+			Responses: map[int]apidoc.Response{
+				200: {Description: "The topic exists."},
+				404: {Description: "The topic does not exist."},
+			},
+		},
+		"DELETE /v1/t/*": {
+			Params: []apidoc.Param{topicParam},
+			Responses: map[int]apidoc.Response{
+				200: {Description: "The topic was deleted."},
+			},
+		},
+	},
+}
@@ -3,16 +3,29 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Masterminds/cookoo"
 	cfmt "github.com/Masterminds/cookoo/fmt"
 	"github.com/Masterminds/cookoo/web"
 
+	"github.com/technosophos/drift/apidoc"
 	"github.com/technosophos/drift/httputil"
+	"github.com/technosophos/drift/logging"
+	"github.com/technosophos/drift/metrics"
 	"github.com/technosophos/drift/pubsub"
 
-	"github.com/bradfitz/http2"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var helpTemplate = `<html>
@@ -28,9 +41,47 @@ var helpTemplate = `<html>
 </body>
 </html>`
 
+var (
+	addr            = flag.String("addr", ":5500", "Address to listen on")
+	unixSocket      = flag.String("unix", "", "Also listen on this Unix socket. Connections on it use cleartext HTTP/2 (h2c) or HTTP/1.1")
+	cleartext       = flag.Bool("h2c", false, "Serve cleartext HTTP/2 with prior knowledge (h2c) instead of TLS. Only use this where TLS is terminated elsewhere")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for subscribers to drain on shutdown")
+	logLevel        = flag.String("log-level", "info", "Log level: debug, info, warn, or error. Message payloads are only logged at debug")
+	historyMaxAge   = flag.Duration("history-max-age", 0, "Drop history messages older than this. Topics created with X-History-Max-Age override it. 0 keeps history until it is full")
+	historyMaxBytes = flag.Int64("history-max-bytes", 0, "The most bytes of messages each topic keeps in history. Topics created with X-History-Max-Bytes override it. 0 is unlimited")
+	historyMemory   = flag.Int64("history-memory", 0, "The most bytes of messages kept in the history of all topics together. The oldest messages are evicted first. 0 is unlimited")
+	historyGC       = flag.Duration("history-gc", 30*time.Second, "How often expired history messages and idle topics are removed")
+	topicIdle       = flag.Duration("topic-idle-timeout", 0, "Delete topics that have had no subscribers and no publishes for this long. 0 keeps topics until they are deleted")
+	autoCreate      = flag.Bool("auto-create", true, "Create topics when they are first published or subscribed to. If false, topics must be created with PUT")
+	maxMessage      = flag.Int64("max-message-bytes", 1<<20, "The largest message that can be published. Topics created with X-Topic-Max-Message-Bytes can lower it. 0 is unlimited")
+	maxBody         = flag.Int64("max-body-bytes", 10<<20, "The largest request body for anything other than a message, such as a schema, a webhook or a history import. 0 is unlimited")
+	maxHeader       = flag.Int("max-header-bytes", 64<<10, "The most bytes of request headers, including the request line for HTTP/1.1")
+	maxStreams      = flag.Uint("max-streams", 250, "The most concurrent HTTP/2 streams, such as subscriptions, on each connection")
+	denyPrivate     = flag.Bool("webhook-deny-private", false, "Refuse webhooks to loopback, private and link-local addresses")
+	heartbeat       = flag.Duration("heartbeat", 30*time.Second, "How often to send a heartbeat to subscribers that ask for stream events. 0 turns heartbeats off")
+)
+
 func main() {
+	flag.Parse()
+
+	lvl, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		logging.Default.Errorf("%s", err)
+		os.Exit(2)
+	}
+	logging.Default.SetLevel(lvl)
+	pubsub.DefaultMaxHistoryAge = *historyMaxAge
+	pubsub.DefaultMaxHistoryBytes = *historyMaxBytes
+	pubsub.HistoryBudget.SetMax(*historyMemory)
+	pubsub.HeartbeatInterval = *heartbeat
+	pubsub.WebhookDenyPrivate = *denyPrivate
+	pubsub.MaxMessageBytes = *maxMessage
+	httputil.MaxBodyBytes = *maxBody
+
+	// MaxHeaderBytes also limits the size of HTTP/2 header lists.
 	srv := &http.Server{
-		Addr: ":5500",
+		Addr:           *addr,
+		MaxHeaderBytes: *maxHeader,
 	}
 
 	reg, router, cxt := cookoo.Cookoo()
@@ -40,13 +91,116 @@ func main() {
 	// Our main datasource is the Medium, which manages channels.
 	m := pubsub.NewMedium()
 	cxt.AddDatasource(pubsub.MediumDS, m)
+	m.SetIdleTimeout(*topicIdle)
+	m.SetAutoCreate(*autoCreate)
+	m.CollectHistory(*historyGC)
 	cxt.Put("routes", reg.Routes())
 
-	http2.ConfigureServer(srv, &http2.Server{})
+	h2 := &http2.Server{MaxConcurrentStreams: uint32(*maxStreams)}
+	if err := http2.ConfigureServer(srv, h2); err != nil {
+		logging.Default.Errorf("Could not configure HTTP/2: %s", err)
+		os.Exit(1)
+	}
+
+	handler := httputil.Instrument(web.NewCookooHandler(reg, router, cxt))
+	srv.Handler = handler
+	if *cleartext {
+		// The h2c handler shares h2 with the TLS configuration, so h2c
+		// connections also get a GOAWAY on shutdown.
+		srv.Handler = h2c.NewHandler(handler, h2)
+	}
+
+	servers := []*http.Server{srv}
+	go serve(func() error {
+		if *cleartext {
+			return srv.ListenAndServe()
+		}
+		return srv.ListenAndServeTLS("server.crt", "server.key")
+	})
+
+	if len(*unixSocket) > 0 {
+		ln, err := listenUnix(*unixSocket)
+		if err != nil {
+			logging.Default.Errorf("Could not listen on %s: %s", *unixSocket, err)
+			os.Exit(1)
+		}
+		usrv := &http.Server{Handler: h2c.NewHandler(handler, h2), MaxHeaderBytes: *maxHeader}
+		servers = append(servers, usrv)
+		go serve(func() error { return usrv.Serve(ln) })
+	}
+
+	shutdown(servers, m, *shutdownTimeout)
+}
+
+// serve runs a blocking serve function, and exits if it fails.
+func serve(fn func() error) {
+	if err := fn(); err != http.ErrServerClosed {
+		logging.Default.Errorf("Server failed: %s", err)
+		os.Exit(1)
+	}
+}
+
+// listenUnix listens on a Unix socket, removing a stale socket file first.
+// If a server is still listening on the socket, it is an error.
+//
+// The socket file is removed again when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		// Only a socket that nothing is listening on is stale. Taking over
+		// a live one would silently cut off the server using it.
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, fmt.Errorf("cannot tell whether %s is in use: %s", path, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// shutdown waits for SIGTERM or SIGINT, and then gracefully stops the servers.
+//
+// The listeners are closed and HTTP/2 clients are sent a GOAWAY. The Medium
+// then refuses new subscriptions and closes its topics, which flushes every
+// subscription's queue before its stream ends. Connections that are still
+// open when the deadline passes are closed forcibly.
+func shutdown(servers []*http.Server, m *pubsub.Medium, deadline time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	<-sig
+	logging.Default.Infof("Shutting down. Waiting up to %s for subscribers to drain.", deadline)
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	done := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				srv.Close()
+			}
+			done <- err
+		}(srv)
+	}
 
-	srv.Handler = web.NewCookooHandler(reg, router, cxt)
+	if err := m.Shutdown(); err != nil {
+		logging.Default.Errorf("Error shutting down medium: %s", err)
+	}
 
-	srv.ListenAndServeTLS("server.crt", "server.key")
+	for range servers {
+		if err := <-done; err != nil {
+			logging.Default.Warnf("Subscribers did not drain in time: %s", err)
+		}
+	}
 }
 
 func buildRegistry(reg *cookoo.Registry, router *cookoo.Router, cxt cookoo.Context) {
@@ -64,9 +218,45 @@ func buildRegistry(reg *cookoo.Registry, router *cookoo.Router, cxt cookoo.Conte
 		},
 	})
 
+	reg.AddRoute(cookoo.Route{
+		Name: "GET /healthz",
+		Help: "Liveness check. Reports the health of the server as JSON.",
+		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "health",
+				Fn:   pubsub.Health,
+			},
+		},
+	})
+
+	reg.AddRoute(cookoo.Route{
+		Name: "GET /readyz",
+		Help: "Readiness check. Reports whether the medium, history store, and other components are ready, as JSON.",
+		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "health",
+				Fn:   pubsub.Health,
+				Using: []cookoo.Param{
+					{Name: "ready", DefaultValue: true},
+				},
+			},
+		},
+	})
+
+	reg.AddRoute(cookoo.Route{
+		Name: "GET /metrics",
+		Help: "Server metrics in the Prometheus text format.",
+		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "metrics",
+				Fn:   metrics.Serve,
+			},
+		},
+	})
+
 	reg.AddRoute(cookoo.Route{
 		Name: "GET /v1/time",
-		Help: "Print the current server time as a UNIX seconds-since-epoch",
+		Help: "Print the current server time as a UNIX seconds-since-epoch, or in the format given by ?format=ms or ?format=rfc3339",
 		Does: cookoo.Tasks{
 			cookoo.Cmd{
 				Name: "timestamp",
@@ -106,14 +296,56 @@ func buildRegistry(reg *cookoo.Registry, router *cookoo.Router, cxt cookoo.Conte
 		},
 	})
 
+	reg.AddRoute(cookoo.Route{
+		Name: "GET /v1/openapi.json",
+		Help: "A machine-readable OpenAPI description of this API.",
+		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "openapi",
+				Fn:   apidoc.Serve,
+				Using: []cookoo.Param{
+					{Name: "spec", DefaultValue: apiSpec},
+					{Name: "routes", From: "cxt:routes"},
+				},
+			},
+		},
+	})
+
+	reg.AddRoute(cookoo.Route{
+		Name: "GET /v1/admin/export",
+		Help: "Export the history of some or all topics as an archive, for backup or migration.",
+		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "export",
+				Fn:   pubsub.ExportHistory,
+			},
+		},
+	})
+
+	reg.AddRoute(cookoo.Route{
+		Name: "POST /v1/admin/import",
+		Help: "Import a history archive made by an export.",
+		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "import",
+				Fn:   pubsub.ImportHistory,
+			},
+		},
+	})
+
 	reg.AddRoute(cookoo.Route{
 		Name: "PUT /v1/t/*",
 		Help: "Create a new topic.",
 		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "postBody",
+				Fn:   httputil.BufferPost,
+			},
 			cookoo.Cmd{
 				Name: "topic",
 				Fn:   pubsub.CreateTopic,
 				Using: []cookoo.Param{
+					{Name: "descriptor", From: "cxt:postBody"},
 					{Name: "topic", From: "path:2"},
 				},
 			},
@@ -124,9 +356,19 @@ func buildRegistry(reg *cookoo.Registry, router *cookoo.Router, cxt cookoo.Conte
 		Name: "POST /v1/t/*",
 		Help: "Publish a message to a channel.",
 		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "messageLimit",
+				Fn:   pubsub.MessageLimit,
+				Using: []cookoo.Param{
+					{Name: "topic", From: "path:2"},
+				},
+			},
 			cookoo.Cmd{
 				Name: "postBody",
 				Fn:   httputil.BufferPost,
+				Using: []cookoo.Param{
+					{Name: "maxBytes", From: "cxt:messageLimit"},
+				},
 			},
 			cookoo.Cmd{
 				Name: "publish",
@@ -142,19 +384,107 @@ func buildRegistry(reg *cookoo.Registry, router *cookoo.Router, cxt cookoo.Conte
 	reg.AddRoute(cookoo.Route{
 		Name: "GET /v1/t/*",
 		Help: "Subscribe to a channel.",
+		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "subscribe",
+				Fn:   pubsub.ReplayAndSubscribe,
+				Using: []cookoo.Param{
+					{Name: "topic", From: "path:2"},
+				},
+			},
+		},
+	})
+
+	reg.AddRoute(cookoo.Route{
+		Name: "GET /v1/t/*/history",
+		Help: "Read a range of a channel's history as JSON, without subscribing.",
 		Does: cookoo.Tasks{
 			cookoo.Cmd{
 				Name: "history",
-				Fn:   pubsub.ReplayHistory,
+				Fn:   pubsub.QueryHistory,
 				Using: []cookoo.Param{
 					{Name: "topic", From: "path:2"},
 				},
 			},
+		},
+	})
+
+	reg.AddRoute(cookoo.Route{
+		Name: "PUT /v1/t/*/schema",
+		Help: "Add a new version of a channel's JSON Schema.",
+		Does: cookoo.Tasks{
 			cookoo.Cmd{
-				Name: "subscribe",
-				Fn:   pubsub.Subscribe,
+				Name: "postBody",
+				Fn:   httputil.BufferPost,
+			},
+			cookoo.Cmd{
+				Name: "schema",
+				Fn:   pubsub.SetSchema,
+				Using: []cookoo.Param{
+					{Name: "body", From: "cxt:postBody"},
+					{Name: "topic", From: "path:2"},
+				},
+			},
+		},
+	})
+
+	reg.AddRoute(cookoo.Route{
+		Name: "GET /v1/t/*/schema",
+		Help: "Get a version of a channel's JSON Schema.",
+		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "schema",
+				Fn:   pubsub.GetSchema,
+				Using: []cookoo.Param{
+					{Name: "topic", From: "path:2"},
+				},
+			},
+		},
+	})
+
+	reg.AddRoute(cookoo.Route{
+		Name: "POST /v1/t/*/webhooks",
+		Help: "Register a webhook that receives every message published to a channel.",
+		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "postBody",
+				Fn:   httputil.BufferPost,
+			},
+			cookoo.Cmd{
+				Name: "webhook",
+				Fn:   pubsub.CreateWebhook,
+				Using: []cookoo.Param{
+					{Name: "body", From: "cxt:postBody"},
+					{Name: "topic", From: "path:2"},
+				},
+			},
+		},
+	})
+
+	reg.AddRoute(cookoo.Route{
+		Name: "GET /v1/t/*/webhooks",
+		Help: "List the webhooks registered on a channel.",
+		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "webhooks",
+				Fn:   pubsub.ListWebhooks,
+				Using: []cookoo.Param{
+					{Name: "topic", From: "path:2"},
+				},
+			},
+		},
+	})
+
+	reg.AddRoute(cookoo.Route{
+		Name: "DELETE /v1/t/*/webhooks/*",
+		Help: "Remove a webhook from a channel.",
+		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "delete",
+				Fn:   pubsub.DeleteWebhook,
 				Using: []cookoo.Param{
 					{Name: "topic", From: "path:2"},
+					{Name: "id", From: "path:4"},
 				},
 			},
 		},
@@ -17,18 +17,21 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/bradfitz/http2"
-	"github.com/bradfitz/http2/hpack"
+	"github.com/technosophos/drift/logging"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
 )
 
+var logger = logging.Default.With(logging.Fields{"component": "transport"})
+
 // MPB: copied from http2
 
 var (
@@ -52,20 +55,35 @@ type Transport struct {
 	// TODO: remove this and make more general with a TLS dial hook, like http
 	InsecureTLSDial bool
 
+	// Dial, if set, is used to open connections instead of dialing TCP.
+	//
+	// It is called with the network "tcp" and the host:port of the URL, so
+	// it may connect somewhere else entirely, such as a Unix socket. For
+	// https:// URLs, TLS is negotiated over the connection it returns.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// AllowHTTP permits http:// URLs. These are dialed without TLS and
+	// spoken to with HTTP/2 directly (h2c with prior knowledge), so the
+	// server must support that.
+	AllowHTTP bool
+
 	connMu sync.Mutex
 	conns  map[string][]*clientConn // key is host:port
 }
 
 type clientConn struct {
 	t        *Transport
-	tconn    *tls.Conn
-	tlsState *tls.ConnectionState
-	connKey  []string // key(s) this connection is cached in, in t.conns
+	tconn    net.Conn
+	tlsState *tls.ConnectionState // nil for cleartext connections
+	connKey  []string             // key(s) this connection is cached in, in t.conns
 
 	readerDone chan struct{} // closed on error
 	readerErr  error         // set before readerDone is closed
 	hdec       *hpack.Decoder
 	nextRes    *http.Response
+	// nextTrailer collects trailers while they are decoded. It is nil
+	// when a response's headers are being decoded instead.
+	nextTrailer http.Header
 
 	mu           sync.Mutex
 	closed       bool
@@ -94,12 +112,23 @@ type clientStream struct {
 	dataToChan bool
 	data       chan []byte
 	cancel     chan bool
+
+	// gotHeaders is set once the response headers arrive. Any HEADERS
+	// frame after that carries trailers. Only the read loop uses it.
+	gotHeaders bool
+	// mu guards trailer, which is set when the stream ends.
+	mu      sync.Mutex
+	trailer http.Header
 }
 
 // Listener makes a stream into something that can be listened to.
 type Listener interface {
 	Stream() (chan []byte, error)
 	Cancel()
+	// Trailer returns the trailers the server sent at the end of the
+	// stream. It is nil until the stream has ended, and empty if the
+	// stream ended without trailers.
+	Trailer() http.Header
 }
 
 func (c *clientStream) Stream() (chan []byte, error) {
@@ -113,6 +142,28 @@ func (c *clientStream) Cancel() {
 	c.cancel <- true
 }
 
+func (c *clientStream) Trailer() http.Header {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.trailer
+}
+
+// end records that the stream has ended, along with its trailers, if any.
+//
+// It must be called before the data channel is closed, so that a listener
+// that sees the channel close can read the trailers.
+func (c *clientStream) end(trailer http.Header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.trailer != nil {
+		return
+	}
+	if trailer == nil {
+		trailer = http.Header{}
+	}
+	c.trailer = trailer
+}
+
 type stickyErrWriter struct {
 	w   io.Writer
 	err *error
@@ -128,21 +179,17 @@ func (sew stickyErrWriter) Write(p []byte) (n int, err error) {
 }
 
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if req.URL.Scheme != "https" {
+	if !t.supportsScheme(req.URL.Scheme) {
 		if t.Fallback == nil {
 			return nil, errors.New("http2: unsupported scheme and no Fallback")
 		}
 		return t.Fallback.RoundTrip(req)
 	}
 
-	host, port, err := net.SplitHostPort(req.URL.Host)
-	if err != nil {
-		host = req.URL.Host
-		port = "443"
-	}
+	host, port := splitHostPort(req.URL)
 
 	for {
-		cc, err := t.getClientConn(host, port)
+		cc, err := t.getClientConn(host, port, req.URL.Scheme == "https")
 		if err != nil {
 			return nil, err
 		}
@@ -157,18 +204,14 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 }
 func (t *Transport) Listen(req *http.Request) (*http.Response, Listener, error) {
-	if req.URL.Scheme != "https" {
+	if !t.supportsScheme(req.URL.Scheme) {
 		return nil, nil, errors.New("http2: unsupported scheme and no Fallback")
 	}
 
-	host, port, err := net.SplitHostPort(req.URL.Host)
-	if err != nil {
-		host = req.URL.Host
-		port = "443"
-	}
+	host, port := splitHostPort(req.URL)
 
 	for {
-		cc, err := t.getClientConn(host, port)
+		cc, err := t.getClientConn(host, port, req.URL.Scheme == "https")
 		if err != nil {
 			return nil, nil, err
 		}
@@ -183,6 +226,25 @@ func (t *Transport) Listen(req *http.Request) (*http.Response, Listener, error)
 	}
 }
 
+// supportsScheme returns true if this transport can speak HTTP/2 to the scheme.
+func (t *Transport) supportsScheme(scheme string) bool {
+	return scheme == "https" || (scheme == "http" && t.AllowHTTP)
+}
+
+// splitHostPort gets the host and port from a URL, using the scheme's
+// default port if none is given.
+func splitHostPort(u *url.URL) (string, string) {
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return host, port
+}
+
 // CloseIdleConnections closes any connections which were previously
 // connected from previous requests but are now sitting idle.
 // It does not interrupt any connections currently in use.
@@ -230,11 +292,15 @@ func filterOutClientConn(in []*clientConn, exclude *clientConn) []*clientConn {
 	return out
 }
 
-func (t *Transport) getClientConn(host, port string) (*clientConn, error) {
+func (t *Transport) getClientConn(host, port string, useTLS bool) (*clientConn, error) {
 	t.connMu.Lock()
 	defer t.connMu.Unlock()
 
 	key := net.JoinHostPort(host, port)
+	if !useTLS {
+		// Never share a cleartext connection with a TLS one.
+		key = "h2c:" + key
+	}
 
 	for _, cc := range t.conns[key] {
 		if cc.canTakeNewRequest() {
@@ -244,7 +310,13 @@ func (t *Transport) getClientConn(host, port string) (*clientConn, error) {
 	if t.conns == nil {
 		t.conns = make(map[string][]*clientConn)
 	}
-	cc, err := t.newClientConn(host, port, key)
+	var cc *clientConn
+	var err error
+	if useTLS {
+		cc, err = t.newClientConn(host, port, key)
+	} else {
+		cc, err = t.newCleartextClientConn(host, port, key)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -258,11 +330,13 @@ func (t *Transport) newClientConn(host, port, key string) (*clientConn, error) {
 		NextProtos:         []string{http2.NextProtoTLS},
 		InsecureSkipVerify: t.InsecureTLSDial,
 	}
-	tconn, err := tls.Dial("tcp", host+":"+port, cfg)
+	conn, err := t.dial(net.JoinHostPort(host, port))
 	if err != nil {
 		return nil, err
 	}
+	tconn := tls.Client(conn, cfg)
 	if err := tconn.Handshake(); err != nil {
+		conn.Close()
 		return nil, err
 	}
 	if !t.InsecureTLSDial {
@@ -278,6 +352,39 @@ func (t *Transport) newClientConn(host, port, key string) (*clientConn, error) {
 	if !state.NegotiatedProtocolIsMutual {
 		return nil, errors.New("could not negotiate protocol mutually")
 	}
+	return t.startClientConn(tconn, &state, key)
+}
+
+// newCleartextClientConn dials an HTTP/2 connection without TLS.
+//
+// There is no upgrade from HTTP/1.1. The client preface is sent right away,
+// which requires that the server supports h2c with prior knowledge.
+func (t *Transport) newCleartextClientConn(host, port, key string) (*clientConn, error) {
+	conn, err := t.dial(net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	return t.startClientConn(conn, nil, key)
+}
+
+func (t *Transport) dial(addr string) (net.Conn, error) {
+	if t.Dial != nil {
+		return t.Dial("tcp", addr)
+	}
+	return net.Dial("tcp", addr)
+}
+
+// UnixDialer returns a Dial function that always connects to the Unix
+// socket at path, regardless of the address it is asked for.
+func UnixDialer(path string) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		return net.Dial("unix", path)
+	}
+}
+
+// startClientConn sends the client preface and settings over an
+// established connection, and starts reading frames.
+func (t *Transport) startClientConn(tconn net.Conn, state *tls.ConnectionState, key string) (*clientConn, error) {
 	if _, err := tconn.Write(clientPreface); err != nil {
 		return nil, err
 	}
@@ -286,7 +393,7 @@ func (t *Transport) newClientConn(host, port, key string) (*clientConn, error) {
 		t:                    t,
 		tconn:                tconn,
 		connKey:              []string{key}, // TODO: cert's validated hostnames too
-		tlsState:             &state,
+		tlsState:             state,
 		readerDone:           make(chan struct{}),
 		nextStreamID:         1,
 		maxFrameSize:         16 << 10, // spec default
@@ -329,7 +436,7 @@ func (t *Transport) newClientConn(host, port, key string) (*clientConn, error) {
 			cc.initialWindowSize = s.Val
 		default:
 			// TODO(bradfitz): handle more
-			log.Printf("Unhandled Setting: %v", s)
+			logger.Debugf("Unhandled Setting: %v", s)
 		}
 		return nil
 	})
@@ -483,7 +590,7 @@ func (cc *clientConn) listen(req *http.Request) (*http.Response, *clientStream,
 	re := <-cs.resc
 	if re.err != nil {
 		//return nil, re.err
-		fmt.Printf("Error closing client stream: %s", re.err)
+		logger.Warnf("Error closing client stream: %s", re.err)
 	}
 	res := re.res
 	res.Request = req
@@ -509,7 +616,11 @@ func (cc *clientConn) encodeHeaders(req *http.Request) []byte {
 	cc.writeHeader(":authority", host) // probably not right for all sites
 	cc.writeHeader(":method", req.Method)
 	cc.writeHeader(":path", path)
-	cc.writeHeader(":scheme", "https")
+	scheme := req.URL.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	cc.writeHeader(":scheme", scheme)
 
 	for k, vv := range req.Header {
 		lowKey := strings.ToLower(k)
@@ -524,7 +635,7 @@ func (cc *clientConn) encodeHeaders(req *http.Request) []byte {
 }
 
 func (cc *clientConn) writeHeader(name, value string) {
-	log.Printf("sending %q = %q", name, value)
+	logger.Debugf("sending %q = %q", name, value)
 	cc.henc.WriteField(hpack.HeaderField{Name: name, Value: value})
 }
 
@@ -566,7 +677,8 @@ func (cc *clientConn) cancelLoop() {
 		}
 		// Run removals.
 		for streamID, cs := range remove {
-			log.Printf("Canceling %d\n", streamID)
+			logger.Debugf("Canceling %d", streamID)
+			cs.end(nil)
 			if cs.dataToChan {
 				close(cs.data)
 			}
@@ -593,6 +705,7 @@ func (cc *clientConn) readLoop() {
 			err = io.ErrUnexpectedEOF
 		}
 		for _, cs := range activeRes {
+			cs.end(nil)
 			if cs.dataToChan {
 				close(cs.data)
 			}
@@ -603,6 +716,10 @@ func (cc *clientConn) readLoop() {
 	// continueStreamID is the stream ID we're waiting for
 	// continuation frames for.
 	var continueStreamID uint32
+	// endAfterHeaders is set when a HEADERS frame ends its stream, but
+	// its header block goes on in CONTINUATION frames. The stream ends
+	// with the last of them.
+	var endAfterHeaders bool
 
 	for {
 		f, err := cc.fr.ReadFrame()
@@ -610,25 +727,35 @@ func (cc *clientConn) readLoop() {
 			cc.readerErr = err
 			return
 		}
-		log.Printf("Transport received %v: %#v", f.Header(), f)
+		logger.Debugf("Transport received %v", f.Header())
 
 		streamID := f.Header().StreamID
 
 		_, isContinue := f.(*http2.ContinuationFrame)
 		if isContinue {
 			if streamID != continueStreamID {
-				log.Printf("Protocol violation: got CONTINUATION with id %d; want %d", streamID, continueStreamID)
+				logger.Errorf("Protocol violation: got CONTINUATION with id %d; want %d", streamID, continueStreamID)
 				cc.readerErr = http2.ConnectionError(http2.ErrCodeProtocol)
 				return
 			}
 		} else if continueStreamID != 0 {
 			// Continue frames need to be adjacent in the stream
 			// and we were in the middle of headers.
-			log.Printf("Protocol violation: got %T for stream %d, want CONTINUATION for %d", f, streamID, continueStreamID)
+			logger.Errorf("Protocol violation: got %T for stream %d, want CONTINUATION for %d", f, streamID, continueStreamID)
 			cc.readerErr = http2.ConnectionError(http2.ErrCodeProtocol)
 			return
 		}
 
+		headersEnded := false
+		if he, ok := f.(headersEnder); ok {
+			headersEnded = he.HeadersEnded()
+			if headersEnded {
+				continueStreamID = 0
+			} else {
+				continueStreamID = streamID
+			}
+		}
+
 		if streamID%2 == 0 {
 			// Ignore streams pushed from the server for now.
 			// These always have an even stream id.
@@ -638,28 +765,40 @@ func (cc *clientConn) readLoop() {
 		if ff, ok := f.(streamEnder); ok {
 			streamEnded = ff.StreamEnded()
 		}
+		if _, isHeaders := f.(*http2.HeadersFrame); isHeaders && streamEnded && !headersEnded {
+			endAfterHeaders, streamEnded = true, false
+		} else if isContinue && headersEnded && endAfterHeaders {
+			endAfterHeaders, streamEnded = false, true
+		}
 
 		cs := cc.streamByID(streamID, streamEnded)
 		if cs == nil {
-			log.Printf("Received frame for untracked stream ID %d", streamID)
+			logger.Debugf("Received frame for untracked stream ID %d", streamID)
 			continue
 		}
 
 		switch f := f.(type) {
 		case *http2.HeadersFrame:
-			cc.nextRes = &http.Response{
-				Proto:      "HTTP/2.0",
-				ProtoMajor: 2,
-				Header:     make(http.Header),
+			if cs.gotHeaders {
+				// A second HEADERS frame carries the stream's trailers.
+				cc.nextTrailer = make(http.Header)
+			} else {
+				cs.gotHeaders = true
+				cc.nextRes = &http.Response{
+					Proto:      "HTTP/2.0",
+					ProtoMajor: 2,
+					Header:     make(http.Header),
+				}
+				cs.pr, cs.pw = io.Pipe()
 			}
-			cs.pr, cs.pw = io.Pipe()
 			cc.hdec.Write(f.HeaderBlockFragment())
 		case *http2.ContinuationFrame:
 			cc.hdec.Write(f.HeaderBlockFragment())
 		case *http2.DataFrame:
-			log.Printf("DATA: %q", f.Data())
+			logger.Debugf("DATA: %s", logger.Payload(f.Data()))
 			if cs.dataToChan {
-				cs.data <- f.Data()
+				// The framer reuses its buffer for the next frame.
+				cs.data <- append([]byte(nil), f.Data()...)
 			} else {
 				cs.pw.Write(f.Data())
 			}
@@ -667,30 +806,18 @@ func (cc *clientConn) readLoop() {
 			cc.t.removeClientConn(cc)
 			if f.ErrCode != 0 {
 				// TODO: deal with GOAWAY more. particularly the error code
-				log.Printf("transport got GOAWAY with error code = %v", f.ErrCode)
+				logger.Warnf("transport got GOAWAY with error code = %v", f.ErrCode)
 			}
 			cc.setGoAway(f)
 		default:
-			log.Printf("Transport: unhandled response frame type %T", f)
-		}
-		headersEnded := false
-		if he, ok := f.(headersEnder); ok {
-			headersEnded = he.HeadersEnded()
-			if headersEnded {
-				continueStreamID = 0
-			} else {
-				continueStreamID = streamID
-			}
-		}
-
-		if streamEnded {
-			if cs.dataToChan {
-				close(cs.data)
-			}
-			cs.pw.Close()
-			delete(activeRes, streamID)
-		}
-		if headersEnded {
+			logger.Debugf("Transport: unhandled response frame type %T", f)
+		}
+		// Trailers end the stream, so they must be recorded before it is
+		// closed.
+		if headersEnded && cc.nextTrailer != nil {
+			cs.end(cc.nextTrailer)
+			cc.nextTrailer = nil
+		} else if headersEnded {
 			if cs == nil {
 				panic("couldn't find stream") // TODO be graceful
 			}
@@ -702,13 +829,27 @@ func (cc *clientConn) readLoop() {
 			activeRes[streamID] = cs
 			cs.resc <- resAndError{res: res}
 		}
+		if streamEnded {
+			cs.end(nil)
+			if cs.dataToChan {
+				close(cs.data)
+			}
+			cs.pw.Close()
+			delete(activeRes, streamID)
+		}
 	}
 }
 
 func (cc *clientConn) onNewHeaderField(f hpack.HeaderField) {
+	if cc.nextTrailer != nil {
+		if !strings.HasPrefix(f.Name, ":") {
+			cc.nextTrailer.Add(http.CanonicalHeaderKey(f.Name), f.Value)
+		}
+		return
+	}
 	// TODO: verifiy pseudo headers come before non-pseudo headers
 	// TODO: verifiy the status is set
-	log.Printf("Header field: %+v", f)
+	logger.Debugf("Header field: %+v", f)
 	if f.Name == ":status" {
 		code, err := strconv.Atoi(f.Value)
 		if err != nil {
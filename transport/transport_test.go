@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// serveFrames accepts one connection and, for each request on it, calls
+// respond with a framer and the request's stream ID.
+func serveFrames(t *testing.T, ln net.Listener, respond ...func(*http2.Framer, uint32)) {
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		t.Error(err)
+		return
+	}
+	fr := http2.NewFramer(conn, conn)
+	if err := fr.WriteSettings(); err != nil {
+		t.Error(err)
+		return
+	}
+	for _, fn := range respond {
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if hf, ok := f.(*http2.HeadersFrame); ok && hf.HeadersEnded() {
+				fn(fr, hf.StreamID)
+				break
+			}
+		}
+	}
+	// Wait for the client to hang up.
+	for {
+		if _, err := fr.ReadFrame(); err != nil {
+			return
+		}
+	}
+}
+
+// encode HPACK encodes header fields, in pairs of name and value.
+func encode(fields ...string) []byte {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	for i := 0; i < len(fields); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return buf.Bytes()
+}
+
+func TestTrailerContinuation(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	pad := strings.Repeat("p", 1000)
+	go serveFrames(t, ln, func(fr *http2.Framer, id uint32) {
+		fr.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: encode(":status", "200"), EndHeaders: true})
+		fr.WriteData(id, false, []byte("hello"))
+		// Split the trailers across a HEADERS frame, which ends the
+		// stream, and two CONTINUATION frames.
+		block := encode("x-close-reason", "overflow", "x-pad", pad)
+		third := len(block) / 3
+		fr.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: block[:third], EndStream: true})
+		fr.WriteContinuation(id, false, block[third:2*third])
+		fr.WriteContinuation(id, true, block[2*third:])
+	}, func(fr *http2.Framer, id uint32) {
+		fr.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: encode(":status", "204"), EndHeaders: true, EndStream: true})
+	})
+
+	tr := &Transport{AllowHTTP: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/v1/t/test", nil)
+	res, l, err := tr.Listen(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected 200, got %d", res.StatusCode)
+	}
+	data, _ := l.Stream()
+	var got []byte
+	for d := range data {
+		got = append(got, d...)
+	}
+	if string(got) != "hello" {
+		t.Errorf("Expected hello, got %q", got)
+	}
+	trailer := l.Trailer()
+	if r := trailer.Get("X-Close-Reason"); r != "overflow" {
+		t.Errorf("Expected the close reason overflow, got %q", r)
+	}
+	if trailer.Get("X-Pad") != pad {
+		t.Error("Expected the whole trailer block.")
+	}
+
+	// The connection is still usable after the split block.
+	done := make(chan *http.Response, 1)
+	go func() {
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- res
+	}()
+	select {
+	case res := <-done:
+		if res != nil && res.StatusCode != 204 {
+			t.Errorf("Expected 204, got %d", res.StatusCode)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Timed out waiting for a second response.")
+	}
+}